@@ -0,0 +1,74 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+func TestRouteFor(t *testing.T) {
+	a := New(nil, time.Second, time.Second, "urlstatus", nil)
+	a.identity.Region = "eu-west"
+	status := &ServerStatus{Url: "http://example.com", Tags: []string{"web", "public"}}
+	if route := a.routeFor(status); route != "urlstatus" {
+		t.Errorf("routeFor failed: expected urlstatus got %s\n", route)
+	}
+	a.exchange = "overseer"
+	if route := a.routeFor(status); route != "status.eu-west.web" {
+		t.Errorf("routeFor failed: expected status.eu-west.web got %s\n", route)
+	}
+	untagged := &ServerStatus{Url: "http://example.com"}
+	if route := a.routeFor(untagged); route != "status.eu-west.none" {
+		t.Errorf("routeFor failed: expected status.eu-west.none got %s\n", route)
+	}
+	a.partitions = 4
+	expected := PartitionQueue("status.eu-west.web", Partition(status.Url, 4))
+	if route := a.routeFor(status); route != expected {
+		t.Errorf("routeFor failed: expected %s got %s\n", expected, route)
+	}
+}
+
+func TestProbeServerTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+	client := &http.Client{Timeout: 50 * time.Millisecond}
+	start := time.Now()
+	status := probeServer(client, Target{Url: server.URL})
+	if status.Alive || time.Since(start) > time.Second {
+		t.Errorf("probeServer failed: expected timed out probe got alive %v after %v\n",
+			status.Alive, time.Since(start))
+	}
+}
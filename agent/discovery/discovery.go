@@ -0,0 +1,296 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package discovery contains the target discovery providers of the agent,
+// discovering targets from external sources like files, DNS records,
+// container labels or Kubernetes annotations and deriving their URLs and
+// tags through relabeling rules
+package discovery
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+// Reserved labels used to build a target out of its labels after the
+// relabeling, the URL is `__scheme__://__address____path__` unless `__url__`
+// is set. Labels prefixed with `__meta_` are set by the providers and are
+// available to the relabeling rules only.
+const (
+	AddressLabel  = "__address__"
+	SchemeLabel   = "__scheme__"
+	PathLabel     = "__path__"
+	URLLabel      = "__url__"
+	IntervalLabel = "__interval__"
+	TagsLabel     = "tags"
+	MetaPrefix    = "__meta_"
+)
+
+// Labels is the set of labels describing a discovered target
+type Labels map[string]string
+
+// copy return a copy of the labels
+func (l Labels) copy() Labels {
+	c := make(Labels, len(l))
+	for k, v := range l {
+		c[k] = v
+	}
+	return c
+}
+
+// Group is a set of targets discovered from the same source, e.g. a file or
+// a DNS name
+type Group struct {
+	Source  string
+	Targets []Labels
+}
+
+// Provider discovers groups of targets
+type Provider interface {
+	// Run discover targets until the context is cancelled, sending the
+	// whole set of groups discovered on every change
+	Run(ctx context.Context, updates chan<- []Group)
+}
+
+// Config is the configuration of the discovery of the agent, every provider
+// configured is merged with the others and with the static targets, the
+// relabeling rules are applied to each target discovered
+type Config struct {
+	Files      *FileConfig       `yaml:"files,omitempty"`
+	DNSSRV     *DNSConfig        `yaml:"dns_srv,omitempty"`
+	Docker     *DockerConfig     `yaml:"docker,omitempty"`
+	Kubernetes *KubernetesConfig `yaml:"kubernetes,omitempty"`
+	Relabel    []RelabelConfig   `yaml:"relabel,omitempty"`
+}
+
+// Manager runs a set of providers, merging the targets discovered by each
+// of them, providers are consulted in registration order
+type Manager struct {
+	names     []string
+	providers map[string]Provider
+	relabel   []*RelabelRule
+	groups    map[string][]Group
+	mutex     sync.Mutex
+	logger    *log.Logger
+}
+
+// NewManager create a new `Manager` with a set of relabeling rules
+func NewManager(relabel []RelabelConfig, logger *log.Logger) (*Manager, error) {
+	rules := make([]*RelabelRule, len(relabel))
+	for i, c := range relabel {
+		rule, err := NewRelabelRule(c)
+		if err != nil {
+			return nil, err
+		}
+		rules[i] = rule
+	}
+	return &Manager{
+		providers: make(map[string]Provider),
+		relabel:   rules,
+		groups:    make(map[string][]Group),
+		logger:    logger,
+	}, nil
+}
+
+// NewManagerFromConfig create a new `Manager` registering every provider
+// configured, nil if there are none
+func NewManagerFromConfig(c Config, logger *log.Logger) (*Manager, error) {
+	m, err := NewManager(c.Relabel, logger)
+	if err != nil {
+		return nil, err
+	}
+	if c.Files != nil {
+		m.Register("file", NewFileProvider(*c.Files, logger))
+	}
+	if c.DNSSRV != nil {
+		m.Register("dns_srv", NewDNSProvider(*c.DNSSRV, nil, logger))
+	}
+	if c.Docker != nil {
+		p, err := NewDockerProvider(*c.Docker, logger)
+		if err != nil {
+			return nil, err
+		}
+		m.Register("docker", p)
+	}
+	if c.Kubernetes != nil {
+		p, err := NewKubernetesProvider(*c.Kubernetes, logger)
+		if err != nil {
+			return nil, err
+		}
+		m.Register("kubernetes", p)
+	}
+	if len(m.providers) == 0 {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// Register add a provider to the manager, replacing the one with the same
+// name, if any
+func (m *Manager) Register(name string, p Provider) {
+	if _, ok := m.providers[name]; !ok {
+		m.names = append(m.names, name)
+	}
+	m.providers[name] = p
+}
+
+// Run start every provider, sending the merged targets discovered on every
+// change until the context is cancelled
+func (m *Manager) Run(ctx context.Context, updates chan<- []Target) {
+	type update struct {
+		provider string
+		groups   []Group
+	}
+	merged := make(chan update)
+	for name, p := range m.providers {
+		groups := make(chan []Group)
+		go p.Run(ctx, groups)
+		go func(name string, groups <-chan []Group) {
+			for {
+				select {
+				case g := <-groups:
+					select {
+					case merged <- update{name, g}:
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(name, groups)
+	}
+	for {
+		select {
+		case u := <-merged:
+			m.mutex.Lock()
+			m.groups[u.provider] = u.groups
+			m.mutex.Unlock()
+			select {
+			case updates <- m.Targets():
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Targets return the targets discovered by every provider after the
+// relabeling, sorted by URL. Of the targets discovered more than once, the
+// one found by the provider registered first is kept.
+func (m *Manager) Targets() []Target {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	seen := make(map[URL]bool)
+	var targets []Target
+	for _, name := range m.names {
+		for _, group := range m.groups[name] {
+			for _, labels := range group.Targets {
+				target, ok := m.target(labels)
+				if !ok || seen[target.Url] {
+					continue
+				}
+				seen[target.Url] = true
+				targets = append(targets, target)
+			}
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Url < targets[j].Url })
+	return targets
+}
+
+// target apply the relabeling rules to the labels of a discovered target,
+// building the target out of the resulting labels, false if the target is
+// dropped or has no valid URL
+func (m *Manager) target(labels Labels) (Target, bool) {
+	labels = labels.copy()
+	for _, rule := range m.relabel {
+		if !rule.Apply(labels) {
+			return Target{}, false
+		}
+	}
+	return TargetFromLabels(labels, m.logger)
+}
+
+// TargetFromLabels build a target out of its labels, false if it has no
+// valid URL
+func TargetFromLabels(labels Labels, logger *log.Logger) (Target, bool) {
+	target := Target{Url: labels[URLLabel]}
+	if target.Url == "" {
+		if labels[AddressLabel] == "" {
+			return Target{}, false
+		}
+		scheme := labels[SchemeLabel]
+		if scheme == "" {
+			scheme = "http"
+		}
+		target.Url = scheme + "://" + labels[AddressLabel] + labels[PathLabel]
+	}
+	if u, err := url.Parse(target.Url); err != nil || u.Host == "" {
+		logger.Printf("Discarding target with invalid URL %s\n", target.Url)
+		return Target{}, false
+	}
+	if tags := labels[TagsLabel]; tags != "" {
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				target.Tags = append(target.Tags, tag)
+			}
+		}
+	}
+	if interval := labels[IntervalLabel]; interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			logger.Printf("Ignoring invalid interval %s of %s\n", interval, target.Url)
+		} else {
+			target.Interval = d
+		}
+	}
+	return target, true
+}
+
+// addressLabels return the labels of a target defined either by its address
+// or by its URL, which is split into scheme, address and path
+func addressLabels(address string) Labels {
+	if strings.Contains(address, "://") {
+		if u, err := url.Parse(address); err == nil {
+			path := u.EscapedPath()
+			if u.RawQuery != "" {
+				path += "?" + u.RawQuery
+			}
+			return Labels{SchemeLabel: u.Scheme, AddressLabel: u.Host, PathLabel: path}
+		}
+	}
+	return Labels{AddressLabel: address}
+}
@@ -0,0 +1,80 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+// staticProvider discovers a fixed set of groups once
+type staticProvider []Group
+
+func (p staticProvider) Run(ctx context.Context, updates chan<- []Group) {
+	select {
+	case updates <- p:
+	case <-ctx.Done():
+	}
+}
+
+func TestManagerTargetsOrder(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	m, _ := NewManager(nil, logger)
+	names := []string{"file", "dns_srv", "docker", "kubernetes"}
+	for _, name := range names {
+		m.Register(name, staticProvider{{Source: name, Targets: []Labels{
+			{AddressLabel: "web-1:8080", TagsLabel: name},
+		}}})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	updates := make(chan []Target)
+	go m.Run(ctx, updates)
+	var targets []Target
+	for range names {
+		select {
+		case targets = <-updates:
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+	}
+	// Duplicates are resolved in favour of the provider registered first,
+	// no matter the order the providers reported in
+	expected := []Target{{Url: "http://web-1:8080", Tags: []string{"file"}}}
+	for i := 0; i < 10; i++ {
+		if !reflect.DeepEqual(targets, expected) {
+			t.Fatalf("manager failed: expected %v got %v\n", expected, targets)
+		}
+		targets = m.Targets()
+	}
+}
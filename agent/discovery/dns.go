@@ -0,0 +1,147 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package discovery
+
+import (
+	"context"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNSConfig is the configuration of the DNS SRV discovery, every name is
+// resolved once every `RefreshInterval` and each SRV record becomes a target
+// probed through `Scheme`, http by default, at `Path`
+type DNSConfig struct {
+	Names           []string      `yaml:"names"`
+	RefreshInterval time.Duration `yaml:"refresh_interval,omitempty"`
+	Scheme          string        `yaml:"scheme,omitempty"`
+	Path            string        `yaml:"path,omitempty"`
+}
+
+// DNSProvider discovers targets by resolving DNS SRV records
+type DNSProvider struct {
+	config   DNSConfig
+	resolver *net.Resolver
+	groups   map[string]Group
+	logger   *log.Logger
+}
+
+// NewDNSProvider create a new `DNSProvider`, refreshing every 30 seconds by
+// default, a nil resolver means the default one
+func NewDNSProvider(config DNSConfig, resolver *net.Resolver, logger *log.Logger) *DNSProvider {
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = 30 * time.Second
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &DNSProvider{
+		config:   config,
+		resolver: resolver,
+		groups:   make(map[string]Group),
+		logger:   logger,
+	}
+}
+
+// Run resolve the names once every refresh interval, sending the groups
+// on change until the context is cancelled
+func (p *DNSProvider) Run(ctx context.Context, updates chan<- []Group) {
+	ticker := time.NewTicker(p.config.RefreshInterval)
+	defer ticker.Stop()
+	first := true
+	for {
+		if changed := p.refresh(ctx); changed || first {
+			first = false
+			select {
+			case updates <- p.list():
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refresh resolve every name, return true if any record changed. Names
+// failing to resolve keep the records resolved last.
+func (p *DNSProvider) refresh(ctx context.Context) bool {
+	changed := false
+	for _, name := range p.config.Names {
+		_, records, err := p.resolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			p.logger.Printf("Error resolving %s: %v\n", name, err)
+			continue
+		}
+		group := Group{Source: name}
+		for _, srv := range records {
+			target := strings.TrimSuffix(srv.Target, ".")
+			port := strconv.Itoa(int(srv.Port))
+			labels := Labels{
+				AddressLabel:                  net.JoinHostPort(target, port),
+				MetaPrefix + "dns_name":       name,
+				MetaPrefix + "dns_srv_target": target,
+				MetaPrefix + "dns_srv_port":   port,
+			}
+			if p.config.Scheme != "" {
+				labels[SchemeLabel] = p.config.Scheme
+			}
+			if p.config.Path != "" {
+				labels[PathLabel] = p.config.Path
+			}
+			group.Targets = append(group.Targets, labels)
+		}
+		// Records of the same priority are shuffled by weight on every lookup
+		sort.Slice(group.Targets, func(i, j int) bool {
+			return group.Targets[i][AddressLabel] < group.Targets[j][AddressLabel]
+		})
+		if !reflect.DeepEqual(group, p.groups[name]) {
+			p.groups[name] = group
+			changed = true
+		}
+	}
+	return changed
+}
+
+// list return the groups of every name, in configuration order
+func (p *DNSProvider) list() []Group {
+	groups := make([]Group, 0, len(p.groups))
+	for _, name := range p.config.Names {
+		if group, ok := p.groups[name]; ok {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
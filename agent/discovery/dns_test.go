@@ -0,0 +1,234 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+// srvServer is a minimal in-process DNS server answering SRV queries
+type srvServer struct {
+	conn    net.PacketConn
+	mutex   sync.Mutex
+	records map[string][]net.SRV
+}
+
+func newSRVServer(t *testing.T, records map[string][]net.SRV) *srvServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &srvServer{conn: conn, records: records}
+	go s.serve()
+	t.Cleanup(func() { conn.Close() })
+	return s
+}
+
+func (s *srvServer) set(name string, records []net.SRV) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records[name] = records
+}
+
+// resolver return a resolver querying the server
+func (s *srvServer) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", s.conn.LocalAddr().String())
+		},
+	}
+}
+
+func (s *srvServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if reply := s.answer(buf[:n]); reply != nil {
+			s.conn.WriteTo(reply, from)
+		}
+	}
+}
+
+// answer build the reply to a query with a single question
+func (s *srvServer) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	// Parse the question name, a sequence of length prefixed labels
+	var labels []string
+	off := 12
+	for off < len(query) && query[off] != 0 {
+		l := int(query[off])
+		if off+1+l > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[off+1:off+1+l]))
+		off += 1 + l
+	}
+	off += 5 // null label, qtype and qclass
+	if off > len(query) {
+		return nil
+	}
+	name := strings.ToLower(strings.Join(labels, ".")) + "."
+	s.mutex.Lock()
+	records, found := s.records[name]
+	s.mutex.Unlock()
+
+	reply := make([]byte, 12, 512)
+	copy(reply, query[:2])
+	flags := uint16(0x8400) | binary.BigEndian.Uint16(query[2:4])&0x0100
+	if !found {
+		flags |= 3 // NXDOMAIN
+	}
+	binary.BigEndian.PutUint16(reply[2:], flags)
+	binary.BigEndian.PutUint16(reply[4:], 1)
+	binary.BigEndian.PutUint16(reply[6:], uint16(len(records)))
+	reply = append(reply, query[12:off]...)
+	for _, srv := range records {
+		target := encodeName(srv.Target)
+		reply = append(reply, 0xc0, 0x0c) // pointer to the question name
+		reply = appendUint16(reply, 33)   // SRV
+		reply = appendUint16(reply, 1)    // IN
+		reply = append(reply, 0, 0, 0, 60)
+		reply = appendUint16(reply, uint16(6+len(target)))
+		reply = appendUint16(reply, srv.Priority)
+		reply = appendUint16(reply, srv.Weight)
+		reply = appendUint16(reply, srv.Port)
+		reply = append(reply, target...)
+	}
+	return reply
+}
+
+func encodeName(name string) []byte {
+	var encoded []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		encoded = append(encoded, byte(len(label)))
+		encoded = append(encoded, label...)
+	}
+	return append(encoded, 0)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	name := "_http._tcp.example.test."
+	server := newSRVServer(t, map[string][]net.SRV{
+		name: {
+			{Target: "web-1.example.test.", Port: 8080, Priority: 10, Weight: 5},
+			{Target: "web-2.example.test.", Port: 8081, Priority: 10, Weight: 5},
+		},
+	})
+	logger := log.New(ioutil.Discard, "", 0)
+	provider := NewDNSProvider(DNSConfig{
+		Names: []string{name, "_missing._tcp.example.test."},
+		Path:  "/health",
+	}, server.resolver(), logger)
+	m, _ := NewManager([]RelabelConfig{
+		{SourceLabels: []string{"__meta_dns_srv_target"}, Regex: "([^.]+)\\..*",
+			TargetLabel: "tags"},
+	}, logger)
+	m.Register("dns_srv", provider)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !provider.refresh(ctx) {
+		t.Fatalf("dns discovery failed: expected records resolved\n")
+	}
+	m.groups["dns_srv"] = provider.list()
+	expected := []Target{
+		{Url: "http://web-1.example.test:8080/health", Tags: []string{"web-1"}},
+		{Url: "http://web-2.example.test:8081/health", Tags: []string{"web-2"}},
+	}
+	if targets := m.Targets(); !reflect.DeepEqual(targets, expected) {
+		t.Errorf("dns discovery failed: expected %v got %v\n", expected, targets)
+	}
+
+	// Unchanged records are not notified again
+	if provider.refresh(ctx) {
+		t.Errorf("dns discovery failed: expected no changes\n")
+	}
+	server.set(name, []net.SRV{{Target: "web-3.example.test.", Port: 80}})
+	if !provider.refresh(ctx) {
+		t.Errorf("dns discovery failed: expected records changed\n")
+	}
+	m.groups["dns_srv"] = provider.list()
+	expected = []Target{{Url: "http://web-3.example.test:80/health", Tags: []string{"web-3"}}}
+	if targets := m.Targets(); !reflect.DeepEqual(targets, expected) {
+		t.Errorf("dns discovery failed: expected %v got %v\n", expected, targets)
+	}
+}
+
+func TestDNSDiscoveryShuffled(t *testing.T) {
+	name := "_http._tcp.example.test."
+	records := []net.SRV{
+		{Target: "web-1.example.test.", Port: 8080, Priority: 10, Weight: 5},
+		{Target: "web-2.example.test.", Port: 8080, Priority: 10, Weight: 5},
+		{Target: "web-3.example.test.", Port: 8080, Priority: 10, Weight: 5},
+		{Target: "web-4.example.test.", Port: 8080, Priority: 20, Weight: 1},
+	}
+	server := newSRVServer(t, map[string][]net.SRV{name: records})
+	provider := NewDNSProvider(DNSConfig{Names: []string{name}},
+		server.resolver(), log.New(ioutil.Discard, "", 0))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !provider.refresh(ctx) {
+		t.Fatalf("dns discovery failed: expected records resolved\n")
+	}
+	expected := provider.list()
+	for i := 0; i < 10; i++ {
+		shuffled := append([]net.SRV(nil), records...)
+		rand.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		server.set(name, shuffled)
+		if provider.refresh(ctx) {
+			t.Errorf("dns discovery failed: expected no changes for %v\n", shuffled)
+		}
+		if groups := provider.list(); !reflect.DeepEqual(groups, expected) {
+			t.Errorf("dns discovery failed: expected %v got %v\n", expected, groups)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Container labels read by the Docker discovery. A container is probed at
+// `overseer.url` or, lacking it, at the address of the container on
+// `overseer.port` through `overseer.scheme` and `overseer.path`.
+const (
+	DockerURLLabel      = "overseer.url"
+	DockerPortLabel     = "overseer.port"
+	DockerSchemeLabel   = "overseer.scheme"
+	DockerPathLabel     = "overseer.path"
+	DockerIntervalLabel = "overseer.interval"
+	DockerTagsLabel     = "overseer.tags"
+)
+
+// defaultDockerHost is the Docker Engine API socket used when neither the
+// configuration nor DOCKER_HOST set one
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// DockerConfig is the configuration of the Docker discovery, the Docker
+// Engine API at `Host`, either a `unix://` socket or a `tcp://` address, is
+// listed on every container start or stop event and once every
+// `RefreshInterval` anyway. `Network` selects the network of the container
+// address when it's attached to more than one.
+type DockerConfig struct {
+	Host            string        `yaml:"host,omitempty"`
+	Network         string        `yaml:"network,omitempty"`
+	RefreshInterval time.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// dockerContainer is the subset of a container returned by the Docker
+// Engine API used by the discovery
+type dockerContainer struct {
+	ID              string            `json:"Id"`
+	Names           []string          `json:"Names"`
+	Image           string            `json:"Image"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// dockerEvent is the subset of an event returned by the Docker Engine API
+// used by the discovery
+type dockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+}
+
+// DockerProvider discovers targets from the labels of the running
+// containers through the Docker Engine API
+type DockerProvider struct {
+	config DockerConfig
+	client *http.Client
+	base   string
+	group  Group
+	logger *log.Logger
+}
+
+// NewDockerProvider create a new `DockerProvider`, the host defaults to
+// DOCKER_HOST or to the local unix socket, the refresh interval to 1 minute
+func NewDockerProvider(config DockerConfig, logger *log.Logger) (*DockerProvider, error) {
+	if config.Host == "" {
+		config.Host = os.Getenv("DOCKER_HOST")
+	}
+	if config.Host == "" {
+		config.Host = defaultDockerHost
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = time.Minute
+	}
+	u, err := url.Parse(config.Host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %s: %v", config.Host, err)
+	}
+	p := &DockerProvider{
+		config: config,
+		client: &http.Client{},
+		group:  Group{Source: config.Host},
+		logger: logger,
+	}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		p.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		p.base = "http://docker"
+	case "tcp", "http":
+		p.base = "http://" + u.Host
+	case "https":
+		p.base = "https://" + u.Host
+	default:
+		return nil, fmt.Errorf("unsupported docker host %s", config.Host)
+	}
+	return p, nil
+}
+
+// Run list the containers on every container event and once every refresh
+// interval, sending the group on change until the context is cancelled
+func (p *DockerProvider) Run(ctx context.Context, updates chan<- []Group) {
+	ticker := time.NewTicker(p.config.RefreshInterval)
+	defer ticker.Stop()
+	events := make(chan struct{}, 1)
+	go p.watch(ctx, events)
+	first := true
+	for {
+		if changed := p.refresh(ctx); changed || first {
+			first = false
+			select {
+			case updates <- []Group{p.group}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-events:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watch follow the container events stream, notifying every start or stop
+// of a container, reconnecting on failure until the context is cancelled.
+// Events are coalesced, a single notification pending at most.
+func (p *DockerProvider) watch(ctx context.Context, events chan<- struct{}) {
+	notify := func() {
+		select {
+		case events <- struct{}{}:
+		default:
+		}
+	}
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"event": {"start", "stop", "die", "destroy", "pause", "unpause"},
+	})
+	backoff := time.Second
+	for {
+		err := p.stream(ctx, "/events?filters="+url.QueryEscape(string(filters)), func(e dockerEvent) {
+			backoff = time.Second
+			notify()
+		}, notify)
+		if ctx.Err() != nil {
+			return
+		}
+		p.logger.Printf("Docker events stream interrupted: %v\n", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// stream call `connected` once the events stream is open, then `handle` on
+// every event received until the stream ends
+func (p *DockerProvider) stream(ctx context.Context, path string,
+	handle func(dockerEvent), connected func()) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.base+path, nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	// Events may have been missed while disconnected
+	connected()
+	decoder := json.NewDecoder(res.Body)
+	for {
+		var e dockerEvent
+		if err := decoder.Decode(&e); err != nil {
+			return err
+		}
+		handle(e)
+	}
+}
+
+// refresh list the running containers, return true if the targets changed.
+// On failure the targets listed last are kept.
+func (p *DockerProvider) refresh(ctx context.Context) bool {
+	containers, err := p.containers(ctx)
+	if err != nil {
+		p.logger.Printf("Error listing docker containers: %v\n", err)
+		return false
+	}
+	group := Group{Source: p.config.Host}
+	for _, c := range containers {
+		if labels, ok := p.labels(c); ok {
+			group.Targets = append(group.Targets, labels)
+		}
+	}
+	if reflect.DeepEqual(group, p.group) {
+		return false
+	}
+	p.group = group
+	return true
+}
+
+// containers return the running containers, sorted by ID
+func (p *DockerProvider) containers(ctx context.Context) ([]dockerContainer, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.base+"/containers/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	var containers []dockerContainer
+	if err := json.NewDecoder(res.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].ID < containers[j].ID })
+	return containers, nil
+}
+
+// invalidLabelChars matches the characters not allowed in label names
+var invalidLabelChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// labels return the labels of the target of a container, false if the
+// container has none
+func (p *DockerProvider) labels(c dockerContainer) (Labels, bool) {
+	name := c.ID
+	if len(c.Names) > 0 {
+		name = strings.TrimPrefix(c.Names[0], "/")
+	}
+	labels := Labels{
+		MetaPrefix + "docker_container_id":    c.ID,
+		MetaPrefix + "docker_container_name":  name,
+		MetaPrefix + "docker_container_image": c.Image,
+	}
+	for k, v := range c.Labels {
+		labels[MetaPrefix+"docker_container_label_"+invalidLabelChars.ReplaceAllString(k, "_")] = v
+	}
+	if interval := c.Labels[DockerIntervalLabel]; interval != "" {
+		labels[IntervalLabel] = interval
+	}
+	if tags := c.Labels[DockerTagsLabel]; tags != "" {
+		labels[TagsLabel] = tags
+	}
+	if u := c.Labels[DockerURLLabel]; u != "" {
+		labels[URLLabel] = u
+		return labels, true
+	}
+	port := c.Labels[DockerPortLabel]
+	if port == "" {
+		return nil, false
+	}
+	host := p.address(c)
+	if host == "" {
+		host = name
+	}
+	labels[AddressLabel] = net.JoinHostPort(host, port)
+	if scheme := c.Labels[DockerSchemeLabel]; scheme != "" {
+		labels[SchemeLabel] = scheme
+	}
+	if path := c.Labels[DockerPathLabel]; path != "" {
+		labels[PathLabel] = path
+	}
+	return labels, true
+}
+
+// address return the IP address of a container on the configured network,
+// or on the first one by name if none is configured
+func (p *DockerProvider) address(c dockerContainer) string {
+	if p.config.Network != "" {
+		return c.NetworkSettings.Networks[p.config.Network].IPAddress
+	}
+	networks := make([]string, 0, len(c.NetworkSettings.Networks))
+	for network := range c.NetworkSettings.Networks {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+	for _, network := range networks {
+		if ip := c.NetworkSettings.Networks[network].IPAddress; ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
@@ -0,0 +1,184 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+// dockerServer is a fake Docker Engine API listening on a unix socket,
+// serving the container list and the events stream
+type dockerServer struct {
+	*httptest.Server
+	socket     string
+	mutex      sync.Mutex
+	containers []dockerContainer
+	events     chan dockerEvent
+}
+
+func newDockerServer(t *testing.T) *dockerServer {
+	s := &dockerServer{
+		socket: filepath.Join(t.TempDir(), "docker.sock"),
+		events: make(chan dockerEvent),
+	}
+	l, err := net.Listen("unix", s.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		json.NewEncoder(w).Encode(s.containers)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		var filters map[string][]string
+		if err := json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters); err != nil ||
+			!reflect.DeepEqual(filters["type"], []string{"container"}) {
+			t.Errorf("docker events failed: unexpected filters %s\n", r.URL.Query().Get("filters"))
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		encoder := json.NewEncoder(w)
+		for {
+			select {
+			case e := <-s.events:
+				encoder.Encode(e)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+	s.Server = httptest.NewUnstartedServer(mux)
+	s.Listener.Close()
+	s.Listener = l
+	s.Start()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// start add a running container and emit its start event
+func (s *dockerServer) start(c dockerContainer) {
+	s.mutex.Lock()
+	s.containers = append(s.containers, c)
+	s.mutex.Unlock()
+	s.events <- dockerEvent{Type: "container", Action: "start"}
+}
+
+// stop remove a running container and emit its stop event
+func (s *dockerServer) stop(id string) {
+	s.mutex.Lock()
+	for i, c := range s.containers {
+		if c.ID == id {
+			s.containers = append(s.containers[:i], s.containers[i+1:]...)
+			break
+		}
+	}
+	s.mutex.Unlock()
+	s.events <- dockerEvent{Type: "container", Action: "stop"}
+}
+
+func container(id, name, ip string, labels map[string]string) dockerContainer {
+	c := dockerContainer{ID: id, Names: []string{"/" + name}, Labels: labels}
+	c.NetworkSettings.Networks = map[string]struct {
+		IPAddress string `json:"IPAddress"`
+	}{"overseer_default": {IPAddress: ip}}
+	return c
+}
+
+func TestDockerDiscovery(t *testing.T) {
+	server := newDockerServer(t)
+	server.containers = []dockerContainer{
+		container("a", "web", "172.18.0.2", map[string]string{
+			DockerURLLabel:      "http://web:8080/health",
+			DockerIntervalLabel: "10s",
+			DockerTagsLabel:     "web,frontend",
+		}),
+		container("b", "rabbitmq", "172.18.0.3", nil),
+	}
+
+	logger := log.New(ioutil.Discard, "", 0)
+	m, err := NewManagerFromConfig(Config{
+		// A long refresh interval, changes are picked up by the events only
+		Docker: &DockerConfig{Host: "unix://" + server.socket, RefreshInterval: time.Hour},
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []Target)
+	go m.Run(ctx, updates)
+
+	next := func() []Target {
+		select {
+		case targets := <-updates:
+			return targets
+		case <-time.After(5 * time.Second):
+			t.Fatal("docker discovery failed: no update received")
+		}
+		return nil
+	}
+	expected := []Target{
+		{Url: "http://web:8080/health", Interval: 10 * time.Second, Tags: []string{"web", "frontend"}},
+	}
+	if targets := next(); !reflect.DeepEqual(targets, expected) {
+		t.Errorf("docker discovery failed: expected %v got %v\n", expected, targets)
+	}
+
+	server.start(container("c", "api", "172.18.0.4", map[string]string{
+		DockerPortLabel: "9000",
+		DockerPathLabel: "/ready",
+	}))
+	expected = []Target{
+		{Url: "http://172.18.0.4:9000/ready"},
+		{Url: "http://web:8080/health", Interval: 10 * time.Second, Tags: []string{"web", "frontend"}},
+	}
+	if targets := next(); !reflect.DeepEqual(targets, expected) {
+		t.Errorf("docker discovery failed: expected %v got %v\n", expected, targets)
+	}
+
+	server.stop("a")
+	expected = []Target{{Url: "http://172.18.0.4:9000/ready"}}
+	if targets := next(); !reflect.DeepEqual(targets, expected) {
+		t.Errorf("docker discovery failed: expected %v got %v\n", expected, targets)
+	}
+}
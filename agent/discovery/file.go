@@ -0,0 +1,209 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// FileConfig is the configuration of the file based discovery, `Paths` are
+// glob patterns of JSON or YAML files, or directories containing them,
+// checked for changes once every `RefreshInterval`.
+//
+// Each file holds a list of groups of targets, Prometheus file_sd style,
+// with the labels shared by the targets of the group:
+//
+//	[{"targets": ["localhost:8080", "https://example.com/health"],
+//	  "labels": {"tags": "web,prod"}}]
+type FileConfig struct {
+	Paths           []string      `yaml:"paths"`
+	RefreshInterval time.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// fileGroup is the on-disk format of a group of targets
+type fileGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// fileState tracks the last version of a file read
+type fileState struct {
+	modTime time.Time
+	size    int64
+	groups  []Group
+}
+
+// FileProvider discovers targets from JSON or YAML files
+type FileProvider struct {
+	config FileConfig
+	files  map[string]fileState
+	logger *log.Logger
+}
+
+// NewFileProvider create a new `FileProvider`, refreshing every 30 seconds
+// by default
+func NewFileProvider(config FileConfig, logger *log.Logger) *FileProvider {
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = 30 * time.Second
+	}
+	return &FileProvider{config: config, files: make(map[string]fileState), logger: logger}
+}
+
+// Run check the files for changes once every refresh interval, sending the
+// groups of every file on change until the context is cancelled
+func (p *FileProvider) Run(ctx context.Context, updates chan<- []Group) {
+	ticker := time.NewTicker(p.config.RefreshInterval)
+	defer ticker.Stop()
+	first := true
+	for {
+		if changed := p.refresh(); changed || first {
+			first = false
+			select {
+			case updates <- p.groups():
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// paths return the files matching the configured patterns, sorted
+func (p *FileProvider) paths() []string {
+	var paths []string
+	for _, pattern := range p.config.Paths {
+		if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+			for _, ext := range []string{"*.json", "*.yaml", "*.yml"} {
+				matches, _ := filepath.Glob(filepath.Join(pattern, ext))
+				paths = append(paths, matches...)
+			}
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			p.logger.Printf("Invalid discovery path %s: %v\n", pattern, err)
+			continue
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// refresh read the files changed since the last refresh, return true if any
+// file has been added, changed or removed. Files failing to parse keep the
+// groups read last.
+func (p *FileProvider) refresh() bool {
+	changed := false
+	seen := make(map[string]bool)
+	for _, path := range p.paths() {
+		seen[path] = true
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		state, known := p.files[path]
+		if known && state.modTime.Equal(info.ModTime()) && state.size == info.Size() {
+			continue
+		}
+		state.modTime, state.size = info.ModTime(), info.Size()
+		groups, err := readFile(path)
+		if err != nil {
+			p.logger.Printf("Error reading discovery file %s: %v\n", path, err)
+		} else if !reflect.DeepEqual(groups, state.groups) {
+			state.groups = groups
+			changed = true
+		}
+		p.files[path] = state
+	}
+	for path := range p.files {
+		if !seen[path] {
+			delete(p.files, path)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// groups return the groups of every file
+func (p *FileProvider) groups() []Group {
+	paths := make([]string, 0, len(p.files))
+	for path := range p.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var groups []Group
+	for _, path := range paths {
+		groups = append(groups, p.files[path].groups...)
+	}
+	return groups
+}
+
+// readFile parse a file of groups of targets, by its extension
+func readFile(path string) ([]Group, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fileGroups []fileGroup
+	if filepath.Ext(path) == ".json" {
+		err = json.Unmarshal(content, &fileGroups)
+	} else {
+		err = yaml.UnmarshalStrict(content, &fileGroups)
+	}
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]Group, len(fileGroups))
+	for i, fg := range fileGroups {
+		groups[i].Source = path + ":" + strconv.Itoa(i)
+		for _, address := range fg.Targets {
+			labels := addressLabels(address)
+			for k, v := range fg.Labels {
+				labels[k] = v
+			}
+			labels[MetaPrefix+"filepath"] = path
+			groups[i].Targets = append(groups[i].Targets, labels)
+		}
+	}
+	return groups, nil
+}
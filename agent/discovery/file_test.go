@@ -0,0 +1,105 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+func TestFileDiscovery(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("web.json", `[{"targets": ["web-1:8080", "https://web-2/health"], "labels": {"tags": "web"}}]`)
+	write("db.yaml", "- targets: [\"db-1:5432\"]\n  labels:\n    env: dev\n")
+	write("notes.txt", "not a target file")
+
+	logger := log.New(ioutil.Discard, "", 0)
+	m, err := NewManagerFromConfig(Config{
+		Files: &FileConfig{Paths: []string{dir}, RefreshInterval: 10 * time.Millisecond},
+		Relabel: []RelabelConfig{
+			// Drop development targets and probe the health endpoint of the
+			// others
+			{SourceLabels: []string{"env"}, Regex: "dev", Action: ActionDrop},
+			{SourceLabels: []string{"__path__"}, Regex: "/?", TargetLabel: "__path__",
+				Replacement: stringPtr("/healthz")},
+		},
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []Target)
+	go m.Run(ctx, updates)
+
+	next := func() []Target {
+		select {
+		case targets := <-updates:
+			return targets
+		case <-time.After(5 * time.Second):
+			t.Fatal("file discovery failed: no update received")
+		}
+		return nil
+	}
+	expected := []Target{
+		{Url: "http://web-1:8080/healthz", Tags: []string{"web"}},
+		{Url: "https://web-2/health", Tags: []string{"web"}},
+	}
+	if targets := next(); !reflect.DeepEqual(targets, expected) {
+		t.Errorf("file discovery failed: expected %v got %v\n", expected, targets)
+	}
+
+	// Targets are updated as files change or are removed
+	write("db.yaml", "- targets: [\"db-1:5432\", \"db-2:5432\"]\n  labels:\n    env: prod\n    __interval__: 1m\n")
+	if err := os.Remove(filepath.Join(dir, "web.json")); err != nil {
+		t.Fatal(err)
+	}
+	expected = []Target{
+		{Url: "http://db-1:5432/healthz", Interval: time.Minute},
+		{Url: "http://db-2:5432/healthz", Interval: time.Minute},
+	}
+	for i := 0; i < 10; i++ {
+		targets := next()
+		if reflect.DeepEqual(targets, expected) {
+			return
+		}
+	}
+	t.Errorf("file discovery failed: expected %v\n", expected)
+}
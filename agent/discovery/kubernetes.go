@@ -0,0 +1,537 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Annotations read by the Kubernetes discovery on Services and Ingresses.
+// A Service annotated with `overseer.io/probe: "true"` is probed through its
+// cluster DNS name, with `overseer.io/probe: "endpoints"` every ready address
+// of its Endpoints is probed instead. Ingresses are probed on each host of
+// their rules, through https if the host is covered by TLS.
+const (
+	KubernetesProbeAnnotation    = "overseer.io/probe"
+	KubernetesPathAnnotation     = "overseer.io/path"
+	KubernetesPortAnnotation     = "overseer.io/port"
+	KubernetesSchemeAnnotation   = "overseer.io/scheme"
+	KubernetesIntervalAnnotation = "overseer.io/interval"
+	KubernetesTagsAnnotation     = "overseer.io/tags"
+)
+
+// In-cluster service account files used when no API server is configured
+const (
+	serviceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCA    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// errWatchExpired is returned when the resource version watched is too old
+// and the resources must be listed again
+var errWatchExpired = errors.New("watch expired")
+
+// KubernetesConfig is the configuration of the Kubernetes discovery, the
+// Services, Endpoints and Ingresses of `Namespaces`, all by default, are
+// listed and watched through the API server at `APIServer`. Without an API
+// server the in-cluster configuration of the pod service account is used.
+type KubernetesConfig struct {
+	APIServer          string        `yaml:"api_server,omitempty"`
+	Namespaces         []string      `yaml:"namespaces,omitempty"`
+	BearerTokenFile    string        `yaml:"bearer_token_file,omitempty"`
+	CAFile             string        `yaml:"ca_file,omitempty"`
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify,omitempty"`
+	WatchTimeout       time.Duration `yaml:"watch_timeout,omitempty"`
+}
+
+// kubeResource is a kind of resource watched
+type kubeResource struct {
+	kind  string
+	group string
+	name  string
+}
+
+var (
+	kubeServices  = kubeResource{"service", "/api/v1", "services"}
+	kubeEndpoints = kubeResource{"endpoints", "/api/v1", "endpoints"}
+	kubeIngresses = kubeResource{"ingress", "/apis/networking.k8s.io/v1", "ingresses"}
+)
+
+// path return the API path of the resource in a namespace, all of them if
+// empty
+func (r kubeResource) path(namespace string) string {
+	if namespace == "" {
+		return r.group + "/" + r.name
+	}
+	return r.group + "/namespaces/" + namespace + "/" + r.name
+}
+
+// kubeObject is the subset of a Service, Endpoints or Ingress used by the
+// discovery, each kind filling its own fields
+type kubeObject struct {
+	Metadata struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		ResourceVersion string            `json:"resourceVersion"`
+		Labels          map[string]string `json:"labels,omitempty"`
+		Annotations     map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		Ports []kubePort `json:"ports,omitempty"`
+		TLS   []struct {
+			Hosts []string `json:"hosts"`
+		} `json:"tls,omitempty"`
+		Rules []struct {
+			Host string `json:"host"`
+		} `json:"rules,omitempty"`
+	} `json:"spec"`
+	Subsets []struct {
+		Addresses []struct {
+			IP        string `json:"ip"`
+			TargetRef *struct {
+				Kind string `json:"kind"`
+				Name string `json:"name"`
+			} `json:"targetRef,omitempty"`
+		} `json:"addresses,omitempty"`
+		Ports []kubePort `json:"ports,omitempty"`
+	} `json:"subsets,omitempty"`
+}
+
+type kubePort struct {
+	Name string `json:"name,omitempty"`
+	Port int    `json:"port"`
+}
+
+// key return the namespaced name of an object
+func (o *kubeObject) key() string {
+	return o.Metadata.Namespace + "/" + o.Metadata.Name
+}
+
+// kubeList is the response of a list request
+type kubeList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []kubeObject `json:"items"`
+}
+
+// kubeEvent is an event of a watch stream
+type kubeEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// KubernetesProvider discovers targets from the annotations of Services and
+// Ingresses, following the changes through the watch API
+type KubernetesProvider struct {
+	config  KubernetesConfig
+	client  *http.Client
+	objects map[string]map[string]*kubeObject
+	mutex   sync.Mutex
+	groups  []Group
+	logger  *log.Logger
+}
+
+// NewKubernetesProvider create a new `KubernetesProvider`, falling back to
+// the in-cluster configuration if no API server is set
+func NewKubernetesProvider(config KubernetesConfig, logger *log.Logger) (*KubernetesProvider, error) {
+	if config.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("no kubernetes API server configured and not running in a cluster")
+		}
+		config.APIServer = "https://" + net.JoinHostPort(host, port)
+		if config.BearerTokenFile == "" {
+			config.BearerTokenFile = serviceAccountToken
+		}
+		if config.CAFile == "" {
+			config.CAFile = serviceAccountCA
+		}
+	}
+	if config.WatchTimeout <= 0 {
+		config.WatchTimeout = 5 * time.Minute
+	}
+	if len(config.Namespaces) == 0 {
+		config.Namespaces = []string{""}
+	}
+	if _, err := url.Parse(config.APIServer); err != nil {
+		return nil, fmt.Errorf("invalid kubernetes API server %s: %v", config.APIServer, err)
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CAFile != "" {
+		ca, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CAFile)
+		}
+	}
+	return &KubernetesProvider{
+		config:  config,
+		client:  &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+		objects: make(map[string]map[string]*kubeObject),
+		logger:  logger,
+	}, nil
+}
+
+// Run list and watch the resources of every namespace, sending the groups
+// on change until the context is cancelled
+func (p *KubernetesProvider) Run(ctx context.Context, updates chan<- []Group) {
+	changes := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+	resources := []kubeResource{kubeServices, kubeEndpoints, kubeIngresses}
+	for _, namespace := range p.config.Namespaces {
+		for _, resource := range resources {
+			go p.watch(ctx, resource, namespace, notify)
+		}
+	}
+	for {
+		select {
+		case <-changes:
+		case <-ctx.Done():
+			return
+		}
+		groups := p.build()
+		if reflect.DeepEqual(groups, p.groups) {
+			continue
+		}
+		p.groups = groups
+		select {
+		case updates <- groups:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watch keep the objects of a resource in a namespace in sync, listing them
+// and then following their changes, listing them again when the watch
+// expires or fails, until the context is cancelled
+func (p *KubernetesProvider) watch(ctx context.Context, resource kubeResource,
+	namespace string, notify func()) {
+	scope := resource.kind + "/" + namespace
+	backoff := time.Second
+	for {
+		version, err := p.list(ctx, resource, namespace, scope)
+		for err == nil {
+			notify()
+			backoff = time.Second
+			version, err = p.follow(ctx, resource, namespace, scope, version, notify)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == errWatchExpired {
+			continue
+		}
+		p.logger.Printf("Error watching kubernetes %s: %v\n", resource.name, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// list replace the objects of a scope with the listed ones, return the
+// resource version of the list
+func (p *KubernetesProvider) list(ctx context.Context, resource kubeResource,
+	namespace, scope string) (string, error) {
+	res, err := p.get(ctx, resource.path(namespace))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var list kubeList
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return "", err
+	}
+	objects := make(map[string]*kubeObject, len(list.Items))
+	for i := range list.Items {
+		objects[list.Items[i].key()] = &list.Items[i]
+	}
+	p.mutex.Lock()
+	p.objects[scope] = objects
+	p.mutex.Unlock()
+	return list.Metadata.ResourceVersion, nil
+}
+
+// follow apply the changes of a watch stream starting after a resource
+// version to the objects of a scope, notifying every change. Return the last
+// resource version seen once the stream ends.
+func (p *KubernetesProvider) follow(ctx context.Context, resource kubeResource,
+	namespace, scope, version string, notify func()) (string, error) {
+	query := url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {version},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {strconv.Itoa(int(p.config.WatchTimeout.Seconds()))},
+	}
+	res, err := p.get(ctx, resource.path(namespace)+"?"+query.Encode())
+	if err != nil {
+		return version, err
+	}
+	defer res.Body.Close()
+	decoder := json.NewDecoder(res.Body)
+	for {
+		var e kubeEvent
+		if err := decoder.Decode(&e); err != nil {
+			if err == io.EOF {
+				return version, nil
+			}
+			return version, err
+		}
+		if e.Type == "ERROR" {
+			// Usually a 410 Gone, the version is too old to resume from
+			return version, errWatchExpired
+		}
+		var object kubeObject
+		if err := json.Unmarshal(e.Object, &object); err != nil {
+			return version, err
+		}
+		version = object.Metadata.ResourceVersion
+		p.mutex.Lock()
+		objects := p.objects[scope]
+		switch e.Type {
+		case "ADDED", "MODIFIED":
+			objects[object.key()] = &object
+		case "DELETED":
+			delete(objects, object.key())
+		}
+		p.mutex.Unlock()
+		if e.Type != "BOOKMARK" {
+			notify()
+		}
+	}
+}
+
+// get send an authenticated GET request to the API server, failing on non
+// 200 responses, 410 Gone being reported as an expired watch
+func (p *KubernetesProvider) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.config.APIServer+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if p.config.BearerTokenFile != "" {
+		// Read on every request, service account tokens are rotated
+		token, err := ioutil.ReadFile(p.config.BearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+string(bytes.TrimSpace(token)))
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		if res.StatusCode == http.StatusGone {
+			return nil, errWatchExpired
+		}
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return res, nil
+}
+
+// build return the groups of every annotated Service and Ingress, sorted by
+// source
+func (p *KubernetesProvider) build() []Group {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	services, endpoints, ingresses := p.all(kubeServices), p.all(kubeEndpoints), p.all(kubeIngresses)
+	var groups []Group
+	for key, service := range services {
+		group := Group{Source: "service/" + key}
+		switch service.Metadata.Annotations[KubernetesProbeAnnotation] {
+		case "true":
+			if labels, ok := p.serviceLabels(service); ok {
+				group.Targets = append(group.Targets, labels)
+			}
+		case "endpoints":
+			if ep, ok := endpoints[key]; ok {
+				group.Targets = p.endpointsLabels(service, ep)
+			}
+		default:
+			continue
+		}
+		groups = append(groups, group)
+	}
+	for key, ingress := range ingresses {
+		if ingress.Metadata.Annotations[KubernetesProbeAnnotation] != "true" {
+			continue
+		}
+		groups = append(groups, Group{Source: "ingress/" + key, Targets: p.ingressLabels(ingress)})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Source < groups[j].Source })
+	return groups
+}
+
+// all return the objects of a resource of every namespace watched
+func (p *KubernetesProvider) all(resource kubeResource) map[string]*kubeObject {
+	all := make(map[string]*kubeObject)
+	for _, namespace := range p.config.Namespaces {
+		for key, object := range p.objects[resource.kind+"/"+namespace] {
+			all[key] = object
+		}
+	}
+	return all
+}
+
+// objectLabels return the labels shared by the targets of an object
+func objectLabels(kind string, o *kubeObject) Labels {
+	annotations := o.Metadata.Annotations
+	labels := Labels{
+		MetaPrefix + "kubernetes_namespace":         o.Metadata.Namespace,
+		MetaPrefix + "kubernetes_" + kind + "_name": o.Metadata.Name,
+	}
+	for k, v := range o.Metadata.Labels {
+		labels[MetaPrefix+"kubernetes_"+kind+"_label_"+invalidLabelChars.ReplaceAllString(k, "_")] = v
+	}
+	for k, v := range annotations {
+		labels[MetaPrefix+"kubernetes_"+kind+"_annotation_"+invalidLabelChars.ReplaceAllString(k, "_")] = v
+	}
+	if scheme := annotations[KubernetesSchemeAnnotation]; scheme != "" {
+		labels[SchemeLabel] = scheme
+	}
+	if path := annotations[KubernetesPathAnnotation]; path != "" {
+		labels[PathLabel] = path
+	}
+	if interval := annotations[KubernetesIntervalAnnotation]; interval != "" {
+		labels[IntervalLabel] = interval
+	}
+	if tags := annotations[KubernetesTagsAnnotation]; tags != "" {
+		labels[TagsLabel] = tags
+	}
+	return labels
+}
+
+// port return the port selected by the port annotation among a set of
+// ports, either by number or by name, the first one if not annotated
+func port(annotation string, ports []kubePort) (int, bool) {
+	if n, err := strconv.Atoi(annotation); err == nil {
+		return n, true
+	}
+	for _, p := range ports {
+		if annotation == "" || p.Name == annotation {
+			return p.Port, true
+		}
+	}
+	return 0, false
+}
+
+// serviceLabels return the labels of the target probing a Service through
+// its cluster DNS name
+func (p *KubernetesProvider) serviceLabels(service *kubeObject) (Labels, bool) {
+	n, ok := port(service.Metadata.Annotations[KubernetesPortAnnotation], service.Spec.Ports)
+	if !ok {
+		p.logger.Printf("No port to probe service %s\n", service.key())
+		return nil, false
+	}
+	labels := objectLabels(kubeServices.kind, service)
+	host := service.Metadata.Name + "." + service.Metadata.Namespace + ".svc"
+	labels[AddressLabel] = net.JoinHostPort(host, strconv.Itoa(n))
+	return labels, true
+}
+
+// endpointsLabels return the labels of the targets probing every ready
+// address of the Endpoints of a Service
+func (p *KubernetesProvider) endpointsLabels(service, endpoints *kubeObject) []Labels {
+	var targets []Labels
+	for _, subset := range endpoints.Subsets {
+		n, ok := port(service.Metadata.Annotations[KubernetesPortAnnotation], subset.Ports)
+		if !ok {
+			continue
+		}
+		for _, address := range subset.Addresses {
+			labels := objectLabels(kubeServices.kind, service)
+			labels[AddressLabel] = net.JoinHostPort(address.IP, strconv.Itoa(n))
+			labels[MetaPrefix+"kubernetes_endpoint_address"] = address.IP
+			if address.TargetRef != nil && address.TargetRef.Kind == "Pod" {
+				labels[MetaPrefix+"kubernetes_pod_name"] = address.TargetRef.Name
+			}
+			targets = append(targets, labels)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i][AddressLabel] < targets[j][AddressLabel] })
+	return targets
+}
+
+// ingressLabels return the labels of the targets probing every host of the
+// rules of an Ingress
+func (p *KubernetesProvider) ingressLabels(ingress *kubeObject) []Labels {
+	secure := make(map[string]bool)
+	for _, tls := range ingress.Spec.TLS {
+		for _, host := range tls.Hosts {
+			secure[host] = true
+		}
+	}
+	seen := make(map[string]bool)
+	var targets []Labels
+	for _, rule := range ingress.Spec.Rules {
+		if rule.Host == "" || seen[rule.Host] {
+			continue
+		}
+		seen[rule.Host] = true
+		labels := objectLabels(kubeIngresses.kind, ingress)
+		labels[AddressLabel] = rule.Host
+		labels[MetaPrefix+"kubernetes_ingress_host"] = rule.Host
+		if _, ok := labels[SchemeLabel]; !ok && secure[rule.Host] {
+			labels[SchemeLabel] = "https"
+		}
+		targets = append(targets, labels)
+	}
+	return targets
+}
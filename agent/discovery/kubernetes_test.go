@@ -0,0 +1,200 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+// kubeServer is a fake Kubernetes API server, serving lists of resources
+// and replaying watch events, as recorded from a real cluster, pushed by the
+// test
+type kubeServer struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	lists   map[string]string
+	watches map[string]chan string
+}
+
+func newKubeServer(t *testing.T, token string, lists map[string]string) *kubeServer {
+	s := &kubeServer{lists: lists, watches: make(map[string]chan string)}
+	for path := range lists {
+		s.watches[path] = make(chan string)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		s.mutex.Lock()
+		list, ok := s.lists[r.URL.Path]
+		s.mutex.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("watch") == "" {
+			w.Write([]byte(list))
+			return
+		}
+		if r.URL.Query().Get("resourceVersion") == "" {
+			t.Errorf("kubernetes watch failed: expected a resource version\n")
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case event := <-s.watches[r.URL.Path]:
+				w.Write([]byte(event + "\n"))
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// send push an event on the watch stream of a resource
+func (s *kubeServer) send(path, event string) {
+	s.watches[path] <- event
+}
+
+// relist replace the list of a resource and expire its watch stream
+func (s *kubeServer) relist(path, list string) {
+	s.mutex.Lock()
+	s.lists[path] = list
+	s.mutex.Unlock()
+	s.send(path, `{"type":"ERROR","object":{"kind":"Status","code":410,"reason":"Expired"}}`)
+}
+
+const (
+	servicesPath  = "/api/v1/namespaces/shop/services"
+	endpointsPath = "/api/v1/namespaces/shop/endpoints"
+	ingressesPath = "/apis/networking.k8s.io/v1/namespaces/shop/ingresses"
+)
+
+func TestKubernetesDiscovery(t *testing.T) {
+	token := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(token, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	server := newKubeServer(t, "secret", map[string]string{
+		servicesPath: `{"kind":"ServiceList","metadata":{"resourceVersion":"100"},"items":[
+			{"metadata":{"name":"web","namespace":"shop","resourceVersion":"90",
+				"annotations":{"overseer.io/probe":"true","overseer.io/port":"http",
+					"overseer.io/path":"/health","overseer.io/tags":"web"}},
+				"spec":{"ports":[{"name":"metrics","port":9090},{"name":"http","port":80}]}},
+			{"metadata":{"name":"api","namespace":"shop","resourceVersion":"91",
+				"annotations":{"overseer.io/probe":"endpoints","overseer.io/interval":"10s"}},
+				"spec":{"ports":[{"name":"http","port":8080}]}},
+			{"metadata":{"name":"db","namespace":"shop","resourceVersion":"92"},
+				"spec":{"ports":[{"port":5432}]}}]}`,
+		endpointsPath: `{"kind":"EndpointsList","metadata":{"resourceVersion":"100"},"items":[
+			{"metadata":{"name":"api","namespace":"shop","resourceVersion":"93"},
+				"subsets":[{"addresses":[
+					{"ip":"10.0.0.1","targetRef":{"kind":"Pod","name":"api-1"}},
+					{"ip":"10.0.0.2","targetRef":{"kind":"Pod","name":"api-2"}}],
+					"notReadyAddresses":[{"ip":"10.0.0.3"}],
+					"ports":[{"name":"http","port":8080}]}]}]}`,
+		ingressesPath: `{"kind":"IngressList","metadata":{"resourceVersion":"100"},"items":[
+			{"metadata":{"name":"shop","namespace":"shop","resourceVersion":"94",
+				"annotations":{"overseer.io/probe":"true"}},
+				"spec":{"tls":[{"hosts":["shop.example.com"]}],
+					"rules":[{"host":"shop.example.com"},{"host":"admin.example.com"}]}}]}`,
+	})
+
+	logger := log.New(ioutil.Discard, "", 0)
+	m, err := NewManagerFromConfig(Config{
+		Kubernetes: &KubernetesConfig{
+			APIServer:       server.URL,
+			Namespaces:      []string{"shop"},
+			BearerTokenFile: token,
+		},
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []Target)
+	go m.Run(ctx, updates)
+
+	// Resources are listed independently, wait for the expected targets
+	// through the partial updates
+	var last []Target
+	waitFor := func(expected []Target) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for !reflect.DeepEqual(last, expected) {
+			select {
+			case last = <-updates:
+			case <-timeout:
+				t.Fatalf("kubernetes discovery failed: expected %v got %v\n", expected, last)
+			}
+		}
+	}
+	waitFor([]Target{
+		{Url: "http://10.0.0.1:8080", Interval: 10 * time.Second},
+		{Url: "http://10.0.0.2:8080", Interval: 10 * time.Second},
+		{Url: "http://admin.example.com"},
+		{Url: "http://web.shop.svc:80/health", Tags: []string{"web"}},
+		{Url: "https://shop.example.com"},
+	})
+
+	// A pod is no longer ready and the ingress is removed
+	server.send(endpointsPath, `{"type":"MODIFIED","object":{"metadata":{"name":"api",
+		"namespace":"shop","resourceVersion":"101"},"subsets":[{"addresses":[{"ip":"10.0.0.2"}],
+		"notReadyAddresses":[{"ip":"10.0.0.1"}],"ports":[{"name":"http","port":8080}]}]}}`)
+	server.send(ingressesPath, `{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"102"}}}`)
+	server.send(ingressesPath, `{"type":"DELETED","object":{"metadata":{"name":"shop",
+		"namespace":"shop","resourceVersion":"103"}}}`)
+	waitFor([]Target{
+		{Url: "http://10.0.0.2:8080", Interval: 10 * time.Second},
+		{Url: "http://web.shop.svc:80/health", Tags: []string{"web"}},
+	})
+
+	// The watch of the services expires while the db service is annotated,
+	// the services are listed again
+	server.relist(servicesPath, `{"kind":"ServiceList","metadata":{"resourceVersion":"200"},"items":[
+		{"metadata":{"name":"db","namespace":"shop","resourceVersion":"150",
+			"annotations":{"overseer.io/probe":"true","overseer.io/scheme":"tcp"}},
+			"spec":{"ports":[{"port":5432}]}}]}`)
+	waitFor([]Target{{Url: "tcp://db.shop.svc:5432"}})
+}
@@ -0,0 +1,133 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package discovery
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Relabeling actions
+const (
+	ActionReplace = "replace"
+	ActionKeep    = "keep"
+	ActionDrop    = "drop"
+)
+
+// RelabelConfig is a relabeling rule, Prometheus style. The values of the
+// `source_labels` are joined by `separator` and matched against `regex`:
+//
+//   - replace: set `target_label` to `replacement`, expanded with the regex
+//     capture groups, if the regex matches, an empty result removes the label
+//   - keep: drop the target unless the regex matches
+//   - drop: drop the target if the regex matches
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels,omitempty"`
+	Separator    string   `yaml:"separator,omitempty"`
+	Regex        string   `yaml:"regex,omitempty"`
+	TargetLabel  string   `yaml:"target_label,omitempty"`
+	Replacement  *string  `yaml:"replacement,omitempty"`
+	Action       string   `yaml:"action,omitempty"`
+}
+
+// RelabelRule is a compiled relabeling rule
+type RelabelRule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+	action       string
+}
+
+// NewRelabelRule compile a relabeling rule, setting the defaults for the
+// optional fields
+func NewRelabelRule(c RelabelConfig) (*RelabelRule, error) {
+	rule := &RelabelRule{
+		sourceLabels: c.SourceLabels,
+		separator:    c.Separator,
+		targetLabel:  c.TargetLabel,
+		replacement:  "$1",
+		action:       c.Action,
+	}
+	if rule.separator == "" {
+		rule.separator = ";"
+	}
+	if c.Replacement != nil {
+		rule.replacement = *c.Replacement
+	}
+	if rule.action == "" {
+		rule.action = ActionReplace
+	}
+	regex := c.Regex
+	if regex == "" {
+		regex = "(.*)"
+	}
+	re, err := regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return nil, err
+	}
+	rule.regex = re
+	switch rule.action {
+	case ActionReplace:
+		if rule.targetLabel == "" {
+			return nil, fmt.Errorf("relabel: replace requires a target_label")
+		}
+	case ActionKeep, ActionDrop:
+	default:
+		return nil, fmt.Errorf("relabel: unknown action %s", rule.action)
+	}
+	return rule, nil
+}
+
+// Apply the rule to a set of labels, modifying them in place, return false
+// if the target has to be dropped
+func (r *RelabelRule) Apply(labels Labels) bool {
+	values := make([]string, len(r.sourceLabels))
+	for i, name := range r.sourceLabels {
+		values[i] = labels[name]
+	}
+	value := strings.Join(values, r.separator)
+	match := r.regex.FindStringSubmatchIndex(value)
+	switch r.action {
+	case ActionKeep:
+		return match != nil
+	case ActionDrop:
+		return match == nil
+	}
+	if match == nil {
+		return true
+	}
+	result := string(r.regex.ExpandString(nil, r.replacement, value, match))
+	if result == "" {
+		delete(labels, r.targetLabel)
+	} else {
+		labels[r.targetLabel] = result
+	}
+	return true
+}
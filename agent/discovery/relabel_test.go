@@ -0,0 +1,120 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package discovery
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRelabelRule(t *testing.T) {
+	empty := ""
+	cases := []struct {
+		name     string
+		config   RelabelConfig
+		labels   Labels
+		keep     bool
+		expected Labels
+	}{
+		{
+			"replace with capture groups",
+			RelabelConfig{
+				SourceLabels: []string{"__meta_dns_srv_target", "__meta_dns_srv_port"},
+				Regex:        "([^.]+)\\..*;(.*)",
+				TargetLabel:  "__address__",
+				Replacement:  stringPtr("$1:$2"),
+			},
+			Labels{"__meta_dns_srv_target": "web.example.test", "__meta_dns_srv_port": "80"},
+			true,
+			Labels{"__meta_dns_srv_target": "web.example.test", "__meta_dns_srv_port": "80",
+				"__address__": "web:80"},
+		},
+		{
+			"replace not matching",
+			RelabelConfig{SourceLabels: []string{"env"}, Regex: "prod", TargetLabel: "tags"},
+			Labels{"env": "dev"},
+			true,
+			Labels{"env": "dev"},
+		},
+		{
+			"replace with empty value removes the label",
+			RelabelConfig{SourceLabels: []string{"env"}, TargetLabel: "tags", Replacement: &empty},
+			Labels{"env": "dev", "tags": "web"},
+			true,
+			Labels{"env": "dev"},
+		},
+		{
+			"keep matching",
+			RelabelConfig{SourceLabels: []string{"env"}, Regex: "prod|staging", Action: ActionKeep},
+			Labels{"env": "staging"},
+			true,
+			Labels{"env": "staging"},
+		},
+		{
+			"keep not matching",
+			RelabelConfig{SourceLabels: []string{"env"}, Regex: "prod", Action: ActionKeep},
+			Labels{"env": "production"},
+			false,
+			nil,
+		},
+		{
+			"drop matching",
+			RelabelConfig{SourceLabels: []string{"env"}, Regex: "dev", Action: ActionDrop},
+			Labels{"env": "dev"},
+			false,
+			nil,
+		},
+	}
+	for _, c := range cases {
+		rule, err := NewRelabelRule(c.config)
+		if err != nil {
+			t.Fatalf("%s failed: %v\n", c.name, err)
+		}
+		keep := rule.Apply(c.labels)
+		if keep != c.keep {
+			t.Errorf("%s failed: expected keep %v got %v\n", c.name, c.keep, keep)
+		}
+		if keep && !reflect.DeepEqual(c.labels, c.expected) {
+			t.Errorf("%s failed: expected %v got %v\n", c.name, c.expected, c.labels)
+		}
+	}
+}
+
+func TestNewRelabelRuleErrors(t *testing.T) {
+	configs := []RelabelConfig{
+		{SourceLabels: []string{"env"}},
+		{SourceLabels: []string{"env"}, Action: "hashmod"},
+		{SourceLabels: []string{"env"}, Regex: "(", Action: ActionKeep},
+	}
+	for _, c := range configs {
+		if _, err := NewRelabelRule(c); err == nil {
+			t.Errorf("NewRelabelRule failed: expected error for %v\n", c)
+		}
+	}
+}
+
+func stringPtr(s string) *string { return &s }
@@ -0,0 +1,153 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+	"github.com/codepr/overseer/internal/messaging"
+)
+
+// RegistryConfig enables the targets managed through the registry service,
+// the agent subscribes to the changes broadcast on `Topic` and reconciles
+// its targets without restarts, probing them along with the static ones
+type RegistryConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Topic   string `yaml:"topic,omitempty"`
+}
+
+// DefaultRegistryConfig return a disabled registry configuration with
+// sensible defaults
+func DefaultRegistryConfig() RegistryConfig {
+	return RegistryConfig{Topic: "targets"}
+}
+
+// subscribeRegistry reconcile the managed targets with every change
+// broadcast by the registry
+func (a *Agent) subscribeRegistry(ctx context.Context, broadcaster messaging.Broadcaster) {
+	events := make(chan messaging.Delivery)
+	go func() {
+		if err := broadcaster.Subscribe(ctx, a.registry.Topic, events); err != nil {
+			a.logger.Println("Error subscribing to the registry:", err)
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case d := <-events:
+				var event TargetEvent
+				if err := d.Decode(&event); err != nil {
+					a.logger.Println("Error decoding target event")
+					continue
+				}
+				a.reconcile(event)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// reconcile apply a change of the registry to the managed targets, a
+// snapshot replaces them altogether. Targets with a probe type not
+// supported are ignored.
+func (a *Agent) reconcile(event TargetEvent) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	switch event.Action {
+	case TargetCreated, TargetUpdated:
+		if !supported(event.Target) {
+			a.logger.Printf("Unsupported probe %s for %s\n", event.Target.Probe, event.Target.Url)
+			return
+		}
+		a.managed[event.Target.ID] = event.Target
+		a.logger.Printf("Target %s %s\n", event.Target.Url, event.Action)
+	case TargetDeleted:
+		delete(a.managed, event.Target.ID)
+		a.logger.Printf("Target %s %s\n", event.Target.Url, event.Action)
+	case TargetsSnapshot:
+		managed := make(map[string]Target, len(event.Targets))
+		for _, target := range event.Targets {
+			if supported(target) {
+				managed[target.ID] = target
+			}
+		}
+		if len(managed) != len(a.managed) {
+			a.logger.Printf("Targets reconciled, %d managed by the registry\n", len(managed))
+		}
+		a.managed = managed
+	}
+}
+
+// supported return true if the agent is able to probe a target
+func supported(target Target) bool {
+	return target.Probe == "" || target.Probe == ProbeHTTP
+}
+
+// currentTargets return the static targets along with those managed by the
+// registry and those discovered, sorted by URL. With the same URL, static
+// targets take precedence on managed ones, which in turn take precedence on
+// discovered ones
+func (a *Agent) currentTargets() []Target {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if len(a.managed) == 0 && len(a.discovered) == 0 {
+		return a.targets
+	}
+	seen := make(map[URL]bool, len(a.targets))
+	targets := make([]Target, 0, len(a.targets)+len(a.managed)+len(a.discovered))
+	for _, target := range a.targets {
+		seen[target.Url] = true
+		targets = append(targets, target)
+	}
+	for _, target := range a.managed {
+		if !seen[target.Url] {
+			seen[target.Url] = true
+			targets = append(targets, target)
+		}
+	}
+	for _, target := range a.discovered {
+		if !seen[target.Url] {
+			seen[target.Url] = true
+			targets = append(targets, target)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Url < targets[j].Url })
+	return targets
+}
+
+// intervalOf return the probing interval of a target, the agent one unless
+// overridden by the target
+func (a *Agent) intervalOf(target Target) time.Duration {
+	if target.Interval > 0 {
+		return target.Interval
+	}
+	return a.interval
+}
@@ -0,0 +1,89 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+func TestReconcile(t *testing.T) {
+	a := New(TargetsFromURLs([]URL{"http://static"}), time.Second, time.Second, "urlstatus", nil)
+	urls := func() []URL {
+		var urls []URL
+		for _, target := range a.currentTargets() {
+			urls = append(urls, target.Url)
+		}
+		return urls
+	}
+	a.reconcile(TargetEvent{Action: TargetCreated, Target: Target{ID: "1", Url: "http://managed-1"}})
+	a.reconcile(TargetEvent{Action: TargetCreated, Target: Target{ID: "2", Url: "http://static"}})
+	a.reconcile(TargetEvent{Action: TargetCreated, Target: Target{ID: "3", Url: "http://ping", Probe: "icmp"}})
+	expected := []URL{"http://managed-1", "http://static"}
+	if got := urls(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("reconcile failed: expected %v got %v\n", expected, got)
+	}
+
+	a.reconcile(TargetEvent{Action: TargetDeleted, Target: Target{ID: "1", Url: "http://managed-1"}})
+	a.reconcile(TargetEvent{Action: TargetsSnapshot, Targets: []Target{
+		{ID: "4", Url: "http://managed-4", Interval: 10 * time.Millisecond},
+		{ID: "5", Url: "http://managed-5"},
+	}})
+	expected = []URL{"http://managed-4", "http://managed-5", "http://static"}
+	if got := urls(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("reconcile failed: expected %v got %v\n", expected, got)
+	}
+	if interval := a.intervalOf(a.currentTargets()[0]); interval != 10*time.Millisecond {
+		t.Errorf("intervalOf failed: expected 10ms got %v\n", interval)
+	}
+	if interval := a.intervalOf(a.currentTargets()[1]); interval != time.Second {
+		t.Errorf("intervalOf failed: expected 1s got %v\n", interval)
+	}
+}
+
+func TestCurrentTargetsDiscovered(t *testing.T) {
+	a := New(TargetsFromURLs([]string{"http://b.example"}), time.Second, time.Second, "urlstatus", nil)
+	a.reconcile(TargetEvent{Action: TargetCreated, Target: Target{ID: "1", Url: "http://c.example"}})
+	a.discovered = []Target{
+		{Url: "http://a.example"},
+		{Url: "http://b.example", Interval: time.Minute},
+		{Url: "http://c.example", Interval: time.Minute},
+	}
+	targets := a.currentTargets()
+	if len(targets) != 3 {
+		t.Fatalf("Agent.currentTargets failed: expected 3 targets got %v\n", targets)
+	}
+	for _, target := range targets {
+		if target.Url != "http://a.example" && target.Interval != 0 {
+			t.Errorf("Agent.currentTargets failed: expected %s to take precedence on the discovered one got %v\n",
+				target.Url, target)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+// ShardingConfig enables the sharding of the targets across a pool of agents
+// sharing the same region: every agent broadcasts a heartbeat on `Topic`
+// once every `Heartbeat` and the targets are spread over a consistent hash
+// ring of the agents alive, so that each target is probed by exactly one of
+// them. Agents not heard of for three heartbeats are considered gone.
+type ShardingConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Topic     string        `yaml:"topic,omitempty"`
+	Heartbeat time.Duration `yaml:"heartbeat,omitempty"`
+}
+
+// DefaultShardingConfig return a disabled sharding configuration with
+// sensible defaults
+func DefaultShardingConfig() ShardingConfig {
+	return ShardingConfig{Topic: "agents", Heartbeat: 2 * time.Second}
+}
+
+// assigned return the targets owned by the agent in the pool, the second
+// value is true if the pool changed since the last call. Agents of other
+// regions are not part of the pool as they're expected to probe the same
+// targets from their location.
+func assigned(members *Membership, targets []Target, now time.Time) ([]Target, bool) {
+	ring, rebuilt := members.Ring(now)
+	owned := make([]Target, 0, len(targets))
+	for _, target := range targets {
+		if members.Owns(ring, target.Url) {
+			owned = append(owned, target)
+		}
+	}
+	return owned, rebuilt
+}
@@ -0,0 +1,190 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+// pool simulates a pool of agents of the same region exchanging heartbeats
+type pool map[string]*Membership
+
+func (p pool) beat(now time.Time, leaving ...string) {
+	for _, m := range p {
+		for _, peer := range p {
+			m.Observe(peer.Heartbeat(false), now)
+		}
+		for _, name := range leaving {
+			m.Observe(Heartbeat{Name: name, Group: "eu", Leaving: true}, now)
+		}
+	}
+}
+
+// without return the pool without a member
+func (p pool) without(name string) pool {
+	others := make(pool, len(p))
+	for n, m := range p {
+		if n != name {
+			others[n] = m
+		}
+	}
+	return others
+}
+
+// probes count how many agents of the pool probe each target
+func (p pool) probes(targets []Target, now time.Time) map[URL]int {
+	counts := make(map[URL]int)
+	for _, m := range p {
+		owned, _ := assigned(m, targets, now)
+		for _, target := range owned {
+			counts[target.Url]++
+		}
+	}
+	return counts
+}
+
+func checkShards(t *testing.T, counts map[URL]int, targets []Target) {
+	t.Helper()
+	for _, target := range targets {
+		if counts[target.Url] != 1 {
+			t.Errorf("sharding failed: expected %s probed once got %d\n",
+				target.Url, counts[target.Url])
+		}
+	}
+}
+
+func TestMembershipSharding(t *testing.T) {
+	targets := make([]Target, 100)
+	for i := range targets {
+		targets[i] = Target{Url: fmt.Sprintf("http://server-%d", i)}
+	}
+	interval := time.Second
+	now := time.Now()
+	p := pool{}
+	for _, name := range []string{"agent-1", "agent-2", "agent-3"} {
+		p[name] = NewMembership(name, "eu", interval, now)
+	}
+	// An agent of another region probes all the targets on its own
+	other := NewMembership("agent-4", "us", interval, now)
+
+	// Warming up, each agent probes all the targets until it hears of the
+	// others and then shares them with the peers heard of
+	for _, target := range targets {
+		if counts := p.probes(targets, now); counts[target.Url] != 3 {
+			t.Errorf("sharding failed: expected %s probed 3 times got %d\n",
+				target.Url, counts[target.Url])
+		}
+	}
+	p.beat(now)
+	checkShards(t, p.probes(targets, now), targets)
+	for i := 1; i <= 3; i++ {
+		now = now.Add(interval)
+		p.beat(now)
+		other.Observe(p["agent-1"].Heartbeat(false), now)
+	}
+	checkShards(t, p.probes(targets, now), targets)
+	if owned, _ := assigned(other, targets, now); len(owned) != len(targets) {
+		t.Errorf("sharding failed: expected %d targets got %d\n", len(targets), len(owned))
+	}
+
+	// A new agent joins, the others keep their shares until the change
+	// settles while it probes its own share of a ring including them
+	p["agent-5"] = NewMembership("agent-5", "eu", interval, now)
+	p.beat(now)
+	for i := 1; i <= 3; i++ {
+		checkShards(t, p.without("agent-5").probes(targets, now), targets)
+		if owned, _ := assigned(p["agent-5"], targets, now); len(owned) == 0 ||
+			len(owned) == len(targets) {
+			t.Errorf("sharding failed: expected a share for agent-5 got %d\n", len(owned))
+		}
+		now = now.Add(interval)
+		p.beat(now)
+	}
+	checkShards(t, p.probes(targets, now), targets)
+	if owned, _ := assigned(p["agent-5"], targets, now); len(owned) == 0 {
+		t.Errorf("sharding failed: expected targets assigned to agent-5 got none\n")
+	}
+
+	// An agent leaves gracefully, its targets are handed off to the others
+	delete(p, "agent-2")
+	now = now.Add(interval)
+	p.beat(now, "agent-2")
+	now = now.Add(interval)
+	p.beat(now)
+	checkShards(t, p.probes(targets, now), targets)
+
+	// An agent crashes, its targets are taken over once it expires
+	delete(p, "agent-3")
+	for i := 1; i <= 5; i++ {
+		now = now.Add(interval)
+		p.beat(now)
+	}
+	checkShards(t, p.probes(targets, now), targets)
+	if ring, _ := p["agent-1"].Ring(now); len(ring.Members()) != 2 {
+		t.Errorf("sharding failed: expected 2 members got %v\n", ring.Members())
+	}
+}
+
+func TestMembershipRestart(t *testing.T) {
+	targets := make([]Target, 100)
+	for i := range targets {
+		targets[i] = Target{Url: fmt.Sprintf("http://server-%d", i)}
+	}
+	interval := time.Second
+	now := time.Now()
+	p := pool{}
+	for _, name := range []string{"agent-1", "agent-2", "agent-3"} {
+		p[name] = NewMembership(name, "eu", interval, now)
+	}
+	for i := 0; i <= 3; i++ {
+		p.beat(now)
+		now = now.Add(interval)
+	}
+
+	// agent-1 restarts, right after it probes all the targets
+	p["agent-1"] = NewMembership("agent-1", "eu", interval, now)
+	if owned, _ := assigned(p["agent-1"], targets, now); len(owned) != len(targets) {
+		t.Errorf("sharding failed: expected %d targets got %d\n", len(targets), len(owned))
+	}
+	// Then its share once it hears of the others, which doesn't change
+	// when the warm-up ends
+	p.beat(now)
+	checkShards(t, p.probes(targets, now), targets)
+	ring, _ := p["agent-1"].Ring(now)
+	for i := 1; i <= 4; i++ {
+		now = now.Add(interval)
+		p.beat(now)
+		checkShards(t, p.probes(targets, now), targets)
+		if current, rebuilt := p["agent-1"].Ring(now); rebuilt || current != ring {
+			t.Errorf("sharding failed: expected ring %v got %v\n", ring.Members(), current.Members())
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package aggregator
+
+import (
+	"io/ioutil"
+	"log"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/codepr/overseer/backend/alerting"
+	. "github.com/codepr/overseer/internal"
+	"github.com/codepr/overseer/internal/messaging"
+)
+
+func newTestAggregator() *Aggregator {
+	maintenance, _ := NewMaintenanceStore(nil, "")
+	return &Aggregator{
+		servers:     make(map[URL]*serverStats),
+		windowSize:  10,
+		flap:        DefaultFlapConfig(),
+		codec:       messaging.JSON,
+		rules:       alerting.NewEngine(nil),
+		maintenance: maintenance,
+		logger:      log.New(ioutil.Discard, "", 0),
+	}
+}
+
+func TestAggregateAvailability(t *testing.T) {
+	cases := []struct {
+		name         string
+		statuses     []ServerStatus
+		alive        bool
+		availability float64
+		codes        map[int]int
+	}{
+		{
+			// Regression: the first sample used to only initialize the state
+			name:         "first sample counted",
+			statuses:     []ServerStatus{{Alive: true, ResponseStatus: 200}},
+			alive:        true,
+			availability: 100.0,
+			codes:        map[int]int{200: 1},
+		},
+		{
+			name:         "first sample failure",
+			statuses:     []ServerStatus{{Alive: false, ResponseStatus: 500}},
+			alive:        false,
+			availability: 0.0,
+			codes:        map[int]int{500: 1},
+		},
+		{
+			name: "400 is an error",
+			statuses: []ServerStatus{
+				{Alive: true, ResponseStatus: 200},
+				{Alive: true, ResponseStatus: 400},
+			},
+			alive:        false,
+			availability: 50.0,
+			codes:        map[int]int{200: 1, 400: 1},
+		},
+		{
+			name: "not alive is an error",
+			statuses: []ServerStatus{
+				{Alive: true, ResponseStatus: 200},
+				{Alive: true, ResponseStatus: 204},
+				{Alive: true, ResponseStatus: 301},
+				{Alive: false},
+			},
+			alive:        false,
+			availability: 75.0,
+			codes:        map[int]int{200: 1, 204: 1, 301: 1, 0: 1},
+		},
+	}
+	for _, c := range cases {
+		a := newTestAggregator()
+		for i := range c.statuses {
+			c.statuses[i].Url = "http://localhost"
+			a.aggregate(&c.statuses[i])
+		}
+		stats := a.servers["http://localhost"]
+		if stats.Alive != c.alive {
+			t.Errorf("%s failed: expected alive %v got %v\n", c.name, c.alive, stats.Alive)
+		}
+		if math.Abs(stats.Availability-c.availability) > tolerance {
+			t.Errorf("%s failed: expected availability %v got %v\n",
+				c.name, c.availability, stats.Availability)
+		}
+		for code, count := range c.codes {
+			if stats.ResponseStatusMap[code] != count {
+				t.Errorf("%s failed: expected %d x %d got %v\n",
+					c.name, count, code, stats.ResponseStatusMap)
+			}
+		}
+	}
+}
+
+func TestReportSnapshot(t *testing.T) {
+	a := newTestAggregator()
+	a.aggregate(&ServerStatus{Url: "http://localhost", Alive: true, ResponseStatus: 200})
+	r := a.servers["http://localhost"].report(time.Now())
+	// The snapshot is not affected by the samples aggregated later
+	a.aggregate(&ServerStatus{Url: "http://localhost", Alive: true, ResponseStatus: 500})
+	expected := map[int]int{200: 1}
+	if !reflect.DeepEqual(r.stats.StatusCodes, expected) {
+		t.Errorf("report failed: expected %v got %v\n", expected, r.stats.StatusCodes)
+	}
+}
+
+func TestAggregateLocations(t *testing.T) {
+	a := newTestAggregator()
+	eu := AgentInfo{Name: "agent-1", Region: "eu-west"}
+	us := AgentInfo{Name: "agent-2", Region: "us-east"}
+	statuses := []ServerStatus{
+		{Agent: eu, Alive: true, ResponseStatus: 200},
+		{Agent: us, Alive: false},
+		{Agent: eu, Alive: true, ResponseStatus: 200},
+		{Agent: us, Alive: false},
+	}
+	for i := range statuses {
+		statuses[i].Url = "http://localhost"
+		a.aggregate(&statuses[i])
+	}
+	stats := a.servers["http://localhost"]
+	if math.Abs(stats.Availability-50.0) > tolerance {
+		t.Errorf("locations failed: expected combined availability 50 got %v\n", stats.Availability)
+	}
+	locations := stats.locationStats()
+	if len(locations) != 2 {
+		t.Fatalf("locations failed: expected 2 locations got %v\n", locations)
+	}
+	if locations[0].Region != "eu-west" || !locations[0].Alive || locations[0].Availability != 100.0 {
+		t.Errorf("locations failed: unexpected eu-west stats %v\n", locations[0])
+	}
+	if locations[1].Region != "us-east" || locations[1].Alive || locations[1].Availability != 0.0 {
+		t.Errorf("locations failed: unexpected us-east stats %v\n", locations[1])
+	}
+}
+
+func TestAggregateQuorumHysteresis(t *testing.T) {
+	a := newTestAggregator()
+	a.flap.Rise, a.flap.Fall = 2, 2
+	a.quorum = QuorumConfig{Agents: 2, Window: time.Minute}
+	agents := []AgentInfo{{Name: "agent-1"}, {Name: "agent-2"}}
+	probe := func(agent AgentInfo, alive bool) *serverStats {
+		status := ServerStatus{Url: "http://localhost", Agent: agent, Alive: alive, ResponseStatus: 200}
+		a.aggregate(&status)
+		return a.servers["http://localhost"]
+	}
+	for _, agent := range agents {
+		probe(agent, true)
+	}
+	for i := 0; i < 2; i++ {
+		for _, agent := range agents {
+			probe(agent, false)
+		}
+	}
+	// Each location falls after two failures, the combined view follows
+	// the verdict without waiting for two more
+	stats := a.servers["http://localhost"]
+	if stats.Alive || !stats.verdict.down {
+		t.Errorf("quorum failed: expected down once both agents fell got %v %v\n",
+			stats.Alive, stats.verdict)
+	}
+}
+
+func TestAggregateQuorum(t *testing.T) {
+	a := newTestAggregator()
+	a.quorum = QuorumConfig{Agents: 2, Window: time.Minute}
+	agents := []AgentInfo{{Name: "agent-1"}, {Name: "agent-2"}, {Name: "agent-3"}}
+	probe := func(agent AgentInfo, alive bool) *serverStats {
+		status := ServerStatus{Url: "http://localhost", Agent: agent, Alive: alive, ResponseStatus: 200}
+		a.aggregate(&status)
+		return a.servers["http://localhost"]
+	}
+	for _, agent := range agents {
+		probe(agent, true)
+	}
+	// A single agent seeing the server down is an outlier
+	stats := probe(agents[0], false)
+	if !stats.Alive || stats.verdict.outlier != "agent-1" {
+		t.Errorf("quorum failed: expected alive with outlier agent-1 got %v %v\n",
+			stats.Alive, stats.verdict)
+	}
+	// Two agents out of three reach the quorum
+	stats = probe(agents[1], false)
+	if stats.Alive || stats.verdict.outlier != "" ||
+		len(stats.verdict.failing) != 2 || stats.verdict.failing[1] != "agent-2" {
+		t.Errorf("quorum failed: expected down seen by agent-1 and agent-2 got %v %v\n",
+			stats.Alive, stats.verdict)
+	}
+	// Back up as soon as the quorum is lost, the combined view doesn't
+	// debounce the verdict again
+	stats = probe(agents[1], true)
+	if !stats.Alive {
+		t.Errorf("quorum failed: expected alive with a single failing agent got %v %v\n",
+			stats.Alive, stats.verdict)
+	}
+	// Agents not reporting within the window are not taken into account,
+	// a single active agent can't declare the server down
+	stats.locations["agent-2"].lastSeen = time.Now().Add(-time.Hour)
+	stats.locations["agent-3"].lastSeen = time.Now().Add(-time.Hour)
+	stats = probe(agents[0], false)
+	if !stats.Alive || !stats.verdict.unknown ||
+		stats.stats(time.Now()).State != StateUnknown {
+		t.Errorf("quorum failed: expected unknown with a single active agent got %v %v\n",
+			stats.Alive, stats.verdict)
+	}
+}
@@ -0,0 +1,179 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package aggregator
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+// Classifier decides whether a probe is a success or a failure, every
+// availability figure, SLO and alerting rule builds upon it
+type Classifier interface {
+	Success(*ServerStatus) bool
+}
+
+// statusClass classifies as successful the probes of alive servers which
+// responded with a status code in one of the accepted classes, e.g. 2 for
+// 2xx codes
+type statusClass struct {
+	classes []int
+}
+
+func (c statusClass) Success(s *ServerStatus) bool {
+	if !s.Alive {
+		return false
+	}
+	for _, class := range c.classes {
+		if s.ResponseStatus/100 == class {
+			return true
+		}
+	}
+	return false
+}
+
+// latencyThreshold classifies as successful the probes of alive servers
+// faster than a threshold
+type latencyThreshold struct {
+	threshold time.Duration
+}
+
+func (c latencyThreshold) Success(s *ServerStatus) bool {
+	return s.Alive && s.ResponseTime <= c.threshold
+}
+
+// assertionsPassed classifies as successful the probes of alive servers
+// which passed every assertion of the target
+type assertionsPassed struct{}
+
+func (c assertionsPassed) Success(s *ServerStatus) bool {
+	if !s.Alive {
+		return false
+	}
+	for _, result := range s.Assertions {
+		if !result.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// allOf classifies as successful the probes every classifier agrees on
+type allOf []Classifier
+
+func (c allOf) Success(s *ServerStatus) bool {
+	for _, classifier := range c {
+		if !classifier.Success(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// DefaultClassifier is used for targets not selected by any configured
+// classifier, a probe is successful if the server is alive and responded
+// with a 2xx or 3xx status code
+var DefaultClassifier Classifier = statusClass{[]int{2, 3}}
+
+// ClassifierConfig defines how to classify the probes of the listed
+// targets and of every target tagged with one of the listed tags, a probe
+// is successful only if it satisfies all of the criteria set:
+//
+// - status_classes: accepted status code classes, e.g. [2, 3]
+// - max_latency: maximum response time
+// - assertions: every target assertion must pass
+//
+// Probes of servers not alive are always failures.
+type ClassifierConfig struct {
+	Name          string        `yaml:"name"`
+	StatusClasses []int         `yaml:"status_classes,omitempty"`
+	MaxLatency    time.Duration `yaml:"max_latency,omitempty"`
+	Assertions    bool          `yaml:"assertions,omitempty"`
+	Selector      `yaml:",inline"`
+}
+
+// NewClassifier create a new `Classifier` from its configuration
+func NewClassifier(c ClassifierConfig) (Classifier, error) {
+	var classifiers allOf
+	for _, class := range c.StatusClasses {
+		if class < 1 || class > 5 {
+			return nil, fmt.Errorf("classifier %s: invalid status class %d", c.Name, class)
+		}
+	}
+	if len(c.StatusClasses) > 0 {
+		classifiers = append(classifiers, statusClass{c.StatusClasses})
+	}
+	if c.MaxLatency > 0 {
+		classifiers = append(classifiers, latencyThreshold{c.MaxLatency})
+	}
+	if c.Assertions {
+		classifiers = append(classifiers, assertionsPassed{})
+	}
+	if len(classifiers) == 0 {
+		return nil, fmt.Errorf("classifier %s: no criteria set", c.Name)
+	}
+	if len(classifiers) == 1 {
+		return classifiers[0], nil
+	}
+	return classifiers, nil
+}
+
+// classifierRule pairs a classifier with its target selection
+type classifierRule struct {
+	config     ClassifierConfig
+	classifier Classifier
+}
+
+// classifiers select the classifier of each target, the first configured
+// one applying to the target wins
+type classifiers []classifierRule
+
+// newClassifiers create the classifiers from their configuration
+func newClassifiers(configs []ClassifierConfig) (classifiers, error) {
+	rules := make(classifiers, 0, len(configs))
+	for _, c := range configs {
+		classifier, err := NewClassifier(c)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, classifierRule{c, classifier})
+	}
+	return rules, nil
+}
+
+// For return the classifier of a target, `DefaultClassifier` if none
+// applies
+func (c classifiers) For(target Target) Classifier {
+	for i := range c {
+		if c[i].config.Applies(target) {
+			return c[i].classifier
+		}
+	}
+	return DefaultClassifier
+}
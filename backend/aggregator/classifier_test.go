@@ -0,0 +1,113 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package aggregator
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+func TestClassifiers(t *testing.T) {
+	passed := []AssertionResult{{Assertion: "body_contains ok", Passed: true}}
+	failed := []AssertionResult{{Assertion: "body_contains ok", Passed: false}}
+	cases := []struct {
+		name     string
+		config   ClassifierConfig
+		status   ServerStatus
+		expected bool
+	}{
+		{"default 200", ClassifierConfig{}, ServerStatus{Alive: true, ResponseStatus: 200}, true},
+		{"default 302", ClassifierConfig{}, ServerStatus{Alive: true, ResponseStatus: 302}, true},
+		{"default 400", ClassifierConfig{}, ServerStatus{Alive: true, ResponseStatus: 400}, false},
+		{"default 503", ClassifierConfig{}, ServerStatus{Alive: true, ResponseStatus: 503}, false},
+		{"default not alive", ClassifierConfig{}, ServerStatus{Alive: false, ResponseStatus: 200}, false},
+		{"2xx only 302", ClassifierConfig{StatusClasses: []int{2}},
+			ServerStatus{Alive: true, ResponseStatus: 302}, false},
+		{"4xx accepted", ClassifierConfig{StatusClasses: []int{2, 4}},
+			ServerStatus{Alive: true, ResponseStatus: 404}, true},
+		{"latency under", ClassifierConfig{MaxLatency: 300 * time.Millisecond},
+			ServerStatus{Alive: true, ResponseStatus: 500, ResponseTime: 100 * time.Millisecond}, true},
+		{"latency over", ClassifierConfig{MaxLatency: 300 * time.Millisecond},
+			ServerStatus{Alive: true, ResponseStatus: 200, ResponseTime: time.Second}, false},
+		{"latency not alive", ClassifierConfig{MaxLatency: 300 * time.Millisecond},
+			ServerStatus{Alive: false, ResponseTime: time.Millisecond}, false},
+		{"assertions passed", ClassifierConfig{Assertions: true},
+			ServerStatus{Alive: true, ResponseStatus: 200, Assertions: passed}, true},
+		{"assertions failed", ClassifierConfig{Assertions: true},
+			ServerStatus{Alive: true, ResponseStatus: 200, Assertions: failed}, false},
+		{"all of passed", ClassifierConfig{StatusClasses: []int{2}, MaxLatency: time.Second, Assertions: true},
+			ServerStatus{Alive: true, ResponseStatus: 200, ResponseTime: time.Millisecond, Assertions: passed}, true},
+		{"all of slow", ClassifierConfig{StatusClasses: []int{2}, MaxLatency: time.Millisecond, Assertions: true},
+			ServerStatus{Alive: true, ResponseStatus: 200, ResponseTime: time.Second, Assertions: passed}, false},
+	}
+	for _, c := range cases {
+		classifier := DefaultClassifier
+		if c.config.StatusClasses != nil || c.config.MaxLatency != 0 || c.config.Assertions {
+			var err error
+			if classifier, err = NewClassifier(c.config); err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+		}
+		if got := classifier.Success(&c.status); got != c.expected {
+			t.Errorf("%s failed: expected %v got %v\n", c.name, c.expected, got)
+		}
+	}
+}
+
+func TestClassifiersSelection(t *testing.T) {
+	rules, err := newClassifiers([]ClassifierConfig{
+		{Name: "api", Selector: Selector{Tags: []string{"api"}}, StatusClasses: []int{2, 4}},
+		{Name: "slow", Selector: Selector{Targets: []URL{"http://slow"}}, MaxLatency: time.Second},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := &ServerStatus{Alive: true, ResponseStatus: 404}
+	if !rules.For(Target{Url: "http://a", Tags: []string{"api"}}).Success(status) {
+		t.Errorf("selection failed: expected api classifier for tag api\n")
+	}
+	if rules.For(Target{Url: "http://b"}).Success(status) {
+		t.Errorf("selection failed: expected default classifier for untagged target\n")
+	}
+	if !rules.For(Target{Url: "http://slow"}).Success(status) {
+		t.Errorf("selection failed: expected latency classifier for http://slow\n")
+	}
+}
+
+func TestNewClassifierInvalid(t *testing.T) {
+	configs := []ClassifierConfig{
+		{Name: "empty"},
+		{Name: "bad class", StatusClasses: []int{6}},
+	}
+	for _, c := range configs {
+		if _, err := NewClassifier(c); err == nil {
+			t.Errorf("new classifier failed: expected error for %s\n", c.Name)
+		}
+	}
+}
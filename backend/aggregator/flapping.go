@@ -0,0 +1,138 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package aggregator
+
+// Possible states of a server as exposed in `Stats`
+const (
+	StateUp       = "up"
+	StateDown     = "down"
+	StateFlapping = "flapping"
+	StateUnknown  = "unknown"
+)
+
+// FlapConfig defines the hysteresis applied to the alive state of servers.
+// A server is considered up after `Rise` consecutive successful probes and
+// down after `Fall` consecutive failed ones. Flapping is detected by
+// tracking the rate of raw state transitions over the last `Window` probes:
+// a server starts flapping when the rate rises above `HighThreshold` and
+// stops when it drops below `LowThreshold`.
+type FlapConfig struct {
+	Rise          int     `yaml:"rise,omitempty"`
+	Fall          int     `yaml:"fall,omitempty"`
+	Window        int     `yaml:"window,omitempty"`
+	HighThreshold float64 `yaml:"high_threshold,omitempty"`
+	LowThreshold  float64 `yaml:"low_threshold,omitempty"`
+}
+
+// DefaultFlapConfig return the default hysteresis settings, state changes
+// are applied on every probe like no hysteresis at all
+func DefaultFlapConfig() FlapConfig {
+	return FlapConfig{
+		Rise:          1,
+		Fall:          1,
+		Window:        20,
+		HighThreshold: 0.5,
+		LowThreshold:  0.25,
+	}
+}
+
+// stateTracker debounces the raw alive state reported by each probe,
+// applying rise and fall thresholds and detecting flapping servers
+type stateTracker struct {
+	config      FlapConfig
+	initialized bool
+	up          bool
+	last        bool
+	successes   int
+	failures    int
+	transitions []bool
+	flapping    bool
+}
+
+func newStateTracker(config FlapConfig) *stateTracker {
+	return &stateTracker{config: config}
+}
+
+// observe update the state with the outcome of a new probe, the first
+// probe sets the state straight away
+func (s *stateTracker) observe(alive bool) {
+	if !s.initialized {
+		s.initialized = true
+		s.up, s.last = alive, alive
+	}
+	if alive {
+		s.successes++
+		s.failures = 0
+	} else {
+		s.failures++
+		s.successes = 0
+	}
+	if !s.up && s.successes >= s.config.Rise {
+		s.up = true
+	} else if s.up && s.failures >= s.config.Fall {
+		s.up = false
+	}
+	// Track raw transitions over the window to compute the flapping rate
+	s.transitions = append(s.transitions, alive != s.last)
+	if len(s.transitions) > s.config.Window {
+		s.transitions = s.transitions[1:]
+	}
+	s.last = alive
+	rate := s.rate()
+	if !s.flapping && rate > s.config.HighThreshold {
+		s.flapping = true
+	} else if s.flapping && rate < s.config.LowThreshold {
+		s.flapping = false
+	}
+}
+
+// rate return the ratio of state transitions over the probes in the window
+func (s *stateTracker) rate() float64 {
+	if len(s.transitions) == 0 {
+		return 0.0
+	}
+	changes := 0
+	for _, changed := range s.transitions {
+		if changed {
+			changes++
+		}
+	}
+	return float64(changes) / float64(len(s.transitions))
+}
+
+// String return the current state, flapping takes precedence over up and
+// down
+func (s *stateTracker) String() string {
+	switch {
+	case s.flapping:
+		return StateFlapping
+	case s.up:
+		return StateUp
+	default:
+		return StateDown
+	}
+}
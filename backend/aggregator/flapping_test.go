@@ -0,0 +1,79 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package aggregator
+
+import "testing"
+
+func TestStateTrackerHysteresis(t *testing.T) {
+	s := newStateTracker(FlapConfig{Rise: 2, Fall: 3, Window: 20,
+		HighThreshold: 0.5, LowThreshold: 0.25})
+	s.observe(true)
+	if !s.up {
+		t.Errorf("hysteresis failed: expected first probe to set up\n")
+	}
+	s.observe(false)
+	s.observe(false)
+	if !s.up {
+		t.Errorf("hysteresis failed: expected up before fall threshold\n")
+	}
+	s.observe(false)
+	if s.up {
+		t.Errorf("hysteresis failed: expected down after 3 failures\n")
+	}
+	s.observe(true)
+	if s.up {
+		t.Errorf("hysteresis failed: expected down before rise threshold\n")
+	}
+	s.observe(true)
+	if !s.up || s.String() != StateUp {
+		t.Errorf("hysteresis failed: expected up after 2 successes got %s\n", s)
+	}
+}
+
+func TestStateTrackerFlapping(t *testing.T) {
+	s := newStateTracker(FlapConfig{Rise: 1, Fall: 1, Window: 10,
+		HighThreshold: 0.5, LowThreshold: 0.25})
+	for i := 0; i < 10; i++ {
+		s.observe(i%2 == 0)
+	}
+	if s.String() != StateFlapping {
+		t.Errorf("flapping failed: expected flapping got %s\n", s)
+	}
+	// Rate goes below the high threshold but stays above the low one
+	for i := 0; i < 3; i++ {
+		s.observe(true)
+	}
+	if !s.flapping {
+		t.Errorf("flapping failed: expected flapping above low threshold\n")
+	}
+	for i := 0; i < 10; i++ {
+		s.observe(true)
+	}
+	if s.String() != StateUp {
+		t.Errorf("flapping failed: expected up got %s\n", s)
+	}
+}
@@ -0,0 +1,234 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package aggregator
+
+import (
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+// handoff carries the state of an URL from the aggregator giving up the
+// ownership of its partition to the one taking it over, along with the
+// alerts active for it. A last message with `Done` set marks the end of
+// the handoff of a partition.
+type handoff struct {
+	Partition int       `json:"partition"`
+	From      string    `json:"from"`
+	Stats     *snapshot `json:"stats,omitempty"`
+	Alerts    []Alert   `json:"alerts,omitempty"`
+	Done      bool      `json:"done,omitempty"`
+}
+
+// snapshot is the serializable form of `serverStats`, derived values like
+// the availability, the maintenance window and the quorum verdict are left
+// out as they're computed again on the next probe
+type snapshot struct {
+	Url                URL                  `json:"url"`
+	Alive              bool                 `json:"alive"`
+	ResponseTimes      []time.Duration      `json:"response_times"`
+	LatestResponseTime time.Duration        `json:"latest_response_time"`
+	StatusCodes        map[int]int          `json:"status_codes"`
+	Failures           int                  `json:"failures"`
+	Successes          int                  `json:"successes"`
+	Total              int                  `json:"total"`
+	CertExpiry         time.Time            `json:"cert_expiry"`
+	Samples            []sampleSnapshot     `json:"samples,omitempty"`
+	State              stateSnapshot        `json:"state"`
+	SLOs               []sloSnapshot        `json:"slos,omitempty"`
+	Agent              AgentInfo            `json:"agent"`
+	LastSeen           time.Time            `json:"last_seen"`
+	Locations          map[string]*snapshot `json:"locations,omitempty"`
+}
+
+type sampleSnapshot struct {
+	At time.Time `json:"at"`
+	Ok bool      `json:"ok"`
+}
+
+type stateSnapshot struct {
+	Initialized bool   `json:"initialized"`
+	Up          bool   `json:"up"`
+	Last        bool   `json:"last"`
+	Successes   int    `json:"successes"`
+	Failures    int    `json:"failures"`
+	Transitions []bool `json:"transitions"`
+	Flapping    bool   `json:"flapping"`
+}
+
+type bucketSnapshot struct {
+	Start time.Time `json:"start"`
+	Good  int       `json:"good"`
+	Total int       `json:"total"`
+}
+
+type sloSnapshot struct {
+	Name   string           `json:"name"`
+	Fine   []bucketSnapshot `json:"fine"`
+	Coarse []bucketSnapshot `json:"coarse"`
+}
+
+// snapshot return the serializable state of the server
+func (s *serverStats) snapshot() *snapshot {
+	snap := &snapshot{
+		Url:                s.url,
+		Alive:              s.Alive,
+		ResponseTimes:      s.MovingAverageStats.items,
+		LatestResponseTime: s.LatestResponseTime,
+		StatusCodes:        s.ResponseStatusMap,
+		Failures:           s.failures,
+		Successes:          s.successes,
+		Total:              s.total,
+		CertExpiry:         s.certExpiry,
+		State: stateSnapshot{
+			Initialized: s.state.initialized,
+			Up:          s.state.up,
+			Last:        s.state.last,
+			Successes:   s.state.successes,
+			Failures:    s.state.failures,
+			Transitions: s.state.transitions,
+			Flapping:    s.state.flapping,
+		},
+		Agent:    s.agent,
+		LastSeen: s.lastSeen,
+	}
+	for _, sample := range s.samples {
+		snap.Samples = append(snap.Samples, sampleSnapshot{sample.at, sample.ok})
+	}
+	for _, slo := range s.slos {
+		snap.SLOs = append(snap.SLOs, sloSnapshot{
+			Name:   slo.config.Name,
+			Fine:   slo.fine.snapshot(),
+			Coarse: slo.coarse.snapshot(),
+		})
+	}
+	if len(s.locations) > 0 {
+		snap.Locations = make(map[string]*snapshot, len(s.locations))
+		for name, l := range s.locations {
+			snap.Locations[name] = l.snapshot()
+		}
+	}
+	return snap
+}
+
+// snapshot return the serializable buckets of the series
+func (s *series) snapshot() []bucketSnapshot {
+	buckets := make([]bucketSnapshot, len(s.buckets))
+	for i, b := range s.buckets {
+		buckets[i] = bucketSnapshot{b.start, b.good, b.total}
+	}
+	return buckets
+}
+
+// restore replace the buckets of the series with those of a snapshot
+func (s *series) restore(buckets []bucketSnapshot) {
+	s.buckets = make([]bucket, len(buckets))
+	for i, b := range buckets {
+		s.buckets[i] = bucket{start: b.Start, good: b.Good, total: b.Total}
+	}
+}
+
+// restore create a `serverStats` from a snapshot, SLOs no more declared
+// are dropped, the moving window is resized to the one configured
+func (a *Aggregator) restore(snap *snapshot) *serverStats {
+	s := a.newServerStats(snap.Url)
+	s.Alive = snap.Alive
+	for _, rt := range snap.ResponseTimes {
+		s.MovingAverageStats.Put(rt)
+	}
+	s.LatestResponseTime = snap.LatestResponseTime
+	if snap.StatusCodes != nil {
+		s.ResponseStatusMap = snap.StatusCodes
+	}
+	s.failures = snap.Failures
+	s.successes = snap.Successes
+	s.total = snap.Total
+	if s.total > 0 {
+		s.Availability = float64(s.successes*100.0) / float64(s.total)
+	}
+	s.certExpiry = snap.CertExpiry
+	for _, ss := range snap.Samples {
+		s.samples = append(s.samples, sample{ss.At, ss.Ok})
+	}
+	s.state.initialized = snap.State.Initialized
+	s.state.up = snap.State.Up
+	s.state.last = snap.State.Last
+	s.state.successes = snap.State.Successes
+	s.state.failures = snap.State.Failures
+	s.state.transitions = snap.State.Transitions
+	s.state.flapping = snap.State.Flapping
+	for _, sloSnap := range snap.SLOs {
+		for _, config := range a.slos {
+			if config.Name == sloSnap.Name {
+				tracker := newSLOTracker(config)
+				tracker.fine.restore(sloSnap.Fine)
+				tracker.coarse.restore(sloSnap.Coarse)
+				s.slos = append(s.slos, tracker)
+			}
+		}
+	}
+	s.agent = snap.Agent
+	s.lastSeen = snap.LastSeen
+	for name, l := range snap.Locations {
+		s.locations[name] = a.restore(l)
+	}
+	return s
+}
+
+// release give up the state of the URLs of a partition, returning the
+// handoff messages for the aggregator taking it over, closed by a `Done`
+// one
+func (a *Aggregator) release(partition int) []handoff {
+	var handoffs []handoff
+	for url, stats := range a.servers {
+		if Partition(url, a.partitioning.Partitions) != partition {
+			continue
+		}
+		handoffs = append(handoffs, handoff{
+			Partition: partition,
+			From:      a.name,
+			Stats:     stats.snapshot(),
+			Alerts:    a.rules.Release(url),
+		})
+		delete(a.servers, url)
+	}
+	return append(handoffs, handoff{Partition: partition, From: a.name, Done: true})
+}
+
+// adopt take over the state of an URL handed off by another aggregator,
+// URLs already tracked are left untouched as their state is more recent,
+// e.g. on late handoffs
+func (a *Aggregator) adopt(h handoff) {
+	if h.Stats == nil {
+		return
+	}
+	if _, ok := a.servers[h.Stats.Url]; ok {
+		return
+	}
+	a.servers[h.Stats.Url] = a.combined(a.restore(h.Stats))
+	a.rules.Adopt(h.Alerts)
+}
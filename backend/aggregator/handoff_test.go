@@ -0,0 +1,254 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package aggregator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codepr/overseer/backend/alerting"
+	. "github.com/codepr/overseer/internal"
+	"github.com/codepr/overseer/internal/messaging"
+)
+
+// discardQueue is a `messaging.MessageQueue` dropping every message
+type discardQueue struct{}
+
+func (discardQueue) Produce(context.Context, string, messaging.Message) error { return nil }
+func (discardQueue) Consume(context.Context, string, int, chan<- messaging.Delivery) error {
+	return nil
+}
+func (discardQueue) Close() error { return nil }
+
+// settler settles a delivery by calling itself
+type settler func()
+
+func (s settler) Ack() error             { s(); return nil }
+func (s settler) Nack(bool, error) error { s(); return nil }
+
+// partitionQueue is a `messaging.MessageQueue` handing out a status event on
+// each partition and a list of handoffs on each handoff queue, like the real
+// ones it doesn't return before the deliveries handed out are settled
+type partitionQueue struct {
+	discardQueue
+	handoffs []handoff
+}
+
+func (q partitionQueue) Consume(ctx context.Context, queue string, _ int,
+	itemChan chan<- messaging.Delivery) error {
+	var msgs []messaging.Message
+	if strings.HasSuffix(queue, ".handoff") {
+		for _, h := range q.handoffs {
+			msg, _ := messaging.Encode(messaging.JSON, "aggregator-1", h)
+			msgs = append(msgs, msg)
+		}
+	} else {
+		msg, _ := messaging.Encode(messaging.JSON, "agent-1", ServerStatus{Url: queue})
+		msgs = append(msgs, msg)
+	}
+	var inflight sync.WaitGroup
+	defer inflight.Wait()
+	for _, msg := range msgs {
+		inflight.Add(1)
+		select {
+		case itemChan <- messaging.NewDelivery(msg, 1, settler(inflight.Done)):
+		case <-ctx.Done():
+			inflight.Done()
+			return nil
+		}
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func newPartitionedAggregator(t *testing.T, name string) *Aggregator {
+	rules, err := alerting.NewEngineFromConfig([]alerting.RuleConfig{
+		{Name: "down", Condition: "not_alive", Probes: 1, Severity: "critical"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slo := &SLOConfig{Name: "availability", Selector: Selector{Tags: []string{"web"}}, Objective: 99}
+	if err := slo.validate(); err != nil {
+		t.Fatal(err)
+	}
+	a := newTestAggregator()
+	a.name = name
+	a.partitioning = PartitionConfig{Partitions: 4}
+	a.rules = rules
+	a.mq = discardQueue{}
+	a.slos = []*SLOConfig{slo}
+	return a
+}
+
+func TestHandoff(t *testing.T) {
+	from := newPartitionedAggregator(t, "aggregator-1")
+	to := newPartitionedAggregator(t, "aggregator-2")
+	now := time.Now()
+	urls := make([]URL, 20)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://server-%d", i)
+		for j, agent := range []string{"agent-1", "agent-2"} {
+			status := ServerStatus{
+				Url:            urls[i],
+				Agent:          AgentInfo{Name: agent, Region: "eu"},
+				Alive:          i%3 != 0,
+				ResponseTime:   time.Duration(i+j) * time.Millisecond,
+				ResponseStatus: 200,
+				Tags:           []string{"web"},
+			}
+			from.aggregate(&status)
+			from.evaluate(context.Background(), status.Url, now)
+		}
+	}
+	partition := Partition(urls[0], 4)
+	expected := make(map[URL]Stats)
+	for _, url := range urls {
+		if Partition(url, 4) == partition {
+			expected[url] = from.servers[url].stats(now)
+		}
+	}
+
+	handoffs := from.release(partition)
+	if !handoffs[len(handoffs)-1].Done || len(handoffs) != len(expected)+1 {
+		t.Errorf("handoff failed: expected %d states and done got %d\n",
+			len(expected), len(handoffs))
+	}
+	for _, h := range handoffs {
+		// Hand off through the wire format
+		payload, err := json.Marshal(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var received handoff
+		if err := json.Unmarshal(payload, &received); err != nil {
+			t.Fatal(err)
+		}
+		to.adopt(received)
+	}
+
+	for _, url := range urls {
+		_, kept := from.servers[url]
+		stats, adopted := to.servers[url]
+		if _, moved := expected[url]; !moved {
+			if !kept || adopted {
+				t.Errorf("handoff failed: expected %s kept got moved\n", url)
+			}
+			continue
+		}
+		if kept || !adopted {
+			t.Errorf("handoff failed: expected %s moved got kept\n", url)
+			continue
+		}
+		if got := stats.stats(now); !reflect.DeepEqual(got, expected[url]) {
+			t.Errorf("handoff failed: expected %v got %v\n", expected[url], got)
+		}
+		// Alerts already firing are not raised again by the new owner
+		if alerts := to.rules.Evaluate(stats, now); len(alerts) != 0 {
+			t.Errorf("handoff failed: expected no alert changes got %v\n", alerts)
+		}
+	}
+}
+
+func TestStatusBindings(t *testing.T) {
+	keys := []string{"status.eu.*", "status.us.#"}
+	expected := map[string][]string{"urlstatus": keys}
+	if got := statusBindings("urlstatus", keys, 0); !reflect.DeepEqual(got, expected) {
+		t.Errorf("statusBindings failed: expected %v got %v\n", expected, got)
+	}
+	expected = map[string][]string{
+		"urlstatus.0": {"status.eu.*.0", "status.us.#.0"},
+		"urlstatus.1": {"status.eu.*.1", "status.us.#.1"},
+	}
+	if got := statusBindings("urlstatus", keys, 2); !reflect.DeepEqual(got, expected) {
+		t.Errorf("statusBindings failed: expected %v got %v\n", expected, got)
+	}
+}
+
+func TestClaimPartition(t *testing.T) {
+	a := newPartitionedAggregator(t, "aggregator-2")
+	a.partitioning.HandoffTimeout = time.Hour
+	a.mq = partitionQueue{}
+	events := make(chan messaging.Delivery)
+	handoffs := make(chan handoff)
+
+	// A partition nobody owned is consumed straight away
+	c := a.claimPartition(context.Background(), 1, false, events, handoffs)
+	var event messaging.Delivery
+	select {
+	case event = <-events:
+	case <-time.After(time.Second):
+		t.Fatalf("claimPartition failed: expected an event got none\n")
+	}
+
+	// Stopping the claim waits for the event in flight to be settled
+	stopped := make(chan struct{})
+	go func() {
+		c.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Errorf("claimPartition failed: expected stop to wait for the event\n")
+	case <-time.After(50 * time.Millisecond):
+	}
+	event.Ack()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("claimPartition failed: expected stop to return once settled\n")
+	}
+
+	// A partition owned before is consumed once handed off
+	state := handoff{Partition: 2, From: "aggregator-1", Stats: &snapshot{Url: "http://server-1"}}
+	a.mq = partitionQueue{handoffs: []handoff{state, {Partition: 2, From: "aggregator-1", Done: true}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a.claimPartition(ctx, 2, true, events, handoffs)
+	select {
+	case h := <-handoffs:
+		if h.Stats == nil || h.Stats.Url != "http://server-1" {
+			t.Errorf("claimPartition failed: expected %v got %v\n", state, h)
+		}
+	case <-events:
+		t.Fatalf("claimPartition failed: expected the handoff before the events\n")
+	case <-time.After(time.Second):
+		t.Fatalf("claimPartition failed: expected a handoff got none\n")
+	}
+	select {
+	case event := <-events:
+		event.Ack()
+	case <-time.After(time.Second):
+		t.Errorf("claimPartition failed: expected an event got none\n")
+	}
+}
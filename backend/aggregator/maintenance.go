@@ -0,0 +1,257 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package aggregator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+// ErrInvalidWindow is returned when a maintenance window doesn't select any
+// target or doesn't define a valid time range
+var ErrInvalidWindow = errors.New("invalid maintenance window")
+
+// Window is a scheduled maintenance window, either one-off between
+// `StartsAt` and `EndsAt` or recurring, starting on each activation of a
+// standard cron expression and lasting `Duration`. It applies to the listed
+// targets and to every target tagged with one of the listed tags.
+type Window struct {
+	ID       string        `yaml:"id" json:"id"`
+	Name     string        `yaml:"name" json:"name"`
+	StartsAt time.Time     `yaml:"starts_at,omitempty" json:"starts_at,omitempty"`
+	EndsAt   time.Time     `yaml:"ends_at,omitempty" json:"ends_at,omitempty"`
+	Cron     string        `yaml:"cron,omitempty" json:"cron,omitempty"`
+	Duration time.Duration `yaml:"duration,omitempty" json:"duration,omitempty"`
+	Selector `yaml:",inline"`
+	schedule cron.Schedule
+}
+
+// MarshalJSON encode the window with a human readable duration
+func (w Window) MarshalJSON() ([]byte, error) {
+	type plain Window
+	return json.Marshal(struct {
+		plain
+		Duration Duration `json:"duration,omitempty"`
+	}{plain(w), Duration(w.Duration)})
+}
+
+// UnmarshalJSON decode a window with its duration expressed as a string
+// like "1h30m"
+func (w *Window) UnmarshalJSON(data []byte) error {
+	type plain Window
+	aux := struct {
+		*plain
+		Duration Duration `json:"duration,omitempty"`
+	}{plain: (*plain)(w)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	w.Duration = time.Duration(aux.Duration)
+	return nil
+}
+
+// validate check the window definition, parsing the cron expression of
+// recurring windows
+func (w *Window) validate() error {
+	if w.Empty() {
+		return fmt.Errorf("%w %s: no targets nor tags", ErrInvalidWindow, w.Name)
+	}
+	if w.Cron == "" {
+		if !w.EndsAt.After(w.StartsAt) {
+			return fmt.Errorf("%w %s: ends_at must follow starts_at", ErrInvalidWindow, w.Name)
+		}
+		return nil
+	}
+	if w.Duration <= 0 {
+		return fmt.Errorf("%w %s: recurring window needs a duration", ErrInvalidWindow, w.Name)
+	}
+	schedule, err := cron.ParseStandard(w.Cron)
+	if err != nil {
+		return fmt.Errorf("%w %s: %v", ErrInvalidWindow, w.Name, err)
+	}
+	w.schedule = schedule
+	return nil
+}
+
+// Active return true if the window is in effect at a given time, for
+// recurring windows this means the last activation of the schedule happened
+// less than `Duration` ago
+func (w *Window) Active(now time.Time) bool {
+	if w.schedule == nil {
+		return !now.Before(w.StartsAt) && now.Before(w.EndsAt)
+	}
+	return !w.schedule.Next(now.Add(-w.Duration)).After(now)
+}
+
+// Expired return true if a one-off window is over, recurring windows never
+// expire
+func (w *Window) Expired(now time.Time) bool {
+	return w.schedule == nil && !now.Before(w.EndsAt)
+}
+
+// MaintenanceStore holds the maintenance windows, both the static ones
+// defined in configuration and the ones created through the API, the latter
+// are persisted as JSON to a file, an empty path means an in-memory store
+type MaintenanceStore struct {
+	path    string
+	mutex   sync.RWMutex
+	static  []*Window
+	windows map[string]*Window
+}
+
+// NewMaintenanceStore create a new `MaintenanceStore` with a set of static
+// windows, loading the windows previously persisted to path, if any
+func NewMaintenanceStore(static []Window, path string) (*MaintenanceStore, error) {
+	store := &MaintenanceStore{path: path, windows: make(map[string]*Window)}
+	for i := range static {
+		w := static[i]
+		if err := w.validate(); err != nil {
+			return nil, err
+		}
+		if w.ID == "" {
+			w.ID = w.Name
+		}
+		store.static = append(store.static, &w)
+	}
+	var windows []*Window
+	if err := LoadJSONFile(path, &windows); err != nil {
+		return nil, err
+	}
+	for _, w := range windows {
+		if err := w.validate(); err != nil {
+			return nil, err
+		}
+		store.windows[w.ID] = w
+	}
+	return store, nil
+}
+
+// Add validate and store a new window, returning its ID
+func (m *MaintenanceStore) Add(w *Window) (string, error) {
+	if err := w.validate(); err != nil {
+		return "", err
+	}
+	id, err := NewID()
+	if err != nil {
+		return "", err
+	}
+	w.ID = id
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.windows[w.ID] = w
+	return w.ID, m.save()
+}
+
+// Delete remove a window created through the API, returning false if not
+// found
+func (m *MaintenanceStore) Delete(id string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.windows[id]; !ok {
+		return false, nil
+	}
+	delete(m.windows, id)
+	return true, m.save()
+}
+
+// List return all the windows not yet expired, static ones first
+func (m *MaintenanceStore) List() []Window {
+	now := time.Now()
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	windows := make([]Window, 0, len(m.static)+len(m.windows))
+	for _, w := range m.static {
+		windows = append(windows, *w)
+	}
+	dynamic := make([]Window, 0, len(m.windows))
+	for _, w := range m.windows {
+		if !w.Expired(now) {
+			dynamic = append(dynamic, *w)
+		}
+	}
+	sort.Slice(dynamic, func(i, j int) bool { return dynamic[i].ID < dynamic[j].ID })
+	return append(windows, dynamic...)
+}
+
+// Active return the first window in effect for a target, nil if the target
+// is not under maintenance
+func (m *MaintenanceStore) Active(target Target, now time.Time) *Window {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for _, w := range m.static {
+		if w.Applies(target) && w.Active(now) {
+			return w
+		}
+	}
+	for _, w := range m.windows {
+		if w.Applies(target) && w.Active(now) {
+			return w
+		}
+	}
+	return nil
+}
+
+// save persist the windows created through the API and not yet expired,
+// must be called holding the lock
+func (m *MaintenanceStore) save() error {
+	now := time.Now()
+	windows := make([]*Window, 0, len(m.windows))
+	for id, w := range m.windows {
+		if w.Expired(now) {
+			delete(m.windows, id)
+			continue
+		}
+		windows = append(windows, w)
+	}
+	return SaveJSONFile(m.path, windows)
+}
+
+// maintenanceEndpoint is the HTTP route to manage maintenance windows:
+//
+// - GET /maintenance list the windows not yet expired
+// - POST /maintenance create a new window from a JSON body
+// - DELETE /maintenance/<id> remove a window created through the API
+func maintenanceEndpoint(store *MaintenanceStore) http.HandlerFunc {
+	return CollectionEndpoint("/maintenance", Collection{
+		Name:    "window",
+		Invalid: ErrInvalidWindow,
+		List:    func(url.Values) interface{} { return store.List() },
+		New:     func() interface{} { return &Window{} },
+		Add:     func(w interface{}) (string, error) { return store.Add(w.(*Window)) },
+		Delete:  store.Delete,
+	})
+}
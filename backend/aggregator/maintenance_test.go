@@ -0,0 +1,120 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package aggregator
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+func TestWindowOneOff(t *testing.T) {
+	start := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	w := Window{Name: "deploy", Selector: Selector{Targets: []URL{"http://a"}},
+		StartsAt: start, EndsAt: start.Add(time.Hour)}
+	if err := w.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if w.Active(start.Add(-time.Second)) || !w.Active(start) ||
+		!w.Active(start.Add(59*time.Minute)) || w.Active(start.Add(time.Hour)) {
+		t.Errorf("one-off window failed: unexpected activity around %v\n", start)
+	}
+}
+
+func TestWindowRecurring(t *testing.T) {
+	// Every day at 02:00 for 30 minutes
+	w := Window{Name: "nightly", Selector: Selector{Tags: []string{"db"}}, Cron: "0 2 * * *",
+		Duration: 30 * time.Minute}
+	if err := w.validate(); err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2020, 10, 1, 0, 0, 0, 0, time.Local)
+	cases := map[time.Duration]bool{
+		time.Hour:                      false,
+		2 * time.Hour:                  true,
+		2*time.Hour + 29*time.Minute:   true,
+		2*time.Hour + 30*time.Minute:   false,
+		24*time.Hour + 2*time.Hour + 1: true,
+		24*time.Hour + 3*time.Hour:     false,
+	}
+	for offset, expected := range cases {
+		if w.Active(day.Add(offset)) != expected {
+			t.Errorf("recurring window failed: expected %v at %v\n", expected, day.Add(offset))
+		}
+	}
+	if !w.Applies(Target{Url: "http://b", Tags: []string{"db"}}) ||
+		w.Applies(Target{Url: "http://c", Tags: []string{"web"}}) {
+		t.Errorf("recurring window failed: unexpected target selection\n")
+	}
+}
+
+func TestWindowInvalid(t *testing.T) {
+	windows := []Window{
+		{Name: "no targets", Cron: "0 2 * * *", Duration: time.Hour},
+		{Name: "bad cron", Selector: Selector{Tags: []string{"db"}}, Cron: "0 2 *", Duration: time.Hour},
+		{Name: "no duration", Selector: Selector{Tags: []string{"db"}}, Cron: "0 2 * * *"},
+		{Name: "empty range", Selector: Selector{Tags: []string{"db"}}},
+	}
+	for _, w := range windows {
+		if err := w.validate(); err == nil {
+			t.Errorf("validate failed: expected error for %s\n", w.Name)
+		}
+	}
+}
+
+func TestMaintenanceStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maintenance.json")
+	static := []Window{{Name: "nightly", Selector: Selector{Tags: []string{"db"}},
+		Cron: "0 2 * * *", Duration: time.Hour}}
+	store, err := NewMaintenanceStore(static, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var w Window
+	body := `{"name":"deploy","targets":["http://a"],"cron":"*/5 * * * *","duration":"1m"}`
+	if err := json.Unmarshal([]byte(body), &w); err != nil {
+		t.Fatal(err)
+	}
+	id, err := store.Add(&w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewMaintenanceStore(static, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	windows := reloaded.List()
+	if len(windows) != 2 || windows[1].ID != id || windows[1].Duration != time.Minute {
+		t.Errorf("persistence failed: expected static and %s got %v\n", id, windows)
+	}
+	if found, _ := reloaded.Delete("nightly"); found {
+		t.Errorf("delete failed: static windows can't be deleted\n")
+	}
+}
@@ -28,7 +28,11 @@
 // aggregations and analysis of incoming server statistics
 package aggregator
 
-import "time"
+import (
+	"math"
+	"sort"
+	"time"
+)
 
 type MovingAverage struct {
 	Size  int
@@ -82,3 +86,21 @@ func (ma *MovingAverage) Min() time.Duration {
 	}
 	return min
 }
+
+// Percentile return the nearest-rank p-th percentile of the items in the
+// window, with p expressed in the (0, 100] range
+func (ma *MovingAverage) Percentile(p float64) time.Duration {
+	if len(ma.items) == 0 {
+		return 0.0
+	}
+	sorted := make([]time.Duration, len(ma.items))
+	copy(sorted, ma.items)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	} else if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
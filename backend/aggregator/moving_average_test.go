@@ -91,3 +91,18 @@ func TestMovingAverageMin(t *testing.T) {
 		t.Errorf("min failed: expected 46.2 got %v\n", min)
 	}
 }
+
+func TestMovingAveragePercentile(t *testing.T) {
+	ma := MovingAverage{10, []time.Duration{}}
+	for i := 1; i <= 10; i++ {
+		ma.Put(time.Duration(i) * time.Millisecond)
+	}
+	p95 := ma.Percentile(95)
+	if p95 != 10*time.Millisecond {
+		t.Errorf("percentile failed: expected 10ms got %v\n", p95)
+	}
+	p50 := ma.Percentile(50)
+	if p50 != 5*time.Millisecond {
+		t.Errorf("percentile failed: expected 5ms got %v\n", p50)
+	}
+}
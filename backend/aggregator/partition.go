@@ -0,0 +1,295 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package aggregator
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+	"github.com/codepr/overseer/internal/messaging"
+)
+
+// PartitionConfig enables the partitioning of the status stream across a
+// pool of aggregators. Agents publish each status to one of `Partitions`
+// queues by the hash of its URL and every aggregator consumes only the
+// partitions it owns, spread over a consistent hash ring of the aggregators
+// announcing themselves on `Topic` once every `Heartbeat`. When the
+// ownership of a partition changes, the previous owner hands the state of
+// its URLs off to the new one, which waits for it up to `HandoffTimeout`
+// before consuming the partition, unless nobody owned it before.
+type PartitionConfig struct {
+	Partitions     int           `yaml:"partitions,omitempty"`
+	Topic          string        `yaml:"topic,omitempty"`
+	Heartbeat      time.Duration `yaml:"heartbeat,omitempty"`
+	HandoffTimeout time.Duration `yaml:"handoff_timeout,omitempty"`
+}
+
+// DefaultPartitionConfig return a disabled partitioning configuration with
+// sensible defaults
+func DefaultPartitionConfig() PartitionConfig {
+	return PartitionConfig{
+		Topic:          "aggregators",
+		Heartbeat:      2 * time.Second,
+		HandoffTimeout: 10 * time.Second,
+	}
+}
+
+// release is a request to hand off a partition, `done` is closed once the
+// state has been published
+type release struct {
+	partition int
+	done      chan struct{}
+}
+
+// claim is a partition being consumed, `done` is closed once its consumers
+// returned and the deliveries handed out have been settled
+type claim struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// stop cancel the consumption of the partition and wait for it to be over,
+// so that no event of the partition is aggregated after it's handed off
+func (c claim) stop() {
+	c.cancel()
+	<-c.done
+}
+
+// handoffQueue return the name of the queue carrying the handoffs of a
+// partition of the status queue
+func handoffQueue(queue string, partition int) string {
+	return PartitionQueue(queue, partition) + ".handoff"
+}
+
+// statusBindings return the keys binding the status queue, or each of its
+// partitions, to the exchange, the keys binding a partition match only the
+// routing keys ending with it
+func statusBindings(queue string, keys []string, partitions int) map[string][]string {
+	if partitions <= 0 {
+		return map[string][]string{queue: keys}
+	}
+	bindings := make(map[string][]string, partitions)
+	for p := 0; p < partitions; p++ {
+		partition := PartitionQueue(queue, p)
+		for _, key := range keys {
+			bindings[partition] = append(bindings[partition], PartitionQueue(key, p))
+		}
+	}
+	return bindings
+}
+
+// handOff publish the state of the URLs of a partition to its handoff queue
+// for the aggregator taking it over
+func (a *Aggregator) handOff(ctx context.Context, partition int) {
+	handoffs := a.release(partition)
+	for _, h := range handoffs {
+		msg, err := messaging.Encode(a.codec, a.name, h)
+		if err != nil {
+			a.logger.Println("Unable to marshal handoff")
+			continue
+		}
+		if err := a.mq.Produce(ctx, handoffQueue(a.queue, partition), msg); err != nil {
+			a.logger.Println("Error producing handoff to queue")
+		}
+	}
+	a.logger.Printf("Partition %d handed off, %d servers\n", partition, len(handoffs)-1)
+}
+
+// runPartitions join the pool of aggregators and consume the partitions
+// owned, rebalancing them as aggregators join or leave the pool, until a
+// leave request is received. Status events are forwarded to `events`,
+// handoffs received to `handoffs` and partitions lost to `releases`, once
+// their consumers are stopped.
+func (a *Aggregator) runPartitions(ctx context.Context, events chan<- messaging.Delivery,
+	handoffs chan<- handoff, releases chan<- release, leave <-chan chan struct{}) {
+	broadcaster, ok := a.mq.(messaging.Broadcaster)
+	if !ok {
+		a.logger.Fatal("Partitioning not supported by the message queue")
+	}
+	members := NewMembership(a.name, "", a.partitioning.Heartbeat, time.Now())
+	members.Join(ctx, broadcaster, a.partitioning.Topic, a.partitioning.Heartbeat, a.logger)
+	owned := make(map[int]claim)
+	// The ring the partitions were last balanced on, on joining the pool
+	// it's the ring of the peers, the aggregators owning the partitions
+	var previous *HashRing
+	// hand a partition off, waiting for its state to be published
+	handOff := func(partition int) {
+		owned[partition].stop()
+		delete(owned, partition)
+		done := make(chan struct{})
+		releases <- release{partition, done}
+		<-done
+	}
+	// claim the partitions owned on a ring and hand off the ones lost
+	rebalance := func(ring *HashRing) {
+		if previous == nil {
+			peers := make([]string, 0, len(ring.Members()))
+			for _, member := range ring.Members() {
+				if member != a.name {
+					peers = append(peers, member)
+				}
+			}
+			previous = NewHashRing(DefaultReplicas, peers...)
+		}
+		for p := 0; p < a.partitioning.Partitions; p++ {
+			key := strconv.Itoa(p)
+			_, owning := owned[p]
+			mine := members.Owns(ring, key)
+			if owning && !mine {
+				handOff(p)
+			} else if mine && !owning {
+				// A partition nobody owned has no state to wait for
+				handedOff := previous.Owner(key) != ""
+				owned[p] = a.claimPartition(ctx, p, handedOff, events, handoffs)
+			}
+		}
+		previous = ring
+		a.logger.Printf("Partitions rebalanced, owning %v of %d\n",
+			ownedPartitions(owned), a.partitioning.Partitions)
+	}
+	ticker := time.NewTicker(a.partitioning.Heartbeat)
+	defer ticker.Stop()
+	for {
+		// Consuming a partition owned by another aggregator would split its
+		// state, don't claim any until the warm-up ends
+		if now := time.Now(); !members.WarmingUp(now) {
+			if ring, rebuilt := members.Ring(now); rebuilt {
+				rebalance(ring)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case ack := <-leave:
+			// Leaving the pool, hand off every partition owned
+			if err := members.Leave(ctx, broadcaster, a.partitioning.Topic); err != nil {
+				a.logger.Println("Error publishing leave heartbeat")
+			}
+			for p := range owned {
+				handOff(p)
+			}
+			close(ack)
+			<-ctx.Done()
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// claimPartition start consuming a partition until the returned claim is
+// stopped or the context cancelled
+func (a *Aggregator) claimPartition(ctx context.Context, partition int, handedOff bool,
+	events chan<- messaging.Delivery, handoffs chan<- handoff) claim {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.consumePartition(ctx, partition, handedOff, events, handoffs)
+	}()
+	return claim{cancel, done}
+}
+
+// consumePartition consume the status events of a partition until the
+// context is cancelled, after having waited for its state to be handed off
+// by the previous owner if `handedOff` is set. It returns once every
+// consumer of the partition has returned.
+func (a *Aggregator) consumePartition(ctx context.Context, partition int, handedOff bool,
+	events chan<- messaging.Delivery, handoffs chan<- handoff) {
+	var consumers sync.WaitGroup
+	defer consumers.Wait()
+	payloads := make(chan messaging.Delivery)
+	consumers.Add(2)
+	go func() {
+		defer consumers.Done()
+		if err := a.mq.Consume(ctx, handoffQueue(a.queue, partition), 1, payloads); err != nil {
+			a.logger.Println("Error consuming handoffs:", err)
+		}
+	}()
+	// Forward every handoff received, signaling the end of the handoff of
+	// the partition, late handoffs are forwarded as well while the partition
+	// is owned and delivered again to the next owner otherwise
+	done := make(chan struct{})
+	go func() {
+		defer consumers.Done()
+		received := false
+		for {
+			select {
+			case payload := <-payloads:
+				var h handoff
+				if err := payload.Decode(&h); err != nil {
+					a.logger.Println("Error decoding handoff")
+					payload.Nack(false, err)
+					continue
+				}
+				if h.Done {
+					payload.Ack()
+					if !received {
+						received = true
+						close(done)
+					}
+					continue
+				}
+				select {
+				case handoffs <- h:
+					payload.Ack()
+				case <-ctx.Done():
+					payload.Nack(true, ctx.Err())
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	if handedOff {
+		select {
+		case <-done:
+		case <-time.After(a.partitioning.HandoffTimeout):
+			a.logger.Printf("No handoff received for partition %d\n", partition)
+		case <-ctx.Done():
+			return
+		}
+	}
+	err := a.mq.Consume(ctx, PartitionQueue(a.queue, partition), 1, events)
+	if err != nil {
+		a.logger.Println("Error consuming partition:", err)
+	}
+}
+
+// ownedPartitions return the sorted list of the partitions owned
+func ownedPartitions(owned map[int]claim) []int {
+	partitions := make([]int, 0, len(owned))
+	for p := range owned {
+		partitions = append(partitions, p)
+	}
+	sort.Ints(partitions)
+	return partitions
+}
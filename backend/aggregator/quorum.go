@@ -0,0 +1,78 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package aggregator
+
+import (
+	"sort"
+	"time"
+)
+
+// QuorumConfig defines how many agents must agree a server is down for it
+// to be declared down, only agents which reported within `Window` are taken
+// into account. A zero `Agents` disables the quorum, each probe result is
+// then taken as is.
+type QuorumConfig struct {
+	Agents int           `yaml:"agents,omitempty"`
+	Window time.Duration `yaml:"window,omitempty"`
+}
+
+// verdict is the outcome of a quorum evaluation, the agents seeing the
+// server down and the suspected outlier, if any. A verdict is unknown when
+// fewer than `Agents` agents reported within the window.
+type verdict struct {
+	down    bool
+	unknown bool
+	failing []string
+	outlier string
+}
+
+// quorum evaluate the state of a server across the agents probing it, the
+// server is down if at least `Agents` of the agents reporting within the
+// window see it down; with fewer agents reporting no verdict can be reached
+// and the state of the server is unknown. A single agent seeing the server
+// down while the others don't is flagged as outlier, pointing to a problem
+// with the agent rather than the server.
+func (c QuorumConfig) quorum(locations map[string]*serverStats, now time.Time) verdict {
+	var v verdict
+	active := 0
+	for name, l := range locations {
+		if now.Sub(l.lastSeen) > c.Window {
+			continue
+		}
+		active++
+		if !l.Alive {
+			v.failing = append(v.failing, name)
+		}
+	}
+	sort.Strings(v.failing)
+	v.unknown = active < c.Agents
+	v.down = !v.unknown && len(v.failing) >= c.Agents
+	if !v.down && len(v.failing) == 1 && active > 1 {
+		v.outlier = v.failing[0]
+	}
+	return v
+}
@@ -0,0 +1,201 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package aggregator
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+// SLOConfig declares a service level objective like "99.9% of probes
+// succeed under 300ms over 30 days", applied to each of the listed targets
+// and to every target tagged with one of the listed tags. A probe counts as
+// good if successful and, when `Latency` is set, faster than it. Burn rates
+// are tracked over each of `BurnWindows`.
+type SLOConfig struct {
+	Name        string          `yaml:"name"`
+	Objective   float64         `yaml:"objective"`
+	Latency     time.Duration   `yaml:"latency,omitempty"`
+	Window      time.Duration   `yaml:"window,omitempty"`
+	BurnWindows []time.Duration `yaml:"burn_windows,omitempty"`
+	Selector    `yaml:",inline"`
+}
+
+// validate check the SLO definition, setting defaults for the optional
+// fields
+func (c *SLOConfig) validate() error {
+	if c.Objective <= 0 || c.Objective >= 100 {
+		return fmt.Errorf("slo %s: objective must be in the (0, 100) range", c.Name)
+	}
+	if c.Empty() {
+		return fmt.Errorf("slo %s: no targets nor tags", c.Name)
+	}
+	if c.Window == 0 {
+		c.Window = 30 * 24 * time.Hour
+	}
+	if len(c.BurnWindows) == 0 {
+		c.BurnWindows = []time.Duration{5 * time.Minute, time.Hour, 6 * time.Hour}
+	}
+	return nil
+}
+
+// bucket counts good and total probes received in a time slot
+type bucket struct {
+	start       time.Time
+	good, total int
+}
+
+// series is a sequence of time ordered buckets with a fixed resolution,
+// covering at most `span`
+type series struct {
+	resolution time.Duration
+	span       time.Duration
+	buckets    []bucket
+}
+
+// add count a probe in the bucket of its time slot, evicting buckets out of
+// the span
+func (s *series) add(at time.Time, good bool) {
+	start := at.Truncate(s.resolution)
+	n := len(s.buckets)
+	if n == 0 || s.buckets[n-1].start.Before(start) {
+		s.buckets = append(s.buckets, bucket{start: start})
+		n++
+	}
+	s.buckets[n-1].total++
+	if good {
+		s.buckets[n-1].good++
+	}
+	i := 0
+	for i < len(s.buckets) && at.Sub(s.buckets[i].start) > s.span {
+		i++
+	}
+	s.buckets = s.buckets[i:]
+}
+
+// sum return the good and total probes counted since a given time
+func (s *series) sum(since time.Time) (int, int) {
+	good, total := 0, 0
+	for i := len(s.buckets) - 1; i >= 0 && !s.buckets[i].start.Before(since); i-- {
+		good += s.buckets[i].good
+		total += s.buckets[i].total
+	}
+	return good, total
+}
+
+// sloTracker tracks the probes of a server against an SLO. To bound memory
+// on long SLO windows, two series are kept: a fine grained one covering
+// the burn rate windows and a coarse one covering the whole SLO window.
+type sloTracker struct {
+	config *SLOConfig
+	fine   series
+	coarse series
+}
+
+func newSLOTracker(config *SLOConfig) *sloTracker {
+	fineSpan := 6 * time.Hour
+	for _, w := range config.BurnWindows {
+		if w > fineSpan {
+			fineSpan = w
+		}
+	}
+	return &sloTracker{
+		config: config,
+		fine:   series{resolution: time.Minute, span: fineSpan},
+		coarse: series{resolution: time.Hour, span: config.Window},
+	}
+}
+
+// observe count a probe, good if successful within the latency threshold
+func (t *sloTracker) observe(at time.Time, ok bool, latency time.Duration) {
+	good := ok && (t.config.Latency == 0 || latency <= t.config.Latency)
+	t.fine.add(at, good)
+	t.coarse.add(at, good)
+}
+
+// errorRatio return the ratio of bad probes over a window, false if there
+// are no probes in the window
+func (t *sloTracker) errorRatio(window time.Duration, now time.Time) (float64, bool) {
+	s := &t.coarse
+	if window <= t.fine.span {
+		s = &t.fine
+	}
+	good, total := s.sum(now.Add(-window))
+	if total == 0 {
+		return 0.0, false
+	}
+	return float64(total-good) / float64(total), true
+}
+
+// budget return the error budget as a ratio, e.g. 0.001 for a 99.9% SLO
+func (t *sloTracker) budget() float64 {
+	return 1 - t.config.Objective/100
+}
+
+// burnRate return the rate the error budget is being consumed at over a
+// window
+func (t *sloTracker) burnRate(window time.Duration, now time.Time) (float64, bool) {
+	ratio, ok := t.errorRatio(window, now)
+	if !ok {
+		return 0.0, false
+	}
+	return ratio / t.budget(), true
+}
+
+// budgetRemaining return the percentage of error budget left over the SLO
+// window
+func (t *sloTracker) budgetRemaining(now time.Time) (float64, bool) {
+	ratio, ok := t.errorRatio(t.config.Window, now)
+	if !ok {
+		return 0.0, false
+	}
+	return (1 - ratio/t.budget()) * 100, true
+}
+
+// status return the current `SLOStatus`
+func (t *sloTracker) status(now time.Time) SLOStatus {
+	status := SLOStatus{
+		Name:                 t.config.Name,
+		Objective:            t.config.Objective,
+		Attainment:           100.0,
+		ErrorBudgetRemaining: 100.0,
+		BurnRates:            make(map[string]float64, len(t.config.BurnWindows)),
+	}
+	if ratio, ok := t.errorRatio(t.config.Window, now); ok {
+		status.Attainment = (1 - ratio) * 100
+	}
+	if remaining, ok := t.budgetRemaining(now); ok {
+		status.ErrorBudgetRemaining = remaining
+	}
+	for _, w := range t.config.BurnWindows {
+		rate, _ := t.burnRate(w, now)
+		status.BurnRates[w.String()] = rate
+	}
+	return status
+}
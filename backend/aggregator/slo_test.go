@@ -0,0 +1,112 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package aggregator
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+func TestSLOTracker(t *testing.T) {
+	config := &SLOConfig{Name: "availability", Selector: Selector{Tags: []string{"web"}},
+		Objective: 99.0, Latency: 300 * time.Millisecond}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	tracker := newSLOTracker(config)
+	now := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	// 2 days ago: 1000 good probes
+	for i := 0; i < 1000; i++ {
+		tracker.observe(now.Add(-48*time.Hour), true, 100*time.Millisecond)
+	}
+	// Last 5 minutes: 90 good, 5 failed and 5 too slow probes
+	for i := 0; i < 100; i++ {
+		ok, latency := true, 100*time.Millisecond
+		if i < 5 {
+			ok = false
+		} else if i < 10 {
+			latency = time.Second
+		}
+		tracker.observe(now.Add(-time.Minute), ok, latency)
+	}
+	status := tracker.status(now)
+	if math.Abs(status.Attainment-(1090.0/1100.0*100)) > tolerance {
+		t.Errorf("slo failed: expected attainment 99.09 got %v\n", status.Attainment)
+	}
+	// 10 errors over 1100 probes with a budget of 11 errors
+	if math.Abs(status.ErrorBudgetRemaining-(1-(10.0/1100.0)/0.01)*100) > tolerance {
+		t.Errorf("slo failed: expected budget 9.09 got %v\n", status.ErrorBudgetRemaining)
+	}
+	// 10% error ratio over the short windows is a 10x burn rate
+	if math.Abs(status.BurnRates["5m0s"]-10.0) > tolerance ||
+		math.Abs(status.BurnRates["1h0m0s"]-10.0) > tolerance {
+		t.Errorf("slo failed: expected 10x burn rates got %v\n", status.BurnRates)
+	}
+	// The long window falls back to the coarse series
+	if rate, _ := tracker.burnRate(72*time.Hour, now); math.Abs(rate-(10.0/1100.0)/0.01) > tolerance {
+		t.Errorf("slo failed: expected 0.91 burn rate over 72h got %v\n", rate)
+	}
+}
+
+func TestSeriesEviction(t *testing.T) {
+	s := series{resolution: time.Minute, span: 10 * time.Minute}
+	now := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 30; i++ {
+		s.add(now.Add(time.Duration(i)*time.Minute), true)
+	}
+	if len(s.buckets) != 11 {
+		t.Errorf("series failed: expected 11 buckets got %d\n", len(s.buckets))
+	}
+}
+
+func TestServerStatsEvaluationTime(t *testing.T) {
+	config := &SLOConfig{Name: "availability", Selector: Selector{Tags: []string{"web"}},
+		Objective: 99.0}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	tracker := newSLOTracker(config)
+	now := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		tracker.observe(now.Add(-time.Minute), i > 0, 0)
+	}
+	s := &serverStats{slos: []*sloTracker{tracker}}
+	// Evaluated right after the probes the failure is within the 5m window,
+	// evaluated an hour later the window is empty, regardless of the clock
+	if rate, ok := s.BurnRate("availability", 5*time.Minute, now); !ok || math.Abs(rate-10.0) > tolerance {
+		t.Errorf("serverStats failed: expected 10x burn rate got %v\n", rate)
+	}
+	if _, ok := s.BurnRate("availability", 5*time.Minute, now.Add(time.Hour)); ok {
+		t.Errorf("serverStats failed: expected no burn rate after the window\n")
+	}
+	if budget, ok := s.ErrorBudgetRemaining("availability", now); !ok || budget >= 0 {
+		t.Errorf("serverStats failed: expected an exhausted budget got %v\n", budget)
+	}
+}
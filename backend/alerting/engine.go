@@ -0,0 +1,152 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package alerting
+
+import (
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+// Engine evaluates a set of rules against targets, tracking the active
+// alerts for each rule and target pair, returning state changes as `Alert`
+// events
+type Engine struct {
+	rules  []*Rule
+	alerts map[string]*Alert
+}
+
+// NewEngine create a new `Engine` for a given set of rules
+func NewEngine(rules []*Rule) *Engine {
+	return &Engine{
+		rules:  rules,
+		alerts: make(map[string]*Alert),
+	}
+}
+
+// NewEngineFromConfig create a new `Engine` from a list of rule
+// configurations
+func NewEngineFromConfig(configs []RuleConfig) (*Engine, error) {
+	rules := make([]*Rule, 0, len(configs))
+	for _, c := range configs {
+		rule, err := NewRule(c)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return NewEngine(rules), nil
+}
+
+// Retention return the longest history span required by the registered
+// rules
+func (e *Engine) Retention() time.Duration {
+	var retention time.Duration
+	for _, r := range e.rules {
+		if w := r.Window(); w > retention {
+			retention = w
+		}
+	}
+	return retention
+}
+
+// Evaluate run every rule against the target, returning the alerts that
+// changed state:
+//
+//   - inactive -> pending when the condition is first met
+//   - pending -> firing when the condition holds for the rule `For` duration,
+//     a rule without duration fires right away
+//   - firing -> resolved when the condition is no more met
+//
+// A pending alert which condition stops being true is just dropped.
+func (e *Engine) Evaluate(t TargetState, now time.Time) []Alert {
+	var changes []Alert
+	for _, rule := range e.rules {
+		key := rule.Name + "/" + t.URL()
+		active, found := e.alerts[key]
+		faulty, summary := rule.Condition.Eval(t, now)
+		if !faulty {
+			if found {
+				delete(e.alerts, key)
+				if active.State == AlertFiring {
+					active.State = AlertResolved
+					active.EndsAt = now
+					changes = append(changes, *active)
+				}
+			}
+			continue
+		}
+		if !found {
+			active = &Alert{
+				Name:     rule.Name,
+				Url:      t.URL(),
+				State:    AlertPending,
+				Severity: rule.Severity,
+				Labels:   rule.Labels,
+				Tags:     append([]string(nil), t.Tags()...),
+				StartsAt: now,
+			}
+			e.alerts[key] = active
+			if rule.For > 0 {
+				active.Summary = summary
+				changes = append(changes, *active)
+				continue
+			}
+		}
+		active.Summary = summary
+		if active.State == AlertPending && now.Sub(active.StartsAt) >= rule.For {
+			active.State = AlertFiring
+			changes = append(changes, *active)
+		}
+	}
+	return changes
+}
+
+// Release remove and return the active alerts of an URL, to hand them off
+// to another engine taking over the URL
+func (e *Engine) Release(url URL) []Alert {
+	var alerts []Alert
+	for key, alert := range e.alerts {
+		if alert.Url == url {
+			alerts = append(alerts, *alert)
+			delete(e.alerts, key)
+		}
+	}
+	return alerts
+}
+
+// Adopt register the active alerts handed off by another engine, alerts
+// already tracked are left untouched
+func (e *Engine) Adopt(alerts []Alert) {
+	for i := range alerts {
+		key := alerts[i].Name + "/" + alerts[i].Url
+		if _, found := e.alerts[key]; !found {
+			alert := alerts[i]
+			e.alerts[key] = &alert
+		}
+	}
+}
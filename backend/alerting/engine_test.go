@@ -0,0 +1,162 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package alerting
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+type fakeTarget struct {
+	failures     int
+	availability float64
+	p95          time.Duration
+	certExpiry   time.Time
+	flapping     bool
+	burnRate     float64
+	budget       float64
+	tags         []string
+}
+
+func (f *fakeTarget) URL() URL                         { return "http://localhost" }
+func (f *fakeTarget) Tags() []string                   { return f.tags }
+func (f *fakeTarget) ConsecutiveFailures() int         { return f.failures }
+func (f *fakeTarget) Percentile(float64) time.Duration { return f.p95 }
+func (f *fakeTarget) CertExpiry() time.Time            { return f.certExpiry }
+func (f *fakeTarget) Flapping() bool                   { return f.flapping }
+func (f *fakeTarget) BurnRate(string, time.Duration, time.Time) (float64, bool) {
+	return f.burnRate, true
+}
+func (f *fakeTarget) ErrorBudgetRemaining(string, time.Time) (float64, bool) {
+	return f.budget, true
+}
+func (f *fakeTarget) AvailabilitySince(time.Time) (float64, bool) {
+	return f.availability, true
+}
+
+func TestEngineLifecycle(t *testing.T) {
+	rule, err := NewRule(RuleConfig{
+		Name:      "TargetDown",
+		Condition: NotAlive,
+		Probes:    2,
+		For:       time.Minute,
+		Severity:  "critical",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := NewEngine([]*Rule{rule})
+	target := &fakeTarget{failures: 1, tags: []string{"web"}}
+	now := time.Now()
+	if changes := engine.Evaluate(target, now); len(changes) != 0 {
+		t.Errorf("evaluate failed: expected no changes got %v\n", changes)
+	}
+	target.failures = 2
+	changes := engine.Evaluate(target, now)
+	if len(changes) != 1 || changes[0].State != AlertPending {
+		t.Errorf("evaluate failed: expected pending got %v\n", changes)
+	}
+	if changes := engine.Evaluate(target, now.Add(30*time.Second)); len(changes) != 0 {
+		t.Errorf("evaluate failed: expected no changes got %v\n", changes)
+	}
+	changes = engine.Evaluate(target, now.Add(time.Minute))
+	if len(changes) != 1 || changes[0].State != AlertFiring {
+		t.Errorf("evaluate failed: expected firing got %v\n", changes)
+	}
+	if len(changes) == 1 && !reflect.DeepEqual(changes[0].Tags, target.tags) {
+		t.Errorf("evaluate failed: expected tags %v got %v\n", target.tags, changes[0].Tags)
+	}
+	target.failures = 0
+	changes = engine.Evaluate(target, now.Add(2*time.Minute))
+	if len(changes) != 1 || changes[0].State != AlertResolved {
+		t.Errorf("evaluate failed: expected resolved got %v\n", changes)
+	}
+	if changes[0].EndsAt != now.Add(2*time.Minute) {
+		t.Errorf("evaluate failed: expected ends_at set got %v\n", changes[0].EndsAt)
+	}
+}
+
+func TestEnginePendingDropped(t *testing.T) {
+	rule, _ := NewRule(RuleConfig{
+		Name:      "LowAvailability",
+		Condition: AvailabilityBelow,
+		Threshold: 99.0,
+		For:       time.Minute,
+	})
+	engine := NewEngine([]*Rule{rule})
+	target := &fakeTarget{availability: 90.0}
+	now := time.Now()
+	engine.Evaluate(target, now)
+	target.availability = 100.0
+	if changes := engine.Evaluate(target, now.Add(time.Second)); len(changes) != 0 {
+		t.Errorf("evaluate failed: expected no changes got %v\n", changes)
+	}
+}
+
+func TestEngineConditions(t *testing.T) {
+	now := time.Now()
+	configs := []RuleConfig{
+		{Name: "down", Condition: NotAlive, Probes: 3},
+		{Name: "avail", Condition: AvailabilityBelow, Threshold: 99.0},
+		{Name: "slow", Condition: LatencyAbove, Latency: 300 * time.Millisecond},
+		{Name: "cert", Condition: CertExpiresWithin, Days: 7},
+		{Name: "flapping", Condition: Flapping},
+		{Name: "burn", Condition: SLOBurnRate, SLO: "availability", Threshold: 14.4},
+		{Name: "budget", Condition: ErrorBudgetBelow, SLO: "availability", Threshold: 10},
+	}
+	engine, err := NewEngineFromConfig(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &fakeTarget{
+		failures:     3,
+		availability: 98.0,
+		p95:          400 * time.Millisecond,
+		certExpiry:   now.Add(48 * time.Hour),
+		flapping:     true,
+		burnRate:     20.0,
+		budget:       5.0,
+	}
+	changes := engine.Evaluate(target, now)
+	if len(changes) != len(configs) {
+		t.Fatalf("evaluate failed: expected %d alerts got %d\n", len(configs), len(changes))
+	}
+	for i, alert := range changes {
+		if alert.Name != configs[i].Name || alert.State != AlertFiring {
+			t.Errorf("evaluate failed: expected %s firing got %v\n", configs[i].Name, alert)
+		}
+	}
+}
+
+func TestNewRuleUnknownCondition(t *testing.T) {
+	if _, err := NewRule(RuleConfig{Name: "x", Condition: "foo"}); err == nil {
+		t.Errorf("new rule failed: expected error got nil\n")
+	}
+}
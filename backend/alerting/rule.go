@@ -0,0 +1,295 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package alerting contains the rules engine evaluated by the aggregator on
+// each aggregation, tracking the state of every alert through its lifecycle
+package alerting
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+// ErrUnknownCondition is returned when a rule declares an unsupported
+// condition type
+var ErrUnknownCondition = errors.New("unknown alerting rule condition")
+
+// Supported condition types
+const (
+	NotAlive          = "not_alive"
+	AvailabilityBelow = "availability_below"
+	LatencyAbove      = "latency_above"
+	CertExpiresWithin = "cert_expires_within"
+	Flapping          = "flapping"
+	SLOBurnRate       = "slo_burn_rate"
+	ErrorBudgetBelow  = "error_budget_below"
+)
+
+// TargetState defines the view of a monitored server the rules are evaluated
+// against, it's expected to be implemented by the aggregation state of each
+// URL
+type TargetState interface {
+	URL() URL
+	// Tags return the tags of the target, copied into the alerts
+	Tags() []string
+	// ConsecutiveFailures return the number of failed probes in a row
+	ConsecutiveFailures() int
+	// AvailabilitySince return the percentage of successful probes received
+	// after a given time, false if no probes were received at all
+	AvailabilitySince(time.Time) (float64, bool)
+	// Percentile return the p-th percentile of the latest response times
+	Percentile(float64) time.Duration
+	// CertExpiry return the expiration of the TLS certificate, zero value
+	// if the target is not served over TLS
+	CertExpiry() time.Time
+	// Flapping return true if the target is changing state too frequently
+	Flapping() bool
+	// BurnRate return the error budget burn rate of an SLO over a window
+	// ending at a given time, false if the SLO is not tracked for the
+	// target or has no probes
+	BurnRate(string, time.Duration, time.Time) (float64, bool)
+	// ErrorBudgetRemaining return the percentage of error budget left of
+	// an SLO at a given time, false if the SLO is not tracked for the target
+	ErrorBudgetRemaining(string, time.Time) (float64, bool)
+}
+
+// Condition is a predicate over a `TargetState`, returning true with a brief
+// human readable summary when the target is in a faulty state
+type Condition interface {
+	Eval(TargetState, time.Time) (bool, string)
+}
+
+// RuleConfig is the user defined settings container for a rule, as read
+// from the yaml configuration, fields used depend on the condition type:
+//
+//   - not_alive: `probes`
+//   - availability_below: `threshold` and `window`
+//   - latency_above: `percentile` and `latency`
+//   - cert_expires_within: `days`
+//   - flapping: no fields
+//   - slo_burn_rate: `slo`, `threshold` and `windows`, satisfied when the
+//     burn rate is above the threshold over all the windows
+//   - error_budget_below: `slo` and `threshold` as a percentage
+type RuleConfig struct {
+	Name       string            `yaml:"name"`
+	Condition  string            `yaml:"condition"`
+	Probes     int               `yaml:"probes,omitempty"`
+	Threshold  float64           `yaml:"threshold,omitempty"`
+	Window     time.Duration     `yaml:"window,omitempty"`
+	Percentile float64           `yaml:"percentile,omitempty"`
+	Latency    time.Duration     `yaml:"latency,omitempty"`
+	Days       int               `yaml:"days,omitempty"`
+	SLO        string            `yaml:"slo,omitempty"`
+	Windows    []time.Duration   `yaml:"windows,omitempty"`
+	Severity   string            `yaml:"severity"`
+	For        time.Duration     `yaml:"for,omitempty"`
+	Labels     map[string]string `yaml:"labels,omitempty"`
+}
+
+// Rule is an alerting rule, an alert is raised for each target that
+// satisfy the condition for at least the `For` duration
+type Rule struct {
+	Name      string
+	Condition Condition
+	Severity  string
+	For       time.Duration
+	Labels    map[string]string
+}
+
+// NewRule create a new `Rule` from its configuration, returning an error
+// if the condition is not supported or misconfigured
+func NewRule(c RuleConfig) (*Rule, error) {
+	var cond Condition
+	switch c.Condition {
+	case NotAlive:
+		if c.Probes < 1 {
+			c.Probes = 1
+		}
+		cond = notAlive{c.Probes}
+	case AvailabilityBelow:
+		if c.Window == 0 {
+			c.Window = 10 * time.Minute
+		}
+		cond = availabilityBelow{c.Threshold, c.Window}
+	case LatencyAbove:
+		if c.Percentile == 0 {
+			c.Percentile = 95
+		}
+		if c.Latency <= 0 {
+			return nil, fmt.Errorf("rule %s: latency must be positive", c.Name)
+		}
+		cond = latencyAbove{c.Percentile, c.Latency}
+	case CertExpiresWithin:
+		if c.Days < 1 {
+			return nil, fmt.Errorf("rule %s: days must be positive", c.Name)
+		}
+		cond = certExpiresWithin{c.Days}
+	case Flapping:
+		cond = flapping{}
+	case SLOBurnRate:
+		if c.SLO == "" || c.Threshold <= 0 {
+			return nil, fmt.Errorf("rule %s: slo and threshold required", c.Name)
+		}
+		if len(c.Windows) == 0 {
+			c.Windows = []time.Duration{time.Hour, 5 * time.Minute}
+		}
+		cond = sloBurnRate{c.SLO, c.Threshold, c.Windows}
+	case ErrorBudgetBelow:
+		if c.SLO == "" {
+			return nil, fmt.Errorf("rule %s: slo required", c.Name)
+		}
+		cond = errorBudgetBelow{c.SLO, c.Threshold}
+	default:
+		return nil, fmt.Errorf("rule %s: %w %q", c.Name, ErrUnknownCondition, c.Condition)
+	}
+	if c.Severity == "" {
+		c.Severity = "warning"
+	}
+	return &Rule{
+		Name:      c.Name,
+		Condition: cond,
+		Severity:  c.Severity,
+		For:       c.For,
+		Labels:    c.Labels,
+	}, nil
+}
+
+// Window return the time span of history the rule needs to be evaluated,
+// zero for rules not depending on history
+func (r *Rule) Window() time.Duration {
+	if c, ok := r.Condition.(availabilityBelow); ok {
+		return c.window
+	}
+	return 0
+}
+
+// notAlive is satisfied when the target failed the last N consecutive probes
+type notAlive struct {
+	probes int
+}
+
+func (c notAlive) Eval(t TargetState, _ time.Time) (bool, string) {
+	failures := t.ConsecutiveFailures()
+	return failures >= c.probes,
+		fmt.Sprintf("%s not alive for %d consecutive probes", t.URL(), failures)
+}
+
+// availabilityBelow is satisfied when the availability % over the last
+// `window` falls below the threshold
+type availabilityBelow struct {
+	threshold float64
+	window    time.Duration
+}
+
+func (c availabilityBelow) Eval(t TargetState, now time.Time) (bool, string) {
+	availability, ok := t.AvailabilitySince(now.Add(-c.window))
+	if !ok {
+		return false, ""
+	}
+	return availability < c.threshold,
+		fmt.Sprintf("%s availability %.2f%% over %v below %.2f%%",
+			t.URL(), availability, c.window, c.threshold)
+}
+
+// latencyAbove is satisfied when the p-th percentile of the response times
+// is greater than the latency threshold
+type latencyAbove struct {
+	percentile float64
+	latency    time.Duration
+}
+
+func (c latencyAbove) Eval(t TargetState, _ time.Time) (bool, string) {
+	value := t.Percentile(c.percentile)
+	return value > c.latency,
+		fmt.Sprintf("%s p%v response time %v above %v",
+			t.URL(), c.percentile, value, c.latency)
+}
+
+// certExpiresWithin is satisfied when the TLS certificate of the target
+// expires in less than `days` days
+type certExpiresWithin struct {
+	days int
+}
+
+func (c certExpiresWithin) Eval(t TargetState, now time.Time) (bool, string) {
+	expiry := t.CertExpiry()
+	if expiry.IsZero() {
+		return false, ""
+	}
+	left := expiry.Sub(now)
+	return left < time.Duration(c.days)*24*time.Hour,
+		fmt.Sprintf("%s certificate expires in %v", t.URL(), left.Truncate(time.Hour))
+}
+
+// flapping is satisfied while the target is detected as flapping
+type flapping struct{}
+
+func (c flapping) Eval(t TargetState, _ time.Time) (bool, string) {
+	return t.Flapping(), fmt.Sprintf("%s is flapping", t.URL())
+}
+
+// sloBurnRate is satisfied when the error budget of an SLO is burning
+// faster than the threshold over every window, pairing a long and a short
+// window makes alerts both significant and quick to reset
+type sloBurnRate struct {
+	slo       string
+	threshold float64
+	windows   []time.Duration
+}
+
+func (c sloBurnRate) Eval(t TargetState, now time.Time) (bool, string) {
+	rates := make([]string, len(c.windows))
+	for i, w := range c.windows {
+		rate, ok := t.BurnRate(c.slo, w, now)
+		if !ok || rate <= c.threshold {
+			return false, ""
+		}
+		rates[i] = fmt.Sprintf("%.2f over %v", rate, w)
+	}
+	return true, fmt.Sprintf("%s SLO %s burn rate %s above %.2f",
+		t.URL(), c.slo, strings.Join(rates, ", "), c.threshold)
+}
+
+// errorBudgetBelow is satisfied when the error budget left of an SLO falls
+// below a percentage
+type errorBudgetBelow struct {
+	slo       string
+	threshold float64
+}
+
+func (c errorBudgetBelow) Eval(t TargetState, now time.Time) (bool, string) {
+	remaining, ok := t.ErrorBudgetRemaining(c.slo, now)
+	if !ok {
+		return false, ""
+	}
+	return remaining < c.threshold,
+		fmt.Sprintf("%s SLO %s error budget %.2f%% below %.2f%%",
+			t.URL(), c.slo, remaining, c.threshold)
+}
@@ -0,0 +1,226 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SignatureHeader is the HTTP header carrying the HMAC-SHA256 signature of
+// webhook payloads, in the form `sha256=<hex digest>`
+const SignatureHeader = "X-Overseer-Signature"
+
+// Channel defines the behavior of a notification medium, it's expected to
+// deliver a `Message` or return an error, a failed delivery may be retried
+type Channel interface {
+	Send(context.Context, *Message) error
+}
+
+// postJSON encode a payload as JSON and POST it to an URL, optional headers
+// are derived from the encoded body
+func postJSON(ctx context.Context, client *http.Client, url string,
+	payload interface{}, headers func([]byte) map[string]string) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if headers != nil {
+		for k, v := range headers(body) {
+			req.Header.Set(k, v)
+		}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with %s", url, res.Status)
+	}
+	return nil
+}
+
+// WebhookChannel POST the whole `Message` as JSON to an URL, signing it with
+// an HMAC if a secret is set
+type WebhookChannel struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// NewWebhookChannel create a new `WebhookChannel`
+func NewWebhookChannel(url, secret string, timeout time.Duration) *WebhookChannel {
+	return &WebhookChannel{url, []byte(secret), &http.Client{Timeout: timeout}}
+}
+
+// Sign return the signature of a payload as set in the `SignatureHeader`
+func Sign(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send POST the message to the webhook URL
+func (w *WebhookChannel) Send(ctx context.Context, m *Message) error {
+	return postJSON(ctx, w.client, w.url, m, func(body []byte) map[string]string {
+		if len(w.secret) == 0 {
+			return nil
+		}
+		return map[string]string{SignatureHeader: Sign(w.secret, body)}
+	})
+}
+
+// ChatChannel POST the rendered message to a Slack or Mattermost compatible
+// incoming webhook
+type ChatChannel struct {
+	url      string
+	channel  string
+	username string
+	client   *http.Client
+}
+
+// NewChatChannel create a new `ChatChannel`, channel and username are
+// optional overrides of the incoming webhook defaults
+func NewChatChannel(url, channel, username string, timeout time.Duration) *ChatChannel {
+	return &ChatChannel{url, channel, username, &http.Client{Timeout: timeout}}
+}
+
+// chatPayload is the incoming webhook payload shared by Slack and Mattermost
+type chatPayload struct {
+	Text     string `json:"text"`
+	Channel  string `json:"channel,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+// Send POST the message text to the incoming webhook
+func (c *ChatChannel) Send(ctx context.Context, m *Message) error {
+	text := "*" + m.Title + "*\n" + m.Body
+	return postJSON(ctx, c.client, c.url, chatPayload{text, c.channel, c.username}, nil)
+}
+
+// EmailChannel deliver messages through an SMTP relay
+type EmailChannel struct {
+	addr    string
+	from    string
+	to      []string
+	auth    smtp.Auth
+	timeout time.Duration
+}
+
+// NewEmailChannel create a new `EmailChannel`, PLAIN authentication is used
+// only if username is set
+func NewEmailChannel(addr, from string, to []string,
+	username, password string, timeout time.Duration) *EmailChannel {
+	var auth smtp.Auth
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &EmailChannel{addr, from, to, auth, timeout}
+}
+
+// headerValue return a value safe to be used as an email header, line breaks
+// are folded into spaces so that no extra header can be injected
+func headerValue(value string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(value)
+}
+
+// Send deliver the message as a plain text email, the SMTP conversation is
+// bounded by the channel timeout and the context deadline
+func (e *EmailChannel) Send(ctx context.Context, m *Message) error {
+	msg := "From: " + e.from + "\r\n" +
+		"To: " + strings.Join(e.to, ", ") + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", headerValue(m.Title)) + "\r\n" +
+		"X-Overseer-Dedup-Key: " + headerValue(m.Key) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.ReplaceAll(m.Body, "\n", "\r\n")
+	dialer := net.Dialer{Timeout: e.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(e.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	host, _, _ := net.SplitHostPort(e.addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if e.auth != nil {
+		if err := client.Auth(e.auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(e.from); err != nil {
+		return err
+	}
+	for _, rcpt := range e.to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
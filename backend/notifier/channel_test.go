@@ -0,0 +1,191 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package notifier
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+func testMessage(t *testing.T) *Message {
+	tpl, _ := parseTemplate("test", "")
+	msg, err := newMessage(tpl, []Alert{{
+		Name:     "TargetDown",
+		Url:      "http://localhost:9898",
+		State:    AlertFiring,
+		Severity: "critical",
+		Summary:  "not alive for 3 consecutive probes",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestWebhookChannelSignature(t *testing.T) {
+	var received Message
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if sig := r.Header.Get(SignatureHeader); sig != Sign([]byte("secret"), body) {
+			t.Errorf("webhook failed: invalid signature %s\n", sig)
+		}
+		json.Unmarshal(body, &received)
+	}))
+	defer server.Close()
+
+	msg := testMessage(t)
+	channel := NewWebhookChannel(server.URL, "secret", time.Second)
+	if err := channel.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if received.Key != msg.Key || len(received.Alerts) != 1 {
+		t.Errorf("webhook failed: expected %v got %v\n", msg, received)
+	}
+}
+
+func TestWebhookChannelError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	channel := NewWebhookChannel(server.URL, "", time.Second)
+	if err := channel.Send(context.Background(), testMessage(t)); err == nil {
+		t.Errorf("webhook failed: expected error got nil\n")
+	}
+}
+
+func TestChatChannel(t *testing.T) {
+	var received chatPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+
+	channel := NewChatChannel(server.URL, "#ops", "overseer", time.Second)
+	if err := channel.Send(context.Background(), testMessage(t)); err != nil {
+		t.Fatal(err)
+	}
+	if received.Channel != "#ops" || !strings.Contains(received.Text, "[FIRING] TargetDown") {
+		t.Errorf("chat failed: unexpected payload %v\n", received)
+	}
+}
+
+// smtpSink is a minimal in-process SMTP server, accepting every message and
+// pushing its DATA section to a channel
+func smtpSink(t *testing.T) (string, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mails := make(chan string, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP sink")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "DATA"):
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					data.WriteString(l)
+				}
+				mails <- data.String()
+				reply("250 ok")
+			case strings.HasPrefix(cmd, "QUIT"):
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().String(), mails
+}
+
+func TestEmailChannel(t *testing.T) {
+	addr, mails := smtpSink(t)
+	channel := NewEmailChannel(addr, "overseer@localhost",
+		[]string{"ops@localhost"}, "", "", time.Second)
+	msg := testMessage(t)
+	if err := channel.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	mail := <-mails
+	if !strings.Contains(mail, "Subject: "+msg.Title) {
+		t.Errorf("email failed: missing subject in %q\n", mail)
+	}
+	if !strings.Contains(mail, "X-Overseer-Dedup-Key: "+msg.Key) {
+		t.Errorf("email failed: missing dedup key in %q\n", mail)
+	}
+}
+
+func TestEmailChannelHeaderInjection(t *testing.T) {
+	addr, mails := smtpSink(t)
+	channel := NewEmailChannel(addr, "overseer@localhost",
+		[]string{"ops@localhost"}, "", "", time.Second)
+	msg := testMessage(t)
+	msg.Title = "TargetDown\r\nBcc: attacker@localhost"
+	if err := channel.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	mail := <-mails
+	if strings.Contains(mail, "\r\nBcc:") {
+		t.Errorf("email failed: header injected in %q\n", mail)
+	}
+	if !strings.Contains(mail, "Subject: TargetDown Bcc: attacker@localhost\r\n") {
+		t.Errorf("email failed: expected sanitized subject in %q\n", mail)
+	}
+}
@@ -0,0 +1,118 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package notifier
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+// group collects the alerts of a route sharing the same values for the
+// route `group_by` labels, they're notified at once when the group is
+// flushed
+type group struct {
+	alerts    map[string]Alert
+	order     []string
+	interval  time.Duration
+	lastFlush time.Time
+	timer     *time.Timer
+}
+
+// grouper tracks the groups of every route, scheduling their flush
+type grouper struct {
+	mutex  sync.Mutex
+	groups map[string]*group
+}
+
+func newGrouper() *grouper {
+	return &grouper{groups: make(map[string]*group)}
+}
+
+// groupKey return the identifier of the group an alert belongs to within a
+// route
+func (r *Route) groupKey(a Alert) string {
+	values := make([]string, len(r.groupBy))
+	for i, name := range r.groupBy {
+		values[i] = name + "=" + label(a, name)
+	}
+	sort.Strings(values)
+	return r.name + "/" + strings.Join(values, ",")
+}
+
+// add an alert to its group, the first alert of a new group schedules a
+// flush after `group_wait`, while groups already notified are flushed no
+// sooner than `group_interval` after the previous notification, throttling
+// repeats. Newer states of an alert already in the group replace the old
+// ones.
+func (g *grouper) add(r *Route, a Alert, now time.Time, flush func([]Alert)) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	// Evict idle groups, nothing pending and out of the throttling window
+	for k, grp := range g.groups {
+		if grp.timer == nil && now.Sub(grp.lastFlush) > grp.interval {
+			delete(g.groups, k)
+		}
+	}
+	key := r.groupKey(a)
+	grp, ok := g.groups[key]
+	if !ok {
+		grp = &group{alerts: make(map[string]Alert), interval: r.groupInterval}
+		g.groups[key] = grp
+	}
+	fingerprint := a.Fingerprint()
+	if _, ok := grp.alerts[fingerprint]; !ok {
+		grp.order = append(grp.order, fingerprint)
+	}
+	grp.alerts[fingerprint] = a
+	if grp.timer != nil {
+		return
+	}
+	delay := r.groupWait
+	if !grp.lastFlush.IsZero() {
+		delay = grp.lastFlush.Add(r.groupInterval).Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+	}
+	grp.timer = time.AfterFunc(delay, func() {
+		g.mutex.Lock()
+		alerts := make([]Alert, len(grp.order))
+		for i, fingerprint := range grp.order {
+			alerts[i] = grp.alerts[fingerprint]
+		}
+		grp.alerts = make(map[string]Alert)
+		grp.order = nil
+		grp.timer = nil
+		grp.lastFlush = time.Now()
+		g.mutex.Unlock()
+		flush(alerts)
+	})
+}
@@ -0,0 +1,116 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package notifier
+
+import (
+	"fmt"
+	"regexp"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+// Matcher select alerts by the value of one of their labels, either by
+// equality or by a regular expression fully matching the value. Besides the
+// alert labels, `alertname`, `severity` and `url` can be matched as well,
+// while `tag` matches if any of the tags of the alerted target does.
+type Matcher struct {
+	Name  string `yaml:"name" json:"name"`
+	Value string `yaml:"value" json:"value"`
+	Regex bool   `yaml:"regex,omitempty" json:"regex,omitempty"`
+	re    *regexp.Regexp
+}
+
+// compile prepare the regular expression of a regex matcher
+func (m *Matcher) compile() error {
+	if !m.Regex {
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + m.Value + ")$")
+	if err != nil {
+		return fmt.Errorf("matcher %s: %w", m.Name, err)
+	}
+	m.re = re
+	return nil
+}
+
+// Matches return true if the alert label named by the matcher has the
+// expected value
+func (m *Matcher) Matches(a Alert) bool {
+	if m.Name == "tag" {
+		for _, tag := range a.Tags {
+			if m.matchValue(tag) {
+				return true
+			}
+		}
+		return false
+	}
+	return m.matchValue(label(a, m.Name))
+}
+
+// matchValue return true if a single value satisfies the matcher, regex
+// matchers are compiled once loaded, one not compiled never matches
+func (m *Matcher) matchValue(value string) bool {
+	if m.Regex {
+		return m.re != nil && m.re.MatchString(value)
+	}
+	return value == m.Value
+}
+
+// compileMatchers validate a list of matchers
+func compileMatchers(matchers []Matcher) error {
+	for i := range matchers {
+		if err := matchers[i].compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchAll return true if every matcher matches the alert, an empty list
+// matches everything
+func matchAll(matchers []Matcher, a Alert) bool {
+	for i := range matchers {
+		if !matchers[i].Matches(a) {
+			return false
+		}
+	}
+	return true
+}
+
+// label return the value of an alert label, resolving the reserved names
+// to the alert fields
+func label(a Alert, name string) string {
+	switch name {
+	case "alertname":
+		return a.Name
+	case "severity":
+		return a.Severity
+	case "url":
+		return a.Url
+	}
+	return a.Labels[name]
+}
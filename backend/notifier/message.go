@@ -0,0 +1,93 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package notifier
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+// defaultTemplate is the body used by routes not defining one
+const defaultTemplate = `{{range .Alerts}}[{{upper .State}}] {{.Name}} {{.Url}} ({{.Severity}}): {{.Summary}}
+{{end}}`
+
+// Message is the notification dispatched through channels, carrying the
+// alerts and their rendered textual representation
+type Message struct {
+	Key    string  `json:"dedup_key"`
+	Title  string  `json:"title"`
+	Body   string  `json:"body"`
+	Alerts []Alert `json:"alerts"`
+}
+
+// parseTemplate compile a message body template, falling back to the
+// default one if empty
+func parseTemplate(name, text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultTemplate
+	}
+	return template.New(name).
+		Funcs(template.FuncMap{
+			"upper": func(s interface{}) string {
+				return strings.ToUpper(fmt.Sprint(s))
+			},
+		}).
+		Parse(text)
+}
+
+// newMessage render a `Message` for a set of alerts through a template, the
+// dedup key identifies the set of alerts in their current state
+func newMessage(tpl *template.Template, alerts []Alert) (*Message, error) {
+	var body bytes.Buffer
+	if err := tpl.Execute(&body, struct{ Alerts []Alert }{alerts}); err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(alerts))
+	for i, a := range alerts {
+		// The start of the incident keeps a target firing again after being
+		// resolved from colliding with the keys already marked as delivered
+		keys[i] = a.Fingerprint() + ":" +
+			strconv.FormatInt(a.StartsAt.UnixNano(), 10) + ":" + string(a.State)
+	}
+	title := fmt.Sprintf("[%s] %s %s", strings.ToUpper(string(alerts[0].State)),
+		alerts[0].Name, alerts[0].Url)
+	if len(alerts) > 1 {
+		title = fmt.Sprintf("[%s] %s and %d more", strings.ToUpper(string(alerts[0].State)),
+			alerts[0].Name, len(alerts)-1)
+	}
+	return &Message{
+		Key:    strings.Join(keys, ","),
+		Title:  title,
+		Body:   body.String(),
+		Alerts: alerts,
+	}, nil
+}
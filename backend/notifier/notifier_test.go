@@ -0,0 +1,233 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package notifier
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+// fakeChannel fails the first `failures` sends, recording the successful
+// ones
+type fakeChannel struct {
+	mutex    sync.Mutex
+	failures int
+	attempts int
+	sent     []*Message
+}
+
+func (f *fakeChannel) Send(_ context.Context, m *Message) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.attempts++
+	if f.attempts <= f.failures {
+		return errors.New("unavailable")
+	}
+	f.sent = append(f.sent, m)
+	return nil
+}
+
+func TestNotifierRetry(t *testing.T) {
+	channel := &fakeChannel{failures: 2}
+	route, _ := NewRoute("fake", channel, "", 2, time.Millisecond)
+	n := New([]*Route{route}, time.Hour, "alerts", nil)
+	n.Dispatch(context.Background(), Alert{Name: "TargetDown", State: AlertFiring})
+	if channel.attempts != 3 || len(channel.sent) != 1 {
+		t.Errorf("retry failed: expected 3 attempts 1 sent got %d %d\n",
+			channel.attempts, len(channel.sent))
+	}
+}
+
+func TestNotifierRetryExhausted(t *testing.T) {
+	channel := &fakeChannel{failures: 5}
+	route, _ := NewRoute("fake", channel, "", 1, time.Millisecond)
+	n := New([]*Route{route}, time.Hour, "alerts", nil)
+	n.Dispatch(context.Background(), Alert{Name: "TargetDown", State: AlertFiring})
+	if channel.attempts != 2 || len(channel.sent) != 0 {
+		t.Errorf("retry failed: expected 2 attempts 0 sent got %d %d\n",
+			channel.attempts, len(channel.sent))
+	}
+}
+
+func TestNotifierDedup(t *testing.T) {
+	channel := &fakeChannel{}
+	route, _ := NewRoute("fake", channel, "", 0, time.Millisecond)
+	n := New([]*Route{route}, time.Hour, "alerts", nil)
+	alert := Alert{Name: "TargetDown", Url: "http://localhost", State: AlertFiring}
+	n.Dispatch(context.Background(), alert)
+	n.Dispatch(context.Background(), alert)
+	if len(channel.sent) != 1 {
+		t.Errorf("dedup failed: expected 1 sent got %d\n", len(channel.sent))
+	}
+	alert.State = AlertResolved
+	n.Dispatch(context.Background(), alert)
+	if len(channel.sent) != 2 {
+		t.Errorf("dedup failed: expected 2 sent got %d\n", len(channel.sent))
+	}
+}
+
+func TestNotifierRefiring(t *testing.T) {
+	channel := &fakeChannel{}
+	route, _ := NewRoute("fake", channel, "", 0, time.Millisecond)
+	n := New([]*Route{route}, time.Hour, "alerts", nil)
+	start := time.Now()
+	alert := Alert{Name: "TargetDown", Url: "http://localhost",
+		State: AlertFiring, StartsAt: start}
+	n.Dispatch(context.Background(), alert)
+	alert.State = AlertResolved
+	n.Dispatch(context.Background(), alert)
+	alert.State, alert.StartsAt = AlertFiring, start.Add(time.Minute)
+	n.Dispatch(context.Background(), alert)
+	if len(channel.sent) != 3 {
+		t.Errorf("refiring failed: expected 3 sent got %d\n", len(channel.sent))
+	}
+}
+
+func TestNotifierPending(t *testing.T) {
+	channel := &fakeChannel{}
+	route, _ := NewRoute("fake", channel, "", 0, time.Millisecond)
+	n := New([]*Route{route}, time.Hour, "alerts", nil)
+	alert := Alert{Name: "TargetDown", Url: "http://localhost", State: AlertPending}
+	n.Dispatch(context.Background(), alert)
+	n.Dispatch(context.Background(), alert)
+	if len(channel.sent) != 0 {
+		t.Errorf("pending failed: expected 0 sent got %d\n", len(channel.sent))
+	}
+}
+
+func TestNotifierRouting(t *testing.T) {
+	critical, warning := &fakeChannel{}, &fakeChannel{}
+	pager, _ := NewRouteFromConfig(RouteConfig{Name: "pager", Type: Webhook})
+	pager.channel = critical
+	pager.matchers = []Matcher{{Name: "severity", Value: "critical"}}
+	mail, err := NewRouteFromConfig(RouteConfig{Name: "mail", Type: Webhook,
+		Match: []Matcher{{Name: "team", Value: "ops|dev", Regex: true}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mail.channel = warning
+	n := New([]*Route{pager, mail}, time.Hour, "alerts", nil)
+	n.Dispatch(context.Background(), Alert{Name: "TargetDown", Severity: "critical"})
+	n.Dispatch(context.Background(), Alert{
+		Name:     "SlowResponses",
+		Severity: "warning",
+		Labels:   map[string]string{"team": "dev"},
+	})
+	if len(critical.sent) != 1 || critical.sent[0].Alerts[0].Name != "TargetDown" {
+		t.Errorf("routing failed: expected TargetDown on pager got %v\n", critical.sent)
+	}
+	if len(warning.sent) != 1 || warning.sent[0].Alerts[0].Name != "SlowResponses" {
+		t.Errorf("routing failed: expected SlowResponses on mail got %v\n", warning.sent)
+	}
+}
+
+func TestNotifierRoutingByTag(t *testing.T) {
+	web, db := &fakeChannel{}, &fakeChannel{}
+	webRoute, _ := NewRouteFromConfig(RouteConfig{Name: "web", Type: Webhook})
+	webRoute.channel = web
+	webRoute.matchers = []Matcher{{Name: "tag", Value: "web"}}
+	dbRoute, err := NewRouteFromConfig(RouteConfig{Name: "db", Type: Webhook,
+		Match: []Matcher{{Name: "tag", Value: "postgres|mysql", Regex: true}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbRoute.channel = db
+	n := New([]*Route{webRoute, dbRoute}, time.Hour, "alerts", nil)
+	n.Dispatch(context.Background(), Alert{Name: "TargetDown",
+		Url: "http://webserver-1", Tags: []string{"frontend", "web"}})
+	n.Dispatch(context.Background(), Alert{Name: "TargetDown",
+		Url: "tcp://db-1", Tags: []string{"mysql"}})
+	if len(web.sent) != 1 || web.sent[0].Alerts[0].Url != "http://webserver-1" {
+		t.Errorf("routing failed: expected webserver-1 on web got %v\n", web.sent)
+	}
+	if len(db.sent) != 1 || db.sent[0].Alerts[0].Url != "tcp://db-1" {
+		t.Errorf("routing failed: expected db-1 on db got %v\n", db.sent)
+	}
+}
+
+func TestMatcherNotCompiled(t *testing.T) {
+	m := Matcher{Name: "alertname", Value: "Target.*", Regex: true}
+	if m.Matches(Alert{Name: "TargetDown"}) || m.re != nil {
+		t.Errorf("Matcher.Matches failed: expected no match nor compilation\n")
+	}
+	if err := compileMatchers([]Matcher{{Name: "alertname", Value: "(", Regex: true}}); err == nil {
+		t.Errorf("compileMatchers failed: expected an error for an invalid regex\n")
+	}
+}
+
+func TestNotifierGrouping(t *testing.T) {
+	channel := &fakeChannel{}
+	route, _ := NewRoute("fake", channel, "", 0, time.Millisecond)
+	route.groupBy = []string{"alertname"}
+	route.groupWait = 20 * time.Millisecond
+	route.groupInterval = 50 * time.Millisecond
+	n := New([]*Route{route}, time.Hour, "alerts", nil)
+	for _, url := range []string{"http://a", "http://b", "http://c"} {
+		n.Dispatch(context.Background(), Alert{Name: "TargetDown", Url: url, State: AlertFiring})
+	}
+	time.Sleep(40 * time.Millisecond)
+	channel.mutex.Lock()
+	if len(channel.sent) != 1 || len(channel.sent[0].Alerts) != 3 {
+		t.Errorf("grouping failed: expected 1 message with 3 alerts got %v\n", channel.sent)
+	}
+	channel.mutex.Unlock()
+	// Repeats within the group interval are throttled and merged
+	n.Dispatch(context.Background(), Alert{Name: "TargetDown", Url: "http://a", State: AlertResolved})
+	n.Dispatch(context.Background(), Alert{Name: "TargetDown", Url: "http://b", State: AlertResolved})
+	time.Sleep(10 * time.Millisecond)
+	channel.mutex.Lock()
+	if len(channel.sent) != 1 {
+		t.Errorf("grouping failed: expected throttled repeat got %d messages\n", len(channel.sent))
+	}
+	channel.mutex.Unlock()
+	time.Sleep(60 * time.Millisecond)
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+	if len(channel.sent) != 2 || len(channel.sent[1].Alerts) != 2 {
+		t.Errorf("grouping failed: expected 2 messages got %v\n", channel.sent)
+	}
+}
+
+func TestNotifierSilenced(t *testing.T) {
+	channel := &fakeChannel{}
+	route, _ := NewRoute("fake", channel, "", 0, time.Millisecond)
+	n := New([]*Route{route}, time.Hour, "alerts", nil)
+	n.silences.Add(&Silence{
+		Matchers: []Matcher{{Name: "url", Value: "http://a"}},
+		EndsAt:   time.Now().Add(time.Hour),
+	})
+	n.Dispatch(context.Background(), Alert{Name: "TargetDown", Url: "http://a"})
+	n.Dispatch(context.Background(), Alert{Name: "TargetDown", Url: "http://b"})
+	if len(channel.sent) != 1 || channel.sent[0].Alerts[0].Url != "http://b" {
+		t.Errorf("silence failed: expected only http://b got %v\n", channel.sent)
+	}
+}
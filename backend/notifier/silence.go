@@ -0,0 +1,179 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package notifier
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+// ErrInvalidSilence is returned when a silence has no matchers or an empty
+// time range
+var ErrInvalidSilence = errors.New("silence requires matchers and ends_at after starts_at")
+
+// Silence mutes every alert matching all of its matchers within a time
+// range
+type Silence struct {
+	ID        string    `json:"id"`
+	Matchers  []Matcher `json:"matchers"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	CreatedBy string    `json:"created_by"`
+	Comment   string    `json:"comment"`
+}
+
+// Active return true if the silence is in effect at a given time
+func (s *Silence) Active(now time.Time) bool {
+	return !now.Before(s.StartsAt) && now.Before(s.EndsAt)
+}
+
+// SilenceStore holds the silences, persisting them as JSON to a file on
+// every change so that they survive restarts, an empty path means an
+// in-memory only store
+type SilenceStore struct {
+	path     string
+	mutex    sync.RWMutex
+	silences map[string]*Silence
+}
+
+// NewSilenceStore create a new `SilenceStore` loading the silences
+// previously persisted to path, if any
+func NewSilenceStore(path string) (*SilenceStore, error) {
+	store := &SilenceStore{path: path, silences: make(map[string]*Silence)}
+	var silences []*Silence
+	if err := LoadJSONFile(path, &silences); err != nil {
+		return nil, err
+	}
+	for _, s := range silences {
+		if err := compileMatchers(s.Matchers); err != nil {
+			return nil, err
+		}
+		store.silences[s.ID] = s
+	}
+	return store, nil
+}
+
+// Add validate and store a new silence, returning its ID
+func (s *SilenceStore) Add(silence *Silence) (string, error) {
+	if silence.StartsAt.IsZero() {
+		silence.StartsAt = time.Now()
+	}
+	if len(silence.Matchers) == 0 || !silence.EndsAt.After(silence.StartsAt) {
+		return "", ErrInvalidSilence
+	}
+	if err := compileMatchers(silence.Matchers); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidSilence, err)
+	}
+	id, err := NewID()
+	if err != nil {
+		return "", err
+	}
+	silence.ID = id
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.silences[silence.ID] = silence
+	return silence.ID, s.save()
+}
+
+// Delete remove a silence, returning false if not found
+func (s *SilenceStore) Delete(id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.silences[id]; !ok {
+		return false, nil
+	}
+	delete(s.silences, id)
+	return true, s.save()
+}
+
+// List return all the silences not yet expired, sorted by start time
+func (s *SilenceStore) List() []Silence {
+	now := time.Now()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	silences := make([]Silence, 0, len(s.silences))
+	for _, silence := range s.silences {
+		if now.Before(silence.EndsAt) {
+			silences = append(silences, *silence)
+		}
+	}
+	sort.Slice(silences, func(i, j int) bool {
+		return silences[i].StartsAt.Before(silences[j].StartsAt)
+	})
+	return silences
+}
+
+// Silenced return the first active silence muting an alert, nil if the
+// alert is not silenced
+func (s *SilenceStore) Silenced(a Alert, now time.Time) *Silence {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, silence := range s.silences {
+		if silence.Active(now) && matchAll(silence.Matchers, a) {
+			return silence
+		}
+	}
+	return nil
+}
+
+// save persist the silences not yet expired, must be called holding the
+// lock
+func (s *SilenceStore) save() error {
+	now := time.Now()
+	silences := make([]*Silence, 0, len(s.silences))
+	for id, silence := range s.silences {
+		if !now.Before(silence.EndsAt) {
+			delete(s.silences, id)
+			continue
+		}
+		silences = append(silences, silence)
+	}
+	return SaveJSONFile(s.path, silences)
+}
+
+// silencesEndpoint is the HTTP route to manage silences:
+//
+// - GET /silences list the silences not yet expired
+// - POST /silences create a new silence from a JSON body
+// - DELETE /silences/<id> remove a silence
+func silencesEndpoint(store *SilenceStore) http.HandlerFunc {
+	return CollectionEndpoint("/silences", Collection{
+		Name:    "silence",
+		Invalid: ErrInvalidSilence,
+		List:    func(url.Values) interface{} { return store.List() },
+		New:     func() interface{} { return &Silence{} },
+		Add:     func(s interface{}) (string, error) { return store.Add(s.(*Silence)) },
+		Delete:  store.Delete,
+	})
+}
@@ -0,0 +1,114 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package notifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+func TestSilenceStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "silences.json")
+	store, err := NewSilenceStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := store.Add(&Silence{
+		Matchers: []Matcher{{Name: "alertname", Value: "Target.*", Regex: true}},
+		EndsAt:   time.Now().Add(time.Hour),
+		Comment:  "deploy",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewSilenceStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	silences := reloaded.List()
+	if len(silences) != 1 || silences[0].ID != id {
+		t.Fatalf("persistence failed: expected silence %s got %v\n", id, silences)
+	}
+	if reloaded.Silenced(Alert{Name: "TargetDown"}, time.Now()) == nil {
+		t.Errorf("persistence failed: expected TargetDown to be silenced\n")
+	}
+	if reloaded.Silenced(Alert{Name: "SlowResponses"}, time.Now()) != nil {
+		t.Errorf("persistence failed: expected SlowResponses not silenced\n")
+	}
+}
+
+func TestSilencesEndpoint(t *testing.T) {
+	store, _ := NewSilenceStore("")
+	server := httptest.NewServer(silencesEndpoint(store))
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"/silences", "application/json",
+		strings.NewReader(`{"matchers":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("create failed: expected 400 got %d\n", res.StatusCode)
+	}
+
+	body := `{"matchers":[{"name":"severity","value":"warning"}],"ends_at":"` +
+		time.Now().Add(time.Hour).Format(time.RFC3339) + `"}`
+	res, err = http.Post(server.URL+"/silences", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created map[string]string
+	json.NewDecoder(res.Body).Decode(&created)
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated || created["id"] == "" {
+		t.Fatalf("create failed: expected 201 got %d\n", res.StatusCode)
+	}
+
+	res, _ = http.Get(server.URL + "/silences")
+	var silences []Silence
+	json.NewDecoder(res.Body).Decode(&silences)
+	res.Body.Close()
+	if len(silences) != 1 {
+		t.Errorf("list failed: expected 1 silence got %d\n", len(silences))
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/silences/"+created["id"], nil)
+	res, _ = http.DefaultClient.Do(req)
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("delete failed: expected 204 got %d\n", res.StatusCode)
+	}
+	if len(store.List()) != 0 {
+		t.Errorf("delete failed: expected no silences\n")
+	}
+}
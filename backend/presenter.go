@@ -30,10 +30,16 @@
 package backend
 
 import (
+	"context"
+	"encoding/json"
 	"html/template"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/codepr/overseer/internal"
 	"github.com/codepr/overseer/internal/messaging"
 
 	"github.com/gorilla/websocket"
@@ -86,22 +92,60 @@ func home() http.HandlerFunc {
 }
 
 // Run start consuming the RabbitMQ and run the HTTP server serving `ws_stats`
-// as the only route available
-func Run(listenAddr, queueAddr, queueName string) {
+// as the only route available, the queue consumed is bound to the exchange
+// by its name, if an exchange is set
+func Run(listenAddr, queueAddr, queueName, exchange string, security messaging.SecurityConfig) {
 	events := make(chan []byte)
-	queue, err := messaging.Connect(queueAddr)
+	queue, err := messaging.Dial(queueAddr, messaging.Group("presenter"),
+		messaging.Security(security), messaging.Exchange(exchange))
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer queue.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Catch SIGINT/SIGTERM signals, draining the stats in flight before
+	// exiting
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signalCh
+		cancel()
+		if err := queue.Close(); err != nil {
+			log.Println("Error closing the message queue:", err)
+		}
+		os.Exit(1)
+	}()
 
 	// Add websocket route
 	http.HandleFunc("/ws_stats", wsEndpoint(events))
 	http.HandleFunc("/", home())
 
 	// Consume records from RabbitMQ pushing them to `events` channel
+	deliveries := make(chan messaging.Delivery)
+	go func() {
+		if err := queue.Consume(ctx, queueName, 1, deliveries); err != nil {
+			log.Println("Error consuming stats:", err)
+		}
+	}()
 	go func() {
-		queue.Consume(queueName, 1, events)
+		for d := range deliveries {
+			// Forward the stats to the front-end in their plain format,
+			// whatever the version received
+			stats, _, err := internal.DecodeStats(d.Message)
+			if err != nil {
+				log.Println("Error decoding stats:", err)
+				d.Nack(false, err)
+				continue
+			}
+			payload, err := json.Marshal(stats)
+			if err != nil {
+				log.Println("Unable to marshal stats")
+				d.Nack(false, err)
+				continue
+			}
+			events <- payload
+			d.Ack()
+		}
 	}()
 
 	log.Fatal(http.ListenAndServe(listenAddr, nil))
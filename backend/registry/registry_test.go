@@ -0,0 +1,178 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+func TestTargetStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.json")
+	store, err := NewTargetStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := store.Add(&Target{
+		Url:      "http://localhost:9898",
+		Interval: 30 * time.Second,
+		Tags:     []string{"db"},
+		Owner:    "team-a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Add(&Target{Url: "http://localhost:9898"}); err != ErrDuplicateTarget {
+		t.Errorf("TargetStore.Add failed: expected %v got %v\n", ErrDuplicateTarget, err)
+	}
+	reloaded, err := NewTargetStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, found := reloaded.Get(id)
+	if !found || target.Interval != 30*time.Second || target.Probe != ProbeHTTP ||
+		target.Owner != "team-a" || !target.HasTag("db") {
+		t.Errorf("persistence failed: expected target %s got %v\n", id, target)
+	}
+}
+
+func TestTargetStoreRollback(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "registry")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewTargetStore(filepath.Join(dir, "targets.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := store.Add(&Target{Url: "http://localhost:9898"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make every following save fail
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Add(&Target{Url: "http://localhost:9899"}); err == nil {
+		t.Errorf("TargetStore.Add failed: expected save error got nil\n")
+	}
+	if _, err := store.Update(id, &Target{Url: "http://localhost:9900"}); err == nil {
+		t.Errorf("TargetStore.Update failed: expected save error got nil\n")
+	}
+	if _, _, err := store.Delete(id); err == nil {
+		t.Errorf("TargetStore.Delete failed: expected save error got nil\n")
+	}
+	targets := store.List()
+	if len(targets) != 1 || targets[0].ID != id || targets[0].Url != "http://localhost:9898" {
+		t.Errorf("rollback failed: expected only the first target got %v\n", targets)
+	}
+}
+
+func TestTargetsEndpoint(t *testing.T) {
+	store, _ := NewTargetStore("")
+	var events []TargetEvent
+	server := httptest.NewServer(targetsEndpoint(store, func(e TargetEvent) {
+		events = append(events, e)
+	}))
+	defer server.Close()
+
+	request := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	invalid := []string{
+		`{"url":"localhost"}`,
+		`{"url":"http://localhost","probe":"icmp"}`,
+		`{"url":"http://localhost","assertions":[{"type":"status","value":"x"}]}`,
+		`{"url":"http://localhost","interval":"soon"}`,
+	}
+	for _, body := range invalid {
+		if res := request(http.MethodPost, "/targets", body); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("POST /targets failed: expected 400 for %s got %d\n", body, res.StatusCode)
+		}
+	}
+
+	res := request(http.MethodPost, "/targets",
+		`{"url":"http://localhost","interval":"30s","tags":["web"],"owner":"team-a"}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /targets failed: expected 201 got %d\n", res.StatusCode)
+	}
+	var created map[string]string
+	json.NewDecoder(res.Body).Decode(&created)
+	id := created["id"]
+	if res := request(http.MethodPost, "/targets", `{"url":"http://localhost"}`); res.StatusCode != http.StatusConflict {
+		t.Errorf("POST /targets failed: expected 409 got %d\n", res.StatusCode)
+	}
+
+	res = request(http.MethodPut, "/targets/"+id, `{"url":"http://localhost","interval":"1m"}`)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("PUT /targets failed: expected 200 got %d\n", res.StatusCode)
+	}
+	res = request(http.MethodGet, "/targets/"+id, "")
+	var target Target
+	json.NewDecoder(res.Body).Decode(&target)
+	if target.ID != id || target.Interval != time.Minute || target.Owner != "" {
+		t.Errorf("GET /targets failed: expected updated target got %v\n", target)
+	}
+
+	res = request(http.MethodGet, "/targets?owner=team-a", "")
+	var targets []Target
+	json.NewDecoder(res.Body).Decode(&targets)
+	if len(targets) != 0 {
+		t.Errorf("GET /targets failed: expected no target of team-a got %v\n", targets)
+	}
+
+	if res := request(http.MethodDelete, "/targets/"+id, ""); res.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE /targets failed: expected 204 got %d\n", res.StatusCode)
+	}
+	if res := request(http.MethodGet, "/targets/"+id, ""); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /targets failed: expected 404 got %d\n", res.StatusCode)
+	}
+
+	actions := []string{TargetCreated, TargetUpdated, TargetDeleted}
+	if len(events) != len(actions) {
+		t.Fatalf("targetsEndpoint failed: expected %d events got %v\n", len(actions), events)
+	}
+	for i, action := range actions {
+		if events[i].Action != action || events[i].Target.ID != id {
+			t.Errorf("targetsEndpoint failed: expected %s of %s got %v\n", action, id, events[i])
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+
+	. "github.com/codepr/overseer/internal"
+)
+
+var (
+	// ErrInvalidTarget is returned when a target has no valid URL, an
+	// unsupported probe type, a negative interval or invalid assertions
+	ErrInvalidTarget = errors.New("invalid target")
+	// ErrDuplicateTarget is returned when a target with the same URL is
+	// already registered
+	ErrDuplicateTarget = errors.New("target already registered")
+)
+
+// TargetStore holds the registered targets, persisting them as JSON to a
+// file on every change so that they survive restarts, an empty path means
+// an in-memory only store
+type TargetStore struct {
+	path    string
+	mutex   sync.RWMutex
+	targets map[string]*Target
+}
+
+// NewTargetStore create a new `TargetStore` loading the targets previously
+// persisted to path, if any
+func NewTargetStore(path string) (*TargetStore, error) {
+	store := &TargetStore{path: path, targets: make(map[string]*Target)}
+	var targets []*Target
+	if err := LoadJSONFile(path, &targets); err != nil {
+		return nil, err
+	}
+	for _, t := range targets {
+		store.targets[t.ID] = t
+	}
+	return store, nil
+}
+
+// validate check a target, setting the default probe type
+func validate(t *Target) error {
+	u, err := url.Parse(t.Url)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("%w: url must be absolute", ErrInvalidTarget)
+	}
+	if t.Probe == "" {
+		t.Probe = ProbeHTTP
+	}
+	if t.Probe != ProbeHTTP {
+		return fmt.Errorf("%w: unsupported probe %s", ErrInvalidTarget, t.Probe)
+	}
+	if t.Interval < 0 {
+		return fmt.Errorf("%w: negative interval", ErrInvalidTarget)
+	}
+	for _, assertion := range t.Assertions {
+		if _, err := assertion.Check(0, ""); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidTarget, err)
+		}
+	}
+	return nil
+}
+
+// duplicate return true if another target with the same URL is registered,
+// must be called holding the lock
+func (s *TargetStore) duplicate(t *Target) bool {
+	for id, other := range s.targets {
+		if id != t.ID && other.Url == t.Url {
+			return true
+		}
+	}
+	return false
+}
+
+// Add validate and store a new target, returning its ID, the target is
+// kept only if persisted successfully
+func (s *TargetStore) Add(target *Target) (string, error) {
+	if err := validate(target); err != nil {
+		return "", err
+	}
+	id, err := NewID()
+	if err != nil {
+		return "", err
+	}
+	target.ID = id
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.duplicate(target) {
+		return "", ErrDuplicateTarget
+	}
+	s.targets[target.ID] = target
+	if err := s.save(); err != nil {
+		delete(s.targets, target.ID)
+		return "", err
+	}
+	return target.ID, nil
+}
+
+// Update validate and replace a target, returning false if not found, the
+// previous target is restored if the change can't be persisted
+func (s *TargetStore) Update(id string, target *Target) (bool, error) {
+	if err := validate(target); err != nil {
+		return false, err
+	}
+	target.ID = id
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous, ok := s.targets[id]
+	if !ok {
+		return false, nil
+	}
+	if s.duplicate(target) {
+		return true, ErrDuplicateTarget
+	}
+	s.targets[id] = target
+	if err := s.save(); err != nil {
+		s.targets[id] = previous
+		return true, err
+	}
+	return true, nil
+}
+
+// Get return a target by its ID
+func (s *TargetStore) Get(id string) (Target, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	target, ok := s.targets[id]
+	if !ok {
+		return Target{}, false
+	}
+	return *target, true
+}
+
+// Delete remove a target, returning it, false if not found, the target is
+// restored if the change can't be persisted
+func (s *TargetStore) Delete(id string) (Target, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	target, ok := s.targets[id]
+	if !ok {
+		return Target{}, false, nil
+	}
+	delete(s.targets, id)
+	if err := s.save(); err != nil {
+		s.targets[id] = target
+		return Target{}, true, err
+	}
+	return *target, true, nil
+}
+
+// List return all the targets, sorted by URL
+func (s *TargetStore) List() []Target {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	targets := make([]Target, 0, len(s.targets))
+	for _, target := range s.targets {
+		targets = append(targets, *target)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Url < targets[j].Url })
+	return targets
+}
+
+// save persist the targets sorted by URL, must be called holding the lock
+func (s *TargetStore) save() error {
+	targets := make([]*Target, 0, len(s.targets))
+	for _, target := range s.targets {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Url < targets[j].Url })
+	return SaveJSONFile(s.path, targets)
+}
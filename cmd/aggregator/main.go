@@ -27,13 +27,30 @@
 package main
 
 import (
+	"flag"
+
 	"github.com/codepr/overseer/backend/aggregator"
+	"github.com/codepr/overseer/internal"
 )
 
 func main() {
-	aggregator, err := aggregator.NewFromEnv()
+	var (
+		configPath string
+		overseer   *aggregator.Aggregator
+		err        error
+	)
+	flag.StringVar(&configPath, "conf", "", "Configuration YAML path")
+	flag.Parse()
+	if configPath != "" {
+		if err := internal.ValidateConfigPath(configPath); err != nil {
+			panic(err)
+		}
+		overseer, err = aggregator.NewFromConfig(configPath)
+	} else {
+		overseer, err = aggregator.NewFromEnv()
+	}
 	if err != nil {
 		panic(err)
 	}
-	aggregator.Run()
+	overseer.Run()
 }
@@ -29,6 +29,9 @@ package main
 import (
 	"flag"
 	"github.com/codepr/overseer/backend"
+	"github.com/codepr/overseer/internal"
+	"github.com/codepr/overseer/internal/messaging"
+	"log"
 	"os"
 )
 
@@ -36,15 +39,21 @@ var (
 	listenAddr string
 	queueAddr  string
 	queueName  string
+	exchange   string
 )
 
 func main() {
 	flag.StringVar(&listenAddr, "listen", ":17657", "Addr to listen on for websocket exposed API")
 	flag.StringVar(&queueAddr, "queue_addr", "", "Addr of the RabbitMQ middleware to communicate with agreagator")
 	flag.StringVar(&queueName, "queue", "stats", "Name of the queue to consume")
+	flag.StringVar(&exchange, "exchange", "", "Name of the topic exchange the queue is bound to")
 	flag.Parse()
 	if queueAddr == "" {
 		queueAddr = os.Getenv("QUEUE_ADDR")
 	}
-	backend.Run(listenAddr, queueAddr, queueName)
+	if exchange == "" {
+		exchange = os.Getenv("EXCHANGE")
+	}
+	log.SetOutput(messaging.Redacting(os.Stderr))
+	backend.Run(listenAddr, queueAddr, queueName, exchange, internal.GetEnvAsSecurity())
 }
@@ -3,7 +3,14 @@ module github.com/codepr/overseer
 go 1.14
 
 require (
+	github.com/Shopify/sarama v1.30.0
+	github.com/alicebob/miniredis/v2 v2.32.1
+	github.com/go-redis/redis/v8 v8.11.4
 	github.com/gorilla/websocket v1.4.2
+	github.com/nats-io/nats-server/v2 v2.6.0
+	github.com/nats-io/nats.go v1.13.0
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/streadway/amqp v1.0.0
-	gopkg.in/yaml.v2 v2.3.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,81 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Supported assertion types
+const (
+	AssertStatus       = "status"
+	AssertBodyContains = "body_contains"
+	AssertBodyMatches  = "body_matches"
+)
+
+// Assertion is a check run by the agent against each probe response, like
+// an expected status code or a string the body must contain
+type Assertion struct {
+	Type  string `yaml:"type" json:"type"`
+	Value string `yaml:"value" json:"value"`
+}
+
+// AssertionResult is the outcome of an `Assertion` on a probe response
+type AssertionResult struct {
+	Assertion string `json:"assertion"`
+	Passed    bool   `json:"passed"`
+}
+
+// String return a brief representation of the assertion
+func (a Assertion) String() string {
+	return a.Type + " " + a.Value
+}
+
+// Check run the assertion against a response status code and body, an
+// error is returned if the assertion is misconfigured
+func (a Assertion) Check(status int, body string) (bool, error) {
+	switch a.Type {
+	case AssertStatus:
+		code, err := strconv.Atoi(a.Value)
+		if err != nil {
+			return false, fmt.Errorf("assertion %s: %w", a, err)
+		}
+		return status == code, nil
+	case AssertBodyContains:
+		return strings.Contains(body, a.Value), nil
+	case AssertBodyMatches:
+		re, err := regexp.Compile(a.Value)
+		if err != nil {
+			return false, fmt.Errorf("assertion %s: %w", a, err)
+		}
+		return re.MatchString(body), nil
+	}
+	return false, fmt.Errorf("assertion %s: unknown type", a)
+}
@@ -0,0 +1,140 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Collection is a set of resources managed through a REST endpoint, like
+// targets, silences and maintenance windows, adapting a store to
+// `CollectionEndpoint`
+type Collection struct {
+	// Name of a single resource, used in the error messages
+	Name string
+	// Invalid is the error returned by `Add` and `Update` for resources
+	// failing the validation, reported as bad requests
+	Invalid error
+	// Conflict is the error returned by `Add` and `Update` for resources
+	// clashing with the ones stored, reported as conflicts
+	Conflict error
+	// List return the resources matching the query parameters of the
+	// request, if supported
+	List func(url.Values) interface{}
+	// New return a pointer to an empty resource to decode a body into
+	New func() interface{}
+	// Add store a decoded resource, returning its ID
+	Add func(interface{}) (string, error)
+	// Get return a resource, false if not found, optional
+	Get func(string) (interface{}, bool)
+	// Update replace a resource with a decoded one, returning false if not
+	// found, optional
+	Update func(string, interface{}) (bool, error)
+	// Delete remove a resource, returning false if not found
+	Delete func(string) (bool, error)
+}
+
+// fail reply with the HTTP status matching an error of the collection
+func (c Collection) fail(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, c.Invalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, c.Conflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// CollectionEndpoint is the HTTP route to manage a collection of resources
+// under a path prefix:
+//
+// - GET <prefix> list the resources
+// - POST <prefix> create a new resource from a JSON body
+// - GET <prefix>/<id> return a resource, if `Get` is set
+// - PUT <prefix>/<id> replace a resource with a JSON body, if `Update` is set
+// - DELETE <prefix>/<id> remove a resource
+func CollectionEndpoint(prefix string, c Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodGet && id == "":
+			json.NewEncoder(w).Encode(c.List(r.URL.Query()))
+		case r.Method == http.MethodPost && id == "":
+			resource := c.New()
+			if err := json.NewDecoder(r.Body).Decode(resource); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			id, err := c.Add(resource)
+			if err != nil {
+				c.fail(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]string{"id": id})
+		case r.Method == http.MethodGet && id != "" && c.Get != nil:
+			resource, found := c.Get(id)
+			if !found {
+				http.Error(w, c.Name+" not found", http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(resource)
+		case r.Method == http.MethodPut && id != "" && c.Update != nil:
+			resource := c.New()
+			if err := json.NewDecoder(r.Body).Decode(resource); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			found, err := c.Update(id, resource)
+			if err != nil {
+				c.fail(w, err)
+				return
+			} else if !found {
+				http.Error(w, c.Name+" not found", http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(resource)
+		case r.Method == http.MethodDelete && id != "":
+			found, err := c.Delete(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			} else if !found {
+				http.Error(w, c.Name+" not found", http.StatusNotFound)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
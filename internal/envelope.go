@@ -0,0 +1,315 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/codepr/overseer/internal/messaging"
+)
+
+// Every `ServerStatus` and `Stats` is sent on the wire wrapped into an
+// envelope carrying the type of the message, the version of the schema of
+// its payload, the producer and the time of the event. Compatibility rules:
+//
+//   - producers always write the latest version of a schema
+//   - consumers decode every version up to the latest they know, older
+//     versions are converted to the current types by their own decoders
+//   - fields can be added to a version as long as consumers can ignore them,
+//     removing fields or changing their meaning or unit requires a new
+//     version along with its decoder
+//   - messages of a version newer than the latest known are rejected, so
+//     consumers must be upgraded before producers
+//
+// Version 1 is the bare JSON payload sent before the envelope was
+// introduced, response times in nanoseconds. Version 2 is the first one
+// wrapped into the envelope, response times in milliseconds.
+const (
+	ServerStatusMessage = "server_status"
+	StatsMessage        = "stats"
+	ServerStatusVersion = 2
+	StatsVersion        = 2
+)
+
+// ErrUnsupportedVersion is returned decoding a message of a schema version
+// newer than the latest known
+var ErrUnsupportedVersion = errors.New("unsupported schema version")
+
+// EnvelopeHeader is the metadata of an envelope
+type EnvelopeHeader struct {
+	Type      string    `json:"type"`
+	Version   int       `json:"schema_version"`
+	Producer  string    `json:"producer"`
+	EventTime time.Time `json:"event_time"`
+}
+
+// Envelope wraps a payload sent on the wire along with its metadata
+type Envelope struct {
+	EnvelopeHeader
+	Payload interface{} `json:"payload"`
+}
+
+// SchemaVersion return the schema version of the payload, carried in the
+// headers of the messages as well
+func (e Envelope) SchemaVersion() int {
+	return e.Version
+}
+
+// serverStatusV2 is the version 2 of the wire schema of `ServerStatus`
+type serverStatusV2 struct {
+	Url             URL               `json:"url"`
+	Agent           AgentInfo         `json:"agent"`
+	Tags            []string          `json:"tags,omitempty"`
+	Alive           bool              `json:"alive"`
+	ResponseTimeMs  float64           `json:"response_time_ms"`
+	ResponseStatus  int               `json:"response_status"`
+	ResponseContent string            `json:"response_content"`
+	CertExpiry      *time.Time        `json:"cert_expiry,omitempty"`
+	Assertions      []AssertionResult `json:"assertions,omitempty"`
+}
+
+// statsV2 is the version 2 of the wire schema of `Stats`
+type statsV2 struct {
+	Url               URL               `json:"url"`
+	Alive             bool              `json:"alive"`
+	State             string            `json:"state"`
+	Maintenance       string            `json:"maintenance,omitempty"`
+	SLOs              []SLOStatus       `json:"slos,omitempty"`
+	AvgResponseTimeMs float64           `json:"avg_response_time_ms"`
+	Availability      float64           `json:"availability"`
+	StatusCodes       map[int]int       `json:"status_codes"`
+	Locations         []locationStatsV2 `json:"locations,omitempty"`
+	FailingAgents     []string          `json:"failing_agents,omitempty"`
+	OutlierAgent      string            `json:"outlier_agent,omitempty"`
+}
+
+// locationStatsV2 is the version 2 of the wire schema of `LocationStats`
+type locationStatsV2 struct {
+	Agent             string  `json:"agent"`
+	Region            string  `json:"region"`
+	Alive             bool    `json:"alive"`
+	State             string  `json:"state"`
+	Outlier           bool    `json:"outlier"`
+	AvgResponseTimeMs float64 `json:"avg_response_time_ms"`
+	Availability      float64 `json:"availability"`
+}
+
+// milliseconds return a duration in milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// fromMilliseconds return the duration of an amount of milliseconds
+func fromMilliseconds(ms float64) time.Duration {
+	return time.Duration(math.Round(ms * float64(time.Millisecond)))
+}
+
+// NewServerStatusEnvelope wrap a `ServerStatus` into an envelope of the
+// latest version
+func NewServerStatusEnvelope(producer string, eventTime time.Time, s ServerStatus) Envelope {
+	payload := serverStatusV2{
+		Url:             s.Url,
+		Agent:           s.Agent,
+		Tags:            s.Tags,
+		Alive:           s.Alive,
+		ResponseTimeMs:  milliseconds(s.ResponseTime),
+		ResponseStatus:  s.ResponseStatus,
+		ResponseContent: s.ResponseContent,
+		Assertions:      s.Assertions,
+	}
+	if !s.CertExpiry.IsZero() {
+		expiry := s.CertExpiry
+		payload.CertExpiry = &expiry
+	}
+	return Envelope{
+		EnvelopeHeader: EnvelopeHeader{
+			Type:      ServerStatusMessage,
+			Version:   ServerStatusVersion,
+			Producer:  producer,
+			EventTime: eventTime,
+		},
+		Payload: payload,
+	}
+}
+
+// NewStatsEnvelope wrap a `Stats` into an envelope of the latest version
+func NewStatsEnvelope(producer string, eventTime time.Time, s Stats) Envelope {
+	payload := statsV2{
+		Url:               s.Url,
+		Alive:             s.Alive,
+		State:             s.State,
+		Maintenance:       s.Maintenance,
+		SLOs:              s.SLOs,
+		AvgResponseTimeMs: milliseconds(s.AvgResponseTime),
+		Availability:      s.Availability,
+		StatusCodes:       s.StatusCodes,
+		FailingAgents:     s.FailingAgents,
+		OutlierAgent:      s.OutlierAgent,
+	}
+	for _, l := range s.Locations {
+		payload.Locations = append(payload.Locations, locationStatsV2{
+			Agent:             l.Agent,
+			Region:            l.Region,
+			Alive:             l.Alive,
+			State:             l.State,
+			Outlier:           l.Outlier,
+			AvgResponseTimeMs: milliseconds(l.AvgResponseTime),
+			Availability:      l.Availability,
+		})
+	}
+	return Envelope{
+		EnvelopeHeader: EnvelopeHeader{
+			Type:      StatsMessage,
+			Version:   StatsVersion,
+			Producer:  producer,
+			EventTime: eventTime,
+		},
+		Payload: payload,
+	}
+}
+
+// openEnvelope return the codec and the header of the envelope of a message
+// of a type, a bare payload of version 1 has an empty header
+func openEnvelope(msg messaging.Message, messageType string, latest int) (messaging.Codec, EnvelopeHeader, error) {
+	var header EnvelopeHeader
+	codec, err := messaging.CodecFor(msg.Headers.ContentType)
+	if err != nil {
+		return nil, header, err
+	}
+	if err := codec.Unmarshal(msg.Body, &header); err != nil {
+		return nil, header, err
+	}
+	if header.Type == "" && header.Version == 0 {
+		// Version 1, stamped with the metadata of the message, if any
+		header = EnvelopeHeader{
+			Type:      messageType,
+			Version:   1,
+			Producer:  msg.Headers.AgentID,
+			EventTime: msg.Headers.Timestamp,
+		}
+		return codec, header, nil
+	}
+	if header.Type != messageType {
+		return nil, header, fmt.Errorf("unexpected message type %q, expected %q", header.Type, messageType)
+	}
+	if header.Version > latest {
+		return nil, header, fmt.Errorf("%w %d of %s, latest known %d",
+			ErrUnsupportedVersion, header.Version, messageType, latest)
+	}
+	return codec, header, nil
+}
+
+// DecodeServerStatus decode a `ServerStatus` from a message of any known
+// version, return it along with the header of its envelope
+func DecodeServerStatus(msg messaging.Message) (ServerStatus, EnvelopeHeader, error) {
+	var status ServerStatus
+	codec, header, err := openEnvelope(msg, ServerStatusMessage, ServerStatusVersion)
+	if err != nil {
+		return status, header, err
+	}
+	switch header.Version {
+	case 1:
+		err = codec.Unmarshal(msg.Body, &status)
+	case 2:
+		var envelope struct {
+			Payload serverStatusV2 `json:"payload"`
+		}
+		if err = codec.Unmarshal(msg.Body, &envelope); err != nil {
+			break
+		}
+		p := envelope.Payload
+		status = ServerStatus{
+			Url:             p.Url,
+			Agent:           p.Agent,
+			Tags:            p.Tags,
+			Alive:           p.Alive,
+			ResponseTime:    fromMilliseconds(p.ResponseTimeMs),
+			ResponseStatus:  p.ResponseStatus,
+			ResponseContent: p.ResponseContent,
+			Assertions:      p.Assertions,
+		}
+		if p.CertExpiry != nil {
+			// Binary codecs carry instants only, timestamps on the wire
+			// are always UTC
+			status.CertExpiry = p.CertExpiry.UTC()
+		}
+	default:
+		err = fmt.Errorf("%w %d of %s", ErrUnsupportedVersion, header.Version, ServerStatusMessage)
+	}
+	return status, header, err
+}
+
+// DecodeStats decode a `Stats` from a message of any known version, return
+// it along with the header of its envelope
+func DecodeStats(msg messaging.Message) (Stats, EnvelopeHeader, error) {
+	var stats Stats
+	codec, header, err := openEnvelope(msg, StatsMessage, StatsVersion)
+	if err != nil {
+		return stats, header, err
+	}
+	switch header.Version {
+	case 1:
+		err = codec.Unmarshal(msg.Body, &stats)
+	case 2:
+		var envelope struct {
+			Payload statsV2 `json:"payload"`
+		}
+		if err = codec.Unmarshal(msg.Body, &envelope); err != nil {
+			break
+		}
+		p := envelope.Payload
+		stats = Stats{
+			Url:             p.Url,
+			Alive:           p.Alive,
+			State:           p.State,
+			Maintenance:     p.Maintenance,
+			SLOs:            p.SLOs,
+			AvgResponseTime: fromMilliseconds(p.AvgResponseTimeMs),
+			Availability:    p.Availability,
+			StatusCodes:     p.StatusCodes,
+			FailingAgents:   p.FailingAgents,
+			OutlierAgent:    p.OutlierAgent,
+		}
+		for _, l := range p.Locations {
+			stats.Locations = append(stats.Locations, LocationStats{
+				Agent:           l.Agent,
+				Region:          l.Region,
+				Alive:           l.Alive,
+				State:           l.State,
+				Outlier:         l.Outlier,
+				AvgResponseTime: fromMilliseconds(l.AvgResponseTimeMs),
+				Availability:    l.Availability,
+			})
+		}
+	default:
+		err = fmt.Errorf("%w %d of %s", ErrUnsupportedVersion, header.Version, StatsMessage)
+	}
+	return stats, header, err
+}
@@ -0,0 +1,254 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codepr/overseer/internal/messaging"
+)
+
+// Regenerate the golden files of the latest versions with
+// go test ./internal -run Golden -update
+var update = flag.Bool("update", false, "update the golden files of the latest versions")
+
+var (
+	goldenTime   = time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	goldenStatus = ServerStatus{
+		Url:             "https://example.com/health",
+		Agent:           AgentInfo{Name: "agent-1", Region: "eu-west", Labels: map[string]string{"dc": "dc1"}},
+		Tags:            []string{"web"},
+		Alive:           true,
+		ResponseTime:    123456789 * time.Nanosecond,
+		ResponseStatus:  200,
+		ResponseContent: "ok",
+		CertExpiry:      time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		Assertions:      []AssertionResult{{Assertion: "status 200", Passed: true}},
+	}
+	goldenStats = Stats{
+		Url:   "https://example.com/health",
+		Alive: false,
+		State: "down",
+		SLOs: []SLOStatus{{Name: "availability", Objective: 99.9, Attainment: 99.5,
+			ErrorBudgetRemaining: -4, BurnRates: map[string]float64{"1h": 5}}},
+		AvgResponseTime: 250 * time.Millisecond,
+		Availability:    99.5,
+		StatusCodes:     map[int]int{200: 199, 503: 1},
+		Locations: []LocationStats{
+			{Agent: "agent-1", Region: "eu-west", Alive: false, State: "down",
+				AvgResponseTime: 300 * time.Millisecond, Availability: 99},
+			{Agent: "agent-2", Region: "us-east", Alive: false, State: "down",
+				AvgResponseTime: 200 * time.Millisecond, Availability: 100},
+		},
+		FailingAgents: []string{"agent-1", "agent-2"},
+	}
+)
+
+// golden return the content of a golden file, written first from `v` if
+// updating
+func golden(t *testing.T, name string, v interface{}) []byte {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update && v != nil {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func jsonMessage(body []byte) messaging.Message {
+	return messaging.Message{Body: body, Headers: messaging.Headers{ContentType: "application/json"}}
+}
+
+func TestServerStatusGolden(t *testing.T) {
+	latest := NewServerStatusEnvelope("agent-1", goldenTime, goldenStatus)
+	// The latest version must encode exactly as its golden file
+	encoded, _ := json.MarshalIndent(latest, "", "  ")
+	if expected := golden(t, "server_status_v2.json", latest); string(expected) != string(encoded)+"\n" {
+		t.Errorf("NewServerStatusEnvelope failed: expected\n%s\ngot\n%s\n", expected, encoded)
+	}
+
+	var tests = []struct {
+		name   string
+		msg    messaging.Message
+		header EnvelopeHeader
+	}{
+		{"v1", messaging.Message{
+			Body:    golden(t, "server_status_v1.json", nil),
+			Headers: messaging.Headers{ContentType: "text/plain", AgentID: "agent-1", Timestamp: goldenTime},
+		}, EnvelopeHeader{ServerStatusMessage, 1, "agent-1", goldenTime}},
+		{"v2", jsonMessage(golden(t, "server_status_v2.json", nil)),
+			EnvelopeHeader{ServerStatusMessage, 2, "agent-1", goldenTime}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, header, err := DecodeServerStatus(tt.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(status, goldenStatus) {
+				t.Errorf("DecodeServerStatus failed: expected %v got %v\n", goldenStatus, status)
+			}
+			if header != tt.header {
+				t.Errorf("DecodeServerStatus failed: expected %v got %v\n", tt.header, header)
+			}
+		})
+	}
+}
+
+func TestStatsGolden(t *testing.T) {
+	latest := NewStatsEnvelope("aggregator-1", goldenTime, goldenStats)
+	encoded, _ := json.MarshalIndent(latest, "", "  ")
+	if expected := golden(t, "stats_v2.json", latest); string(expected) != string(encoded)+"\n" {
+		t.Errorf("NewStatsEnvelope failed: expected\n%s\ngot\n%s\n", expected, encoded)
+	}
+
+	for _, name := range []string{"stats_v1.json", "stats_v2.json"} {
+		stats, _, err := DecodeStats(jsonMessage(golden(t, name, nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(stats, goldenStats) {
+			t.Errorf("DecodeStats %s failed: expected %v got %v\n", name, goldenStats, stats)
+		}
+	}
+}
+
+func TestDecodeIncompatible(t *testing.T) {
+	newer := []byte(`{"type": "server_status", "schema_version": 3, "payload": {}}`)
+	if _, _, err := DecodeServerStatus(jsonMessage(newer)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("DecodeServerStatus failed: expected %v got %v\n", ErrUnsupportedVersion, err)
+	}
+	stats := golden(t, "stats_v2.json", nil)
+	if _, _, err := DecodeServerStatus(jsonMessage(stats)); err == nil {
+		t.Errorf("DecodeServerStatus failed: expected an error decoding stats\n")
+	}
+}
+
+func TestEnvelopeCodecs(t *testing.T) {
+	for _, codec := range []messaging.Codec{messaging.JSON, messaging.MsgPack} {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			msg, err := messaging.Encode(codec, "agent-1",
+				NewServerStatusEnvelope("agent-1", goldenTime, goldenStatus))
+			if err != nil {
+				t.Fatal(err)
+			}
+			status, header, err := DecodeServerStatus(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(status, goldenStatus) {
+				t.Errorf("DecodeServerStatus failed: expected %v got %v\n", goldenStatus, status)
+			}
+			if header.Version != ServerStatusVersion || !header.EventTime.Equal(goldenTime) {
+				t.Errorf("DecodeServerStatus failed: unexpected header %v\n", header)
+			}
+
+			msg, err = messaging.Encode(codec, "aggregator-1",
+				NewStatsEnvelope("aggregator-1", goldenTime, goldenStats))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stats, _, err := DecodeStats(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(stats, goldenStats) {
+				t.Errorf("DecodeStats failed: expected %v got %v\n", goldenStats, stats)
+			}
+		})
+	}
+}
+
+// benchmarkStatus carry a response body of a realistic size, as it usually
+// dominates the encoding cost
+func benchmarkStatus() ServerStatus {
+	status := goldenStatus
+	status.ResponseContent = strings.Repeat(`{"status": "ok", "checks": [1, 2, 3]} `, 64)
+	return status
+}
+
+func BenchmarkEncodeServerStatus(b *testing.B) {
+	envelope := NewServerStatusEnvelope("agent-1", goldenTime, benchmarkStatus())
+	for _, codec := range []messaging.Codec{messaging.JSON, messaging.MsgPack} {
+		b.Run(codec.ContentType(), func(b *testing.B) {
+			var msg messaging.Message
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				msg, _ = messaging.Encode(codec, "agent-1", envelope)
+			}
+			b.ReportMetric(float64(len(msg.Body)), "bytes/msg")
+		})
+	}
+}
+
+func BenchmarkDecodeServerStatus(b *testing.B) {
+	envelope := NewServerStatusEnvelope("agent-1", goldenTime, benchmarkStatus())
+	for _, codec := range []messaging.Codec{messaging.JSON, messaging.MsgPack} {
+		b.Run(codec.ContentType(), func(b *testing.B) {
+			msg, _ := messaging.Encode(codec, "agent-1", envelope)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(msg.Body)))
+			for i := 0; i < b.N; i++ {
+				if _, _, err := DecodeServerStatus(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeStats(b *testing.B) {
+	envelope := NewStatsEnvelope("aggregator-1", goldenTime, goldenStats)
+	for _, codec := range []messaging.Codec{messaging.JSON, messaging.MsgPack} {
+		b.Run(codec.ContentType(), func(b *testing.B) {
+			var msg messaging.Message
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				msg, _ = messaging.Encode(codec, "aggregator-1", envelope)
+			}
+			b.ReportMetric(float64(len(msg.Body)), "bytes/msg")
+		})
+	}
+}
@@ -0,0 +1,222 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package internal
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codepr/overseer/internal/messaging"
+)
+
+// Heartbeat is the message broadcast by each member of a pool of services
+// to announce itself to the others, `Group` scopes the pool, e.g. the region
+// of an agent, `Leaving` is set on graceful shutdown to trigger an immediate
+// rebalance
+type Heartbeat struct {
+	Name    string `json:"name"`
+	Group   string `json:"group"`
+	Leaving bool   `json:"leaving,omitempty"`
+}
+
+// peer is a member of the pool, tracking when it has been heard of the first
+// and the last time
+type peer struct {
+	joined time.Time
+	seen   time.Time
+}
+
+// Membership tracks the members of a pool of services through their
+// heartbeats and the consistent hash ring spreading the work among them.
+//
+// Every member joining the pool spends a warm-up period, the time for a
+// peer to expire, listening for the others: meanwhile its ring is made of
+// itself and the peers heard of so far, doing some of their work twice
+// rather than dropping any, members that can't afford it wait for the
+// warm-up to end. The peers heard of during the warm-up are members of its
+// ring from then on. The others add it to their ring once
+// the same period has elapsed since its first heartbeat, so that all the
+// members, receiving the same heartbeats, switch to the new ring at the same
+// time, handing off the work without doing it twice or dropping it.
+// Likewise, peers leaving are removed as soon as their leave heartbeat is
+// received and crashed peers once they expire, after three heartbeats.
+type Membership struct {
+	self    string
+	group   string
+	ttl     time.Duration
+	started time.Time
+	peers   map[string]peer
+	ring    *HashRing
+	mutex   sync.Mutex
+}
+
+// NewMembership create a new `Membership` of a group with the member itself
+// as its only member, heartbeats are expected once every `heartbeat`
+func NewMembership(self, group string, heartbeat time.Duration, now time.Time) *Membership {
+	return &Membership{
+		self:    self,
+		group:   group,
+		ttl:     3 * heartbeat,
+		started: now,
+		peers:   make(map[string]peer),
+	}
+}
+
+// Heartbeat return the heartbeat announcing the member to the pool
+func (m *Membership) Heartbeat(leaving bool) Heartbeat {
+	return Heartbeat{Name: m.self, Group: m.group, Leaving: leaving}
+}
+
+// Observe update the members of the pool with an heartbeat received,
+// heartbeats from other groups are ignored
+func (m *Membership) Observe(hb Heartbeat, now time.Time) {
+	if hb.Group != m.group || hb.Name == m.self {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if hb.Leaving {
+		delete(m.peers, hb.Name)
+		return
+	}
+	p, known := m.peers[hb.Name]
+	if !known {
+		p.joined = now
+		// Peers heard of while warming up were already there
+		if m.WarmingUp(now) {
+			p.joined = m.started
+		}
+	}
+	p.seen = now
+	m.peers[hb.Name] = p
+}
+
+// Ring return the hash ring of the members of the pool, made of the member
+// itself and the peers heard of so far while still warming up, the second
+// value is true if the ring has been rebuilt since the last call
+func (m *Membership) Ring(now time.Time) (*HashRing, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	warmingUp := m.WarmingUp(now)
+	members := []string{m.self}
+	for name, p := range m.peers {
+		if now.Sub(p.seen) > m.ttl {
+			delete(m.peers, name)
+			continue
+		}
+		if warmingUp || now.Sub(p.joined) >= m.ttl {
+			members = append(members, name)
+		}
+	}
+	sort.Strings(members)
+	rebuilt := false
+	if m.ring == nil || !equal(m.ring.Members(), members) {
+		m.ring = NewHashRing(DefaultReplicas, members...)
+		rebuilt = true
+	}
+	return m.ring, rebuilt
+}
+
+// WarmingUp return true if the member is still listening for the other
+// members of the pool
+func (m *Membership) WarmingUp(now time.Time) bool {
+	return now.Sub(m.started) < m.ttl
+}
+
+// Join start broadcasting heartbeats on a topic once every `heartbeat`
+// until the context is cancelled, tracking the heartbeats of the other
+// members of the pool
+func (m *Membership) Join(ctx context.Context, broadcaster messaging.Broadcaster,
+	topic string, heartbeat time.Duration, logger *log.Logger) {
+	heartbeats := make(chan messaging.Delivery)
+	go func() {
+		if err := broadcaster.Subscribe(ctx, topic, heartbeats); err != nil {
+			logger.Println("Error subscribing to the pool:", err)
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case d := <-heartbeats:
+				var hb Heartbeat
+				if err := d.Decode(&hb); err != nil {
+					logger.Println("Error decoding heartbeat")
+					continue
+				}
+				m.Observe(hb, time.Now())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		for {
+			msg, _ := messaging.Encode(messaging.JSON, m.self, m.Heartbeat(false))
+			if err := broadcaster.Publish(ctx, topic, msg); err != nil {
+				logger.Println("Error publishing heartbeat")
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Leave announce to the pool that the member is shutting down, letting the
+// others take over its work without waiting for it to expire
+func (m *Membership) Leave(ctx context.Context, broadcaster messaging.Broadcaster, topic string) error {
+	msg, err := messaging.Encode(messaging.JSON, m.self, m.Heartbeat(true))
+	if err != nil {
+		return err
+	}
+	return broadcaster.Publish(ctx, topic, msg)
+}
+
+// Owns return true if the member owns a key on a ring
+func (m *Membership) Owns(ring *HashRing, key string) bool {
+	return ring != nil && ring.Owner(key) == m.self
+}
+
+// equal return true if two sorted lists of members are the same
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,197 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package messaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// DefaultSchemaVersion is the schema version of the messages encoded by
+// values not declaring one
+const DefaultSchemaVersion = 1
+
+// Headers are the metadata carried by every message: the content type of
+// the body, selecting the codec to decode it, the version of the schema of
+// the value encoded, the id of the agent, or service instance, producing it
+// and the time it was produced. Key, if set, routes the message by the
+// transports keeping order per key, e.g. Kafka delivers the messages with
+// the same key from the same partition, in order.
+type Headers struct {
+	ContentType   string    `json:"content_type"`
+	SchemaVersion int       `json:"schema_version"`
+	AgentID       string    `json:"agent_id,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+	Key           string    `json:"key,omitempty"`
+}
+
+// Message is a message carried by a message queue, a body encoded by a
+// codec along with its headers
+type Message struct {
+	Body    []byte  `json:"body"`
+	Headers Headers `json:"headers"`
+}
+
+// Decode decode the body of a message into a value, through the codec of
+// its content type
+func (m Message) Decode(v interface{}) error {
+	codec, err := CodecFor(m.Headers.ContentType)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(m.Body, v)
+}
+
+// Codec encodes and decodes the values carried by the messages, identified
+// by the content type of the messages it produces
+type Codec interface {
+	ContentType() string
+	Marshal(interface{}) ([]byte, error)
+	Unmarshal([]byte, interface{}) error
+}
+
+// Versioned is implemented by values declaring the version of their
+// schema, carried in the headers of the messages encoding them
+type Versioned interface {
+	SchemaVersion() int
+}
+
+// jsonCodec is the JSON `Codec`
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string                        { return "application/json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// msgpackCodec is the MessagePack `Codec`, fields are named after their
+// JSON tags, to encode the same values as the JSON codec
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string { return "application/x-msgpack" }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+var (
+	// JSON is the default codec, encoding values as JSON
+	JSON Codec = jsonCodec{}
+	// MsgPack is a compact binary codec, encoding values as MessagePack
+	MsgPack Codec = msgpackCodec{}
+)
+
+var (
+	codecsMutex sync.RWMutex
+	// Messages without a content type, or produced as plain text before
+	// the codecs were introduced, carry JSON
+	codecs = map[string]Codec{
+		JSON.ContentType():    JSON,
+		MsgPack.ContentType(): MsgPack,
+		"":                    JSON,
+		"text/plain":          JSON,
+	}
+	// Codecs selectable by name in the configuration of the producers
+	codecNames = map[string]Codec{
+		"json":    JSON,
+		"msgpack": MsgPack,
+	}
+)
+
+// RegisterCodec make a codec available to decode the messages of its
+// content type
+func RegisterCodec(codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	codecs[codec.ContentType()] = codec
+}
+
+// CodecByName return the codec selected by name in the configuration, JSON
+// if empty
+func CodecByName(name string) (Codec, error) {
+	if name == "" {
+		return JSON, nil
+	}
+	codec, ok := codecNames[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return codec, nil
+}
+
+// CodecFor return the codec registered for a content type, consumers pick
+// the codec to decode each message through its content type header, thus
+// producers can switch codec without coordination
+func CodecFor(contentType string) (Codec, error) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	codec, ok := codecs[contentType]
+	if !ok {
+		return nil, fmt.Errorf("no codec registered for content type %q", contentType)
+	}
+	return codec, nil
+}
+
+// Encode encode a value into a message through a codec, stamping it with
+// the id of the agent producing it, the schema version of the value and the
+// current time
+func Encode(codec Codec, agentID string, v interface{}) (Message, error) {
+	body, err := codec.Marshal(v)
+	if err != nil {
+		return Message{}, err
+	}
+	version := DefaultSchemaVersion
+	if versioned, ok := v.(Versioned); ok {
+		version = versioned.SchemaVersion()
+	}
+	return Message{
+		Body: body,
+		Headers: Headers{
+			ContentType:   codec.ContentType(),
+			SchemaVersion: version,
+			AgentID:       agentID,
+			Timestamp:     time.Now(),
+		},
+	}, nil
+}
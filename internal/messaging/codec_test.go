@@ -0,0 +1,98 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package messaging
+
+import (
+	"testing"
+	"time"
+)
+
+type sample struct {
+	Url   string `json:"url"`
+	Alive bool   `json:"alive"`
+}
+
+type versionedSample struct {
+	sample
+}
+
+func (versionedSample) SchemaVersion() int { return 2 }
+
+func TestEncodeDecode(t *testing.T) {
+	before := time.Now()
+	msg, err := Encode(JSON, "agent-1", sample{"http://example.com", true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Headers.ContentType != "application/json" || msg.Headers.AgentID != "agent-1" ||
+		msg.Headers.SchemaVersion != DefaultSchemaVersion || msg.Headers.Timestamp.Before(before) {
+		t.Errorf("Encode failed: unexpected headers %v\n", msg.Headers)
+	}
+	var s sample
+	if err := NewDelivery(msg, 1, nil).Decode(&s); err != nil || s.Url != "http://example.com" || !s.Alive {
+		t.Errorf("Decode failed: expected %v got %v (%v)\n", sample{"http://example.com", true}, s, err)
+	}
+
+	msg, _ = Encode(JSON, "agent-1", versionedSample{})
+	if msg.Headers.SchemaVersion != 2 {
+		t.Errorf("Encode failed: expected schema version 2 got %d\n", msg.Headers.SchemaVersion)
+	}
+
+	// Messages produced before the codecs were introduced carry JSON as
+	// plain text
+	legacy := Message{Body: []byte(`{"url": "http://legacy"}`), Headers: Headers{ContentType: "text/plain"}}
+	if err := legacy.Decode(&s); err != nil || s.Url != "http://legacy" {
+		t.Errorf("Decode failed: expected http://legacy got %v (%v)\n", s.Url, err)
+	}
+	unknown := Message{Body: []byte{0x80}, Headers: Headers{ContentType: "application/unknown"}}
+	if err := unknown.Decode(&s); err == nil {
+		t.Errorf("Decode failed: expected an error for an unknown content type\n")
+	}
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	codec, err := CodecByName("msgpack")
+	if err != nil || codec != MsgPack {
+		t.Errorf("CodecByName failed: expected %v got %v (%v)\n", MsgPack, codec, err)
+	}
+	if _, err := CodecByName("xml"); err == nil {
+		t.Errorf("CodecByName failed: expected an error for an unknown codec\n")
+	}
+	msg, err := Encode(MsgPack, "agent-1", sample{"http://example.com", true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Headers.ContentType != "application/x-msgpack" {
+		t.Errorf("Encode failed: expected application/x-msgpack got %s\n", msg.Headers.ContentType)
+	}
+	// The consumer pick the codec from the content type, whatever its own
+	// configuration
+	var s sample
+	if err := msg.Decode(&s); err != nil || s.Url != "http://example.com" || !s.Alive {
+		t.Errorf("Decode failed: expected %v got %v (%v)\n", sample{"http://example.com", true}, s, err)
+	}
+}
@@ -0,0 +1,232 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package messaging
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrNacked is returned when the broker refuses to take charge of a message
+// published
+var ErrNacked = errors.New("message nacked by the broker")
+
+// ConfirmStats are the counters of the messages published in confirm mode,
+// `Returned` are the messages confirmed but not routed to any queue, thus
+// dropped, `Outstanding` those not yet confirmed
+type ConfirmStats struct {
+	Published   uint64
+	Confirmed   uint64
+	Nacked      uint64
+	Returned    uint64
+	Outstanding uint64
+}
+
+// ConfirmReporter is implemented by the message queues tracking the
+// confirmation of the messages published
+type ConfirmReporter interface {
+	ConfirmStats() ConfirmStats
+}
+
+// ReportConfirms log the confirm counters of a message queue once every
+// interval, until the context is cancelled, nothing is logged if the
+// message queue doesn't track them
+func ReportConfirms(ctx context.Context, mq MessageQueue,
+	interval time.Duration, logger *log.Logger) {
+	reporter, ok := mq.(ConfirmReporter)
+	if !ok {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s := reporter.ConfirmStats()
+			logger.Printf("Published %d confirmed %d nacked %d returned %d outstanding %d\n",
+				s.Published, s.Confirmed, s.Nacked, s.Returned, s.Outstanding)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// confirms tracks the messages published in confirm mode on a channel,
+// resolved asynchronously as the broker confirms them. Delivery tags are
+// sequential, starting from 1, in the order of publishing.
+type confirms struct {
+	publishing sync.Mutex
+	mutex      sync.Mutex
+	next       uint64
+	pending    map[uint64]chan error
+	err        error
+	stats      ConfirmStats
+}
+
+// newConfirms return a tracker for a channel just put in confirm mode
+func newConfirms() *confirms {
+	return &confirms{next: 1, pending: make(map[uint64]chan error)}
+}
+
+// publish track a message published by calling `publish`, return a channel
+// receiving nil once it's confirmed, `ErrNacked` if it's refused, or an
+// error if the channel closed before. The message is tracked before being
+// published as it may be confirmed before `publish` returns, publishings
+// are serialized to keep the delivery tags in order.
+func (c *confirms) publish(publish func() error) (<-chan error, error) {
+	c.publishing.Lock()
+	defer c.publishing.Unlock()
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return nil, c.err
+	}
+	tag, done := c.next, make(chan error, 1)
+	c.pending[tag] = done
+	c.next++
+	c.mutex.Unlock()
+
+	err := publish()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err != nil {
+		// Not published, the tag goes to the next message
+		delete(c.pending, tag)
+		c.next--
+		return nil, err
+	}
+	c.stats.Published++
+	return done, nil
+}
+
+// confirm resolve the message of a confirmation
+func (c *confirms) confirm(confirmation amqp.Confirmation) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	done, ok := c.pending[confirmation.DeliveryTag]
+	if !ok {
+		return
+	}
+	delete(c.pending, confirmation.DeliveryTag)
+	if confirmation.Ack {
+		c.stats.Confirmed++
+		done <- nil
+	} else {
+		c.stats.Nacked++
+		done <- ErrNacked
+	}
+}
+
+// returned count a message returned as unroutable
+func (c *confirms) returned() {
+	c.mutex.Lock()
+	c.stats.Returned++
+	c.mutex.Unlock()
+}
+
+// close fail every message still outstanding, and those published later,
+// with an error
+func (c *confirms) close(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.err = err
+	for tag, done := range c.pending {
+		delete(c.pending, tag)
+		done <- err
+	}
+}
+
+// listen resolve the confirmations and count the returns of a channel until
+// it's closed, then fail the messages still outstanding
+func (c *confirms) listen(confirmations <-chan amqp.Confirmation, returns <-chan amqp.Return) {
+	for {
+		select {
+		case confirmation, ok := <-confirmations:
+			if !ok {
+				c.close(ErrRabbitMq)
+				return
+			}
+			c.confirm(confirmation)
+		case _, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			c.returned()
+		}
+	}
+}
+
+// Stats return the current confirm counters
+func (c *confirms) Stats() ConfirmStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Outstanding = uint64(len(c.pending))
+	return stats
+}
+
+// outgoing is a message to be published to a queue, or with a routing key
+type outgoing struct {
+	name string
+	msg  Message
+}
+
+// batch buffers the messages produced until they're flushed, once `size`
+// messages are buffered or on time
+type batch struct {
+	mutex    sync.Mutex
+	size     int
+	messages []outgoing
+}
+
+// add buffer a message, return the messages to flush once the batch is full
+func (b *batch) add(name string, msg Message) []outgoing {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.messages = append(b.messages, outgoing{name, msg})
+	if len(b.messages) < b.size {
+		return nil
+	}
+	messages := b.messages
+	b.messages = nil
+	return messages
+}
+
+// take return the messages buffered, emptying the batch
+func (b *batch) take() []outgoing {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	messages := b.messages
+	b.messages = nil
+	return messages
+}
@@ -0,0 +1,110 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package messaging
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestConfirms(t *testing.T) {
+	c := newConfirms()
+	var outcomes []<-chan error
+	for i := 0; i < 3; i++ {
+		done, err := c.publish(func() error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		outcomes = append(outcomes, done)
+	}
+	// A message not published doesn't take a delivery tag
+	failed := errors.New("channel closed")
+	if _, err := c.publish(func() error { return failed }); err != failed {
+		t.Errorf("publish failed: expected %v got %v\n", failed, err)
+	}
+	confirmations := make(chan amqp.Confirmation, 2)
+	confirmations <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	confirmations <- amqp.Confirmation{DeliveryTag: 2, Ack: false}
+	c.returned()
+	done := make(chan struct{})
+	go func() {
+		c.listen(confirmations, nil)
+		close(done)
+	}()
+	if err := <-outcomes[0]; err != nil {
+		t.Errorf("confirm failed: expected nil got %v\n", err)
+	}
+	if err := <-outcomes[1]; err != ErrNacked {
+		t.Errorf("confirm failed: expected %v got %v\n", ErrNacked, err)
+	}
+	// Closing the channel fails the messages outstanding
+	close(confirmations)
+	<-done
+	if err := <-outcomes[2]; err != ErrRabbitMq {
+		t.Errorf("confirm failed: expected %v got %v\n", ErrRabbitMq, err)
+	}
+	if _, err := c.publish(func() error { return nil }); err != ErrRabbitMq {
+		t.Errorf("publish failed: expected %v got %v\n", ErrRabbitMq, err)
+	}
+	expected := ConfirmStats{Published: 3, Confirmed: 1, Nacked: 1, Returned: 1}
+	if stats := c.Stats(); stats != expected {
+		t.Errorf("Stats failed: expected %+v got %+v\n", expected, stats)
+	}
+}
+
+func TestConfirmsOutstanding(t *testing.T) {
+	c := newConfirms()
+	for i := 0; i < 2; i++ {
+		c.publish(func() error { return nil })
+	}
+	c.confirm(amqp.Confirmation{DeliveryTag: 2, Ack: true})
+	expected := ConfirmStats{Published: 2, Confirmed: 1, Outstanding: 1}
+	if stats := c.Stats(); stats != expected {
+		t.Errorf("Stats failed: expected %+v got %+v\n", expected, stats)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	b := &batch{size: 3}
+	for i := 0; i < 2; i++ {
+		if messages := b.add("urlstatus", Message{}); messages != nil {
+			t.Errorf("add failed: expected no flush got %d messages\n", len(messages))
+		}
+	}
+	if messages := b.add("stats", Message{}); len(messages) != 3 {
+		t.Errorf("add failed: expected 3 messages got %d\n", len(messages))
+	}
+	if messages := b.take(); len(messages) != 0 {
+		t.Errorf("take failed: expected 0 messages got %d\n", len(messages))
+	}
+	b.add("urlstatus", Message{})
+	if messages := b.take(); len(messages) != 1 || messages[0].name != "urlstatus" {
+		t.Errorf("take failed: expected 1 message to urlstatus got %v\n", messages)
+	}
+}
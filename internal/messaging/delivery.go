@@ -0,0 +1,99 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package messaging
+
+import "time"
+
+// DefaultMaxAttempts is the number of times a message is delivered before
+// being dead-lettered, unless configured otherwise
+const DefaultMaxAttempts = 5
+
+// Acknowledger settles a delivery with the message queue it was consumed
+// from
+type Acknowledger interface {
+	Ack() error
+	Nack(requeue bool, reason error) error
+}
+
+// Delivery is a message consumed from a queue, it must be settled once
+// processed: acknowledged with `Ack`, or rejected with `Nack` to have it
+// delivered again, up to a bounded number of attempts, or moved to the
+// dead-letter queue of the queue it was consumed from. Attempts is the
+// number of times the message has been delivered, 1 on the first one.
+type Delivery struct {
+	Message
+	Attempts int
+	acker    Acknowledger
+}
+
+// NewDelivery create a new `Delivery` settled through an `Acknowledger`, a
+// nil one settles nothing
+func NewDelivery(msg Message, attempts int, acker Acknowledger) Delivery {
+	return Delivery{Message: msg, Attempts: attempts, acker: acker}
+}
+
+// Ack acknowledge the message as processed, removing it from the queue
+func (d Delivery) Ack() error {
+	if d.acker == nil {
+		return nil
+	}
+	return d.acker.Ack()
+}
+
+// Nack reject the message for a reason, with requeue set the message is
+// delivered again unless it reached the maximum number of attempts,
+// otherwise it's moved straight to the dead-letter queue, e.g. a message
+// that can't be decoded
+func (d Delivery) Nack(requeue bool, reason error) error {
+	if d.acker == nil {
+		return nil
+	}
+	return d.acker.Nack(requeue, reason)
+}
+
+// DeadLetter is a message moved to a dead-letter queue, along with the
+// queue it was consumed from and the reason of the last rejection
+type DeadLetter struct {
+	Message
+	Queue    string    `json:"queue"`
+	Attempts int       `json:"attempts"`
+	Reason   string    `json:"reason"`
+	DeadAt   time.Time `json:"dead_at"`
+}
+
+// DeadLetterQueue defines the behavior of a message queue able to inspect
+// the messages dead-lettered from a queue and to replay them, moving them
+// back to the queue, up to `limit` messages, all of them if not positive.
+type DeadLetterQueue interface {
+	DeadLetters(queue string, limit int) ([]DeadLetter, error)
+	Replay(queue string, limit int) (int, error)
+}
+
+// DeadLetterQueueName return the name of the dead-letter queue of a queue
+func DeadLetterQueueName(queue string) string {
+	return queue + ".dead"
+}
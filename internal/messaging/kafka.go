@@ -0,0 +1,664 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package messaging
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+const (
+	// kafkaRepublishAttempts is the number of times a message dead-lettered
+	// is tried to be published to the dead-letter topic before giving up
+	kafkaRepublishAttempts = 3
+	// kafkaRepublishDelay is the delay before the first retry, doubling on
+	// every following one
+	kafkaRepublishDelay = 100 * time.Millisecond
+	// kafkaReadTimeout is the longest a dead-letter topic is waited for the
+	// messages before the newest offset before giving up reading it
+	kafkaReadTimeout = time.Second
+)
+
+// ConnectKafka create a client connected to a Kafka cluster, the URL lists
+// the brokers to bootstrap from separated by commas, e.g.
+// kafka://broker-1:9092,broker-2:9092, returning it into a pointer to a
+// `KafkaQueue` object. The connections are secured by TLS once a CA bundle
+// or a client certificate is set, credentials authenticate through SASL
+// PLAIN.
+func ConnectKafka(rawurl string, opts ...option) (*KafkaQueue, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	brokers := strings.Split(u.Host, ",")
+	options := newOptions(opts)
+	config := kafkaConfig()
+	tlsConfig, err := options.security.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+	username, password, err := options.security.credentials(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if password != "" {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = username
+		config.Net.SASL.Password = password
+	}
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		producer.Close()
+		client.Close()
+		return nil, err
+	}
+	return &KafkaQueue{
+		client:   client,
+		producer: producer,
+		consumer: consumer,
+		// Consumer groups can't share a client
+		newGroup: func(group string) (sarama.ConsumerGroup, error) {
+			return sarama.NewConsumerGroup(brokers, group, config)
+		},
+		newOffsets: func(group string) (sarama.OffsetManager, error) {
+			return sarama.NewOffsetManagerFromClient(group, client)
+		},
+		options: options,
+		closing: make(chan struct{}),
+	}, nil
+}
+
+// kafkaConfig return the configuration of the Kafka clients, messages are
+// partitioned by the hash of their key, consumer groups start from the
+// oldest message when they have no offset committed
+func kafkaConfig() *sarama.Config {
+	config := sarama.NewConfig()
+	// Record headers are supported since 0.11
+	config.Version = sarama.V2_0_0_0
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	return config
+}
+
+// KafkaQueue is a `MessageQueue` backed by Kafka. Messages are partitioned
+// by key, thus messages with the same key are consumed in order. Each queue
+// is a topic consumed through a consumer group, named after the queue
+// unless set with `Group`, which commits the offsets of the messages
+// settled; the messages not settled by a consumer going away are consumed
+// again. Messages dead-lettered are published to the dead-letter topic of
+// the queue, the ones replayed are tracked by the offsets of a consumer
+// group named after it. Topics to broadcast to are consumed from the newest
+// message by every subscriber, without a consumer group.
+type KafkaQueue struct {
+	client     sarama.Client
+	producer   sarama.SyncProducer
+	consumer   sarama.Consumer
+	newGroup   func(string) (sarama.ConsumerGroup, error)
+	newOffsets func(string) (sarama.OffsetManager, error)
+	options    *options
+	mutex      sync.Mutex
+	closed     bool
+	closing    chan struct{}
+	consumers  sync.WaitGroup
+}
+
+// Close the connection with Kafka, stopping the consumers and waiting for
+// the deliveries in flight to be settled, up to the drain timeout, then
+// closing the producer and the client
+func (q *KafkaQueue) Close() error {
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.closing)
+	q.mutex.Unlock()
+
+	q.consumers.Wait()
+	err := q.producer.Close()
+	if cerr := q.consumer.Close(); err == nil {
+		err = cerr
+	}
+	if q.client != nil {
+		if cerr := q.client.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// addConsumer register a consumer to be waited for on close, false if the
+// queue is closed
+func (q *KafkaQueue) addConsumer() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return false
+	}
+	q.consumers.Add(1)
+	return true
+}
+
+// Produce publish a message to a topic, on the partition of its key, waiting
+// for it to be stored
+func (q *KafkaQueue) Produce(ctx context.Context, topic string, msg Message) error {
+	return q.send(ctx, kafkaMessage(topic, msg))
+}
+
+// send publish a Kafka message waiting for it to be stored or the context
+// to be done, whichever comes first; the producer can't be interrupted, a
+// message given up on may still be stored afterwards
+func (q *KafkaQueue) send(ctx context.Context, m *sarama.ProducerMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sent := make(chan error, 1)
+	go func() {
+		_, _, err := q.producer.SendMessage(m)
+		sent <- err
+	}()
+	select {
+	case err := <-sent:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Consume join the consumer group of a topic and block handing out the
+// messages of the partitions assigned until the context is cancelled or
+// the queue closed, a concurrency value can be set to consume multiple
+// messages at once, that is the number of deliveries not yet settled across
+// the partitions, each of them hands out a message at a time.
+// Before returning, the deliveries handed out are given time to be settled,
+// those not settled are consumed again by the group.
+func (q *KafkaQueue) Consume(ctx context.Context, topic string,
+	concurrency int, itemChan chan<- Delivery) error {
+	if !q.addConsumer() {
+		return ErrClosed
+	}
+	defer q.consumers.Done()
+
+	group, err := q.newGroup(q.options.groupFor(topic))
+	if err != nil {
+		return err
+	}
+	defer group.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-q.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	handler := &kafkaHandler{
+		queue:    q,
+		itemChan: itemChan,
+		slots:    make(chan struct{}, concurrency),
+	}
+	// Each session ends on a rebalance, a new one gets the partitions
+	// assigned then
+	for ctx.Err() == nil {
+		if err := group.Consume(ctx, []string{topic}, handler); err != nil && ctx.Err() == nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kafkaHandler hands out the messages of the partitions claimed by a
+// consumer group session
+type kafkaHandler struct {
+	queue    *KafkaQueue
+	itemChan chan<- Delivery
+	slots    chan struct{}
+	inflight sync.WaitGroup
+}
+
+// Setup is run at the beginning of a new session
+func (h *kafkaHandler) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// Cleanup is run at the end of a session, before the offsets marked are
+// committed for the last time, the deliveries in flight are given time to
+// be settled
+func (h *kafkaHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	drain(&h.inflight, h.queue.options.drainTimeout)
+	return nil
+}
+
+// ConsumeClaim hand out the messages of a partition in order, one at a
+// time: a message is handed out once the previous one is settled, so that
+// a message rejected to be requeued is delivered again in place, before the
+// following ones, keeping the messages of a key in order. The offset of a
+// message is committed once it's acknowledged or dead-lettered.
+func (h *kafkaHandler) ConsumeClaim(session sarama.ConsumerGroupSession,
+	claim sarama.ConsumerGroupClaim) error {
+	done := session.Context().Done()
+	for {
+		var m *sarama.ConsumerMessage
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			m = msg
+		case <-done:
+			return nil
+		}
+		// Settling the message return the attempt to deliver it again at,
+		// 0 once done with it
+		for attempts := 1; attempts > 0; {
+			select {
+			case h.slots <- struct{}{}:
+			case <-done:
+				return nil
+			}
+			h.inflight.Add(1)
+			next := make(chan int, 1)
+			settled := func(again int) {
+				if again == 0 {
+					session.MarkOffset(m.Topic, m.Partition, m.Offset+1, "")
+				}
+				<-h.slots
+				h.inflight.Done()
+				next <- again
+			}
+			select {
+			case h.itemChan <- h.queue.delivery(m, attempts, settled):
+			case <-done:
+				// Not handed out, consumed again by the group
+				<-h.slots
+				h.inflight.Done()
+				return nil
+			}
+			select {
+			case attempts = <-next:
+			case <-done:
+				// Committed if settled while the session ends
+				return nil
+			}
+		}
+	}
+}
+
+// Publish broadcast a message to every subscriber of a topic
+func (q *KafkaQueue) Publish(ctx context.Context, topic string, msg Message) error {
+	return q.Produce(ctx, topic, msg)
+}
+
+// Subscribe consume every partition of a topic from the newest message and
+// block handing out all messages published to it until the context is
+// cancelled or the queue closed
+func (q *KafkaQueue) Subscribe(ctx context.Context, topic string, itemChan chan<- Delivery) error {
+	if !q.addConsumer() {
+		return ErrClosed
+	}
+	defer q.consumers.Done()
+
+	partitions, err := q.consumer.Partitions(topic)
+	if err != nil {
+		return err
+	}
+	msgs := make(chan *sarama.ConsumerMessage)
+	stop := make(chan struct{})
+	defer close(stop)
+	for _, partition := range partitions {
+		pc, err := q.consumer.ConsumePartition(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return err
+		}
+		defer pc.Close()
+		go func() {
+			for m := range pc.Messages() {
+				select {
+				case msgs <- m:
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	for {
+		select {
+		case m := <-msgs:
+			select {
+			case itemChan <- NewDelivery(kafkaMessageOf(m), 1, nil):
+			case <-ctx.Done():
+				return nil
+			case <-q.closing:
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		case <-q.closing:
+			return nil
+		}
+	}
+}
+
+// kafkaMessage return the Kafka message of a message published to a topic,
+// keyed by the key of the message, if any
+func kafkaMessage(topic string, msg Message) *sarama.ProducerMessage {
+	m := &sarama.ProducerMessage{
+		Topic: topic,
+		Value: sarama.ByteEncoder(msg.Body),
+	}
+	if msg.Headers.Key != "" {
+		m.Key = sarama.StringEncoder(msg.Headers.Key)
+	}
+	header := func(key, value string) {
+		m.Headers = append(m.Headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+	}
+	if msg.Headers.ContentType != "" {
+		header(contentTypeHeader, msg.Headers.ContentType)
+	}
+	if msg.Headers.AgentID != "" {
+		header(agentIDHeader, msg.Headers.AgentID)
+	}
+	if !msg.Headers.Timestamp.IsZero() {
+		header(timestampHeader, msg.Headers.Timestamp.Format(time.RFC3339Nano))
+	}
+	if msg.Headers.SchemaVersion > 0 {
+		header(schemaVersionHeader, strconv.Itoa(msg.Headers.SchemaVersion))
+	}
+	return m
+}
+
+// kafkaHeader return the value of a header of a Kafka message, empty if
+// missing
+func kafkaHeader(m *sarama.ConsumerMessage, name string) string {
+	for _, h := range m.Headers {
+		if h != nil && string(h.Key) == name {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// kafkaMessageOf return the message of a Kafka message
+func kafkaMessageOf(m *sarama.ConsumerMessage) Message {
+	version, _ := strconv.Atoi(kafkaHeader(m, schemaVersionHeader))
+	timestamp, _ := time.Parse(time.RFC3339Nano, kafkaHeader(m, timestampHeader))
+	return Message{
+		Body: m.Value,
+		Headers: Headers{
+			ContentType:   kafkaHeader(m, contentTypeHeader),
+			SchemaVersion: version,
+			AgentID:       kafkaHeader(m, agentIDHeader),
+			Timestamp:     timestamp,
+			Key:           string(m.Key),
+		},
+	}
+}
+
+// delivery wrap a message consumed from a partition into a `Delivery`,
+// `settled` is called once it is with the attempt to deliver it again at,
+// 0 if not to be delivered again. The attempts are counted by the consumer,
+// a message consumed again after a consumer went away starts over.
+func (q *KafkaQueue) delivery(m *sarama.ConsumerMessage, attempts int, settled func(int)) Delivery {
+	return NewDelivery(kafkaMessageOf(m), attempts, &kafkaAcker{
+		queue:    q,
+		msg:      m,
+		attempts: attempts,
+		settled:  settled,
+	})
+}
+
+// kafkaAcker settles a Kafka message, as Kafka doesn't requeue messages
+// those rejected are delivered again in place by the consumer or published
+// to the dead-letter topic
+type kafkaAcker struct {
+	queue    *KafkaQueue
+	msg      *sarama.ConsumerMessage
+	attempts int
+	settled  func(int)
+	once     sync.Once
+}
+
+// settle settle the message once, with the attempt to deliver it again at,
+// 0 to commit its offset
+func (a *kafkaAcker) settle(again int) {
+	a.once.Do(func() { a.settled(again) })
+}
+
+// Ack acknowledge the message, committing its offset
+func (a *kafkaAcker) Ack() error {
+	a.settle(0)
+	return nil
+}
+
+// Nack have the message delivered again, before the ones following it, or
+// publish it to the dead-letter topic once the attempts are exhausted or if
+// not to be requeued, committing its offset once published. Failing
+// publications are retried with backoff, if all fail the message is
+// delivered again at the same attempt.
+func (a *kafkaAcker) Nack(requeue bool, reason error) error {
+	if requeue && a.attempts < a.queue.options.maxAttempts {
+		a.settle(a.attempts + 1)
+		return nil
+	}
+	m := kafkaMessage(DeadLetterQueueName(a.msg.Topic), kafkaMessageOf(a.msg))
+	extra := map[string]string{
+		attemptsHeader: strconv.Itoa(a.attempts),
+		queueHeader:    a.msg.Topic,
+		deadAtHeader:   time.Now().Format(time.RFC3339Nano),
+	}
+	if reason != nil {
+		extra[reasonHeader] = reason.Error()
+	}
+	for k, v := range extra {
+		m.Headers = append(m.Headers, sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
+	}
+	if err := a.republish(m); err != nil {
+		a.settle(a.attempts)
+		return err
+	}
+	a.settle(0)
+	return nil
+}
+
+// republish publish a message dead-lettered, retrying with an exponential
+// backoff until it's stored or the queue closed
+func (a *kafkaAcker) republish(m *sarama.ProducerMessage) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-a.queue.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	delay := kafkaRepublishDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = a.queue.send(ctx, m); err == nil || attempt == kafkaRepublishAttempts {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// deadLetters call `f` on the messages in the dead-letter topic of a topic
+// not replayed yet, oldest first on each partition, up to `limit` messages,
+// all of them if not positive, along with the manager of the offsets of
+// their partition. The messages replayed are tracked by the offsets of a
+// consumer group named after the dead-letter topic.
+func (q *KafkaQueue) deadLetters(topic string, limit int,
+	f func(*sarama.ConsumerMessage, sarama.PartitionOffsetManager) error) error {
+	deadLetterTopic := DeadLetterQueueName(topic)
+	partitions, err := q.consumer.Partitions(deadLetterTopic)
+	if errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	offsets, err := q.newOffsets(deadLetterTopic)
+	if err != nil {
+		return err
+	}
+	defer offsets.Close()
+	read := 0
+	for _, partition := range partitions {
+		if limit > 0 && read >= limit {
+			break
+		}
+		n, err := q.readPartition(offsets, deadLetterTopic, partition, limit-read, f)
+		read += n
+		if err != nil {
+			return err
+		}
+	}
+	offsets.Commit()
+	return nil
+}
+
+// readPartition call `f` on the messages of a partition from the offset
+// committed up to the newest one, up to `limit` messages, all of them if
+// not positive. Return the number of messages read.
+func (q *KafkaQueue) readPartition(offsets sarama.OffsetManager, topic string, partition int32,
+	limit int, f func(*sarama.ConsumerMessage, sarama.PartitionOffsetManager) error) (int, error) {
+	pom, err := offsets.ManagePartition(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	// Released by the offset manager once its offsets are committed
+	defer pom.AsyncClose()
+	oldest, err := q.client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return 0, err
+	}
+	newest, err := q.client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, err
+	}
+	// Nothing committed yet, or removed by the retention
+	next, _ := pom.NextOffset()
+	if next < oldest {
+		next = oldest
+	}
+	if next >= newest {
+		return 0, nil
+	}
+	pc, err := q.consumer.ConsumePartition(topic, partition, next)
+	if err != nil {
+		return 0, err
+	}
+	defer pc.Close()
+	n := 0
+	for next < newest && (limit <= 0 || n < limit) {
+		select {
+		case m, ok := <-pc.Messages():
+			if !ok {
+				return n, nil
+			}
+			if err := f(m, pom); err != nil {
+				return n, err
+			}
+			next = m.Offset + 1
+			n++
+		case <-time.After(kafkaReadTimeout):
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
+// DeadLetters return the messages in the dead-letter topic of a topic not
+// replayed yet, up to `limit` messages, all of them if not positive
+func (q *KafkaQueue) DeadLetters(topic string, limit int) ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := q.deadLetters(topic, limit, func(m *sarama.ConsumerMessage, _ sarama.PartitionOffsetManager) error {
+		attempts, _ := strconv.Atoi(kafkaHeader(m, attemptsHeader))
+		deadAt, _ := time.Parse(time.RFC3339Nano, kafkaHeader(m, deadAtHeader))
+		letters = append(letters, DeadLetter{
+			Queue:    topic,
+			Message:  kafkaMessageOf(m),
+			Attempts: attempts,
+			Reason:   kafkaHeader(m, reasonHeader),
+			DeadAt:   deadAt,
+		})
+		return nil
+	})
+	return letters, err
+}
+
+// Replay publish the messages in the dead-letter topic of a topic not
+// replayed yet back to the topic, up to `limit` messages, all of them if
+// not positive, their attempts are reset. Kafka doesn't delete messages,
+// those replayed are marked as such by committing their offsets. Return
+// the number of messages replayed.
+func (q *KafkaQueue) Replay(topic string, limit int) (int, error) {
+	replayed := 0
+	err := q.deadLetters(topic, limit, func(m *sarama.ConsumerMessage, offsets sarama.PartitionOffsetManager) error {
+		if err := q.Produce(context.Background(), topic, kafkaMessageOf(m)); err != nil {
+			return err
+		}
+		offsets.MarkOffset(m.Offset+1, "")
+		replayed++
+		return nil
+	})
+	return replayed, err
+}
@@ -0,0 +1,586 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+)
+
+func TestKafkaDial(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetController(broker.BrokerID()).
+			SetLeader("urlstatus", 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(3),
+	})
+
+	mq, err := Dial("kafka://" + broker.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Close()
+	msg, _ := Encode(JSON, "agent-1", sample{"http://a", true})
+	if err := mq.Produce(context.Background(), "urlstatus", msg); err != nil {
+		t.Errorf("Produce failed: expected nil got %v\n", err)
+	}
+}
+
+func TestKafkaProduceByKey(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, kafkaConfig())
+	producer.SetDefaultPartitions(4)
+	q := &KafkaQueue{
+		producer: producer,
+		consumer: mocks.NewConsumer(t, nil),
+		options:  newOptions(nil),
+		closing:  make(chan struct{}),
+	}
+	defer q.Close()
+
+	// The samples of a target always land on the same partition
+	partitions := make(map[string]map[int32]bool)
+	record := func(m *sarama.ProducerMessage) error {
+		key, _ := m.Key.Encode()
+		if partitions[string(key)] == nil {
+			partitions[string(key)] = make(map[int32]bool)
+		}
+		partitions[string(key)][m.Partition] = true
+		return nil
+	}
+	urls := []string{"http://a", "http://b", "http://c", "http://d", "http://e", "http://f"}
+	seen := make(map[int32]bool)
+	for _, url := range urls {
+		msg, _ := Encode(JSON, "agent-1", sample{url, true})
+		msg.Headers.Key = url
+		for i := 0; i < 5; i++ {
+			producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(record)
+			if err := q.Produce(context.Background(), "urlstatus", msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(partitions[url]) != 1 {
+			t.Errorf("Produce failed: expected %s on a single partition got %v\n", url, partitions[url])
+		}
+		for partition := range partitions[url] {
+			seen[partition] = true
+		}
+	}
+	if len(seen) < 2 {
+		t.Errorf("Produce failed: expected the targets spread on partitions got %v\n", seen)
+	}
+}
+
+// blockingProducer is a `sarama.SyncProducer` never storing the messages
+// until closed
+type blockingProducer struct {
+	closed chan struct{}
+}
+
+func (p *blockingProducer) SendMessage(*sarama.ProducerMessage) (int32, int64, error) {
+	<-p.closed
+	return 0, 0, sarama.ErrClosedClient
+}
+
+func (p *blockingProducer) SendMessages([]*sarama.ProducerMessage) error {
+	<-p.closed
+	return sarama.ErrClosedClient
+}
+
+func (p *blockingProducer) Close() error {
+	close(p.closed)
+	return nil
+}
+
+func TestKafkaProduceContext(t *testing.T) {
+	q := &KafkaQueue{
+		producer: &blockingProducer{closed: make(chan struct{})},
+		consumer: mocks.NewConsumer(t, nil),
+		options:  newOptions(nil),
+		closing:  make(chan struct{}),
+	}
+	defer q.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	msg, _ := Encode(JSON, "agent-1", sample{"http://a", true})
+	if err := q.Produce(ctx, "urlstatus", msg); err != context.DeadlineExceeded {
+		t.Errorf("Produce failed: expected %v got %v\n", context.DeadlineExceeded, err)
+	}
+}
+
+// fakeGroup is a `sarama.ConsumerGroup` claiming a single partition, fed
+// by hand
+type fakeGroup struct {
+	messages chan *sarama.ConsumerMessage
+	mutex    sync.Mutex
+	marks    []int64
+	sessions int
+	errors   []error
+}
+
+func (g *fakeGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	g.mutex.Lock()
+	g.sessions++
+	g.mutex.Unlock()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	session := &fakeSession{ctx: ctx, group: g}
+	if err := handler.Setup(session); err != nil {
+		return err
+	}
+	// Like sarama, the errors of a claim are reported apart, ending the
+	// session
+	if err := handler.ConsumeClaim(session, &fakeClaim{topic: topics[0], messages: g.messages}); err != nil {
+		g.mutex.Lock()
+		g.errors = append(g.errors, err)
+		g.mutex.Unlock()
+	}
+	handler.Cleanup(session)
+	return nil
+}
+
+func (g *fakeGroup) Errors() <-chan error { return nil }
+func (g *fakeGroup) Close() error         { return nil }
+
+// started return the number of sessions started
+func (g *fakeGroup) started() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.sessions
+}
+
+func (g *fakeGroup) committed() []int64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return append([]int64(nil), g.marks...)
+}
+
+type fakeSession struct {
+	ctx   context.Context
+	group *fakeGroup
+}
+
+func (s *fakeSession) Claims() map[string][]int32                      { return nil }
+func (s *fakeSession) MemberID() string                                { return "member-1" }
+func (s *fakeSession) GenerationID() int32                             { return 1 }
+func (s *fakeSession) Commit()                                         {}
+func (s *fakeSession) ResetOffset(string, int32, int64, string)        {}
+func (s *fakeSession) MarkMessage(m *sarama.ConsumerMessage, _ string) {}
+func (s *fakeSession) Context() context.Context                        { return s.ctx }
+
+func (s *fakeSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.group.mutex.Lock()
+	defer s.group.mutex.Unlock()
+	s.group.marks = append(s.group.marks, offset)
+}
+
+type fakeClaim struct {
+	topic    string
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *fakeClaim) Topic() string                            { return c.topic }
+func (c *fakeClaim) Partition() int32                         { return 0 }
+func (c *fakeClaim) InitialOffset() int64                     { return 0 }
+func (c *fakeClaim) HighWaterMarkOffset() int64               { return 0 }
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+// consumerMessage return the message consumed at an offset of the
+// partition of a target
+func consumerMessage(offset int64, url string, attempts string) *sarama.ConsumerMessage {
+	msg, _ := Encode(MsgPack, "agent-1", sample{url, true})
+	msg.Headers.Key = url
+	p := kafkaMessage("urlstatus", msg)
+	m := &sarama.ConsumerMessage{Topic: "urlstatus", Offset: offset, Key: []byte(url)}
+	m.Value, _ = p.Value.Encode()
+	for i := range p.Headers {
+		m.Headers = append(m.Headers, &p.Headers[i])
+	}
+	if attempts != "" {
+		m.Headers = append(m.Headers, &sarama.RecordHeader{Key: []byte(attemptsHeader), Value: []byte(attempts)})
+	}
+	return m
+}
+
+// headerChecker check a header of the messages published
+func headerChecker(topic, name, value string) mocks.MessageChecker {
+	return func(m *sarama.ProducerMessage) error {
+		if m.Topic != topic {
+			return errors.New("unexpected topic " + m.Topic)
+		}
+		for _, h := range m.Headers {
+			if string(h.Key) == name && string(h.Value) == value {
+				return nil
+			}
+		}
+		return errors.New("missing header " + name)
+	}
+}
+
+// noDelivery fail if a delivery is handed out within a short time
+func noDelivery(t *testing.T, deliveries <-chan Delivery) {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		t.Errorf("Consume failed: expected no delivery got %v\n", d.Headers)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestKafkaConsume(t *testing.T) {
+	group := &fakeGroup{messages: make(chan *sarama.ConsumerMessage, 3)}
+	var groups []string
+	producer := mocks.NewSyncProducer(t, nil)
+	q := &KafkaQueue{
+		producer: producer,
+		consumer: mocks.NewConsumer(t, nil),
+		newGroup: func(name string) (sarama.ConsumerGroup, error) {
+			groups = append(groups, name)
+			return group, nil
+		},
+		options: newOptions([]option{Group("aggregator"), MaxAttempts(2)}),
+		closing: make(chan struct{}),
+	}
+	defer q.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for offset := int64(0); offset < 3; offset++ {
+		group.messages <- consumerMessage(offset, "http://example.com", "")
+	}
+	deliveries := make(chan Delivery)
+	go q.Consume(ctx, "urlstatus", 4, deliveries)
+
+	// A message of a partition at a time, the next one once settled
+	d := receive(t, deliveries)
+	var s sample
+	if err := d.Decode(&s); err != nil || s.Url != "http://example.com" ||
+		d.Headers.Key != "http://example.com" || d.Headers.AgentID != "agent-1" || d.Attempts != 1 {
+		t.Errorf("Consume failed: unexpected delivery %v %v (%v)\n", d.Headers, s, err)
+	}
+	noDelivery(t, deliveries)
+	d.Ack()
+
+	// Delivered again in place until the attempts are exhausted
+	receive(t, deliveries).Nack(true, errors.New("retry"))
+	d = receive(t, deliveries)
+	if d.Attempts != 2 {
+		t.Errorf("Nack failed: expected attempt 2 got %d\n", d.Attempts)
+	}
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(headerChecker("urlstatus.dead", reasonHeader, "exhausted"))
+	d.Nack(true, errors.New("exhausted"))
+	receive(t, deliveries).Ack()
+	if marks := group.committed(); !reflect.DeepEqual(marks, []int64{1, 2, 3}) {
+		t.Errorf("Consume failed: expected offsets [1 2 3] committed got %v\n", marks)
+	}
+	if !reflect.DeepEqual(groups, []string{"aggregator"}) {
+		t.Errorf("Consume failed: expected group aggregator got %v\n", groups)
+	}
+}
+
+func TestKafkaNackOrder(t *testing.T) {
+	group := &fakeGroup{messages: make(chan *sarama.ConsumerMessage, 3)}
+	q := &KafkaQueue{
+		producer: mocks.NewSyncProducer(t, nil),
+		consumer: mocks.NewConsumer(t, nil),
+		newGroup: func(string) (sarama.ConsumerGroup, error) { return group, nil },
+		options:  newOptions(nil),
+		closing:  make(chan struct{}),
+	}
+	defer q.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for offset, url := range []string{"http://a", "http://b", "http://a"} {
+		group.messages <- consumerMessage(int64(offset), url, "")
+	}
+	deliveries := make(chan Delivery)
+	go q.Consume(ctx, "urlstatus", 2, deliveries)
+
+	// The message requeued is delivered again before the following ones
+	var order []string
+	for i := 0; i < 4; i++ {
+		d := receive(t, deliveries)
+		var s sample
+		d.Decode(&s)
+		order = append(order, fmt.Sprintf("%s#%d", s.Url, d.Attempts))
+		if i == 0 {
+			d.Nack(true, nil)
+		} else {
+			d.Ack()
+		}
+	}
+	expected := []string{"http://a#1", "http://a#2", "http://b#1", "http://a#1"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("Nack failed: expected %v got %v\n", expected, order)
+	}
+	if marks := group.committed(); !reflect.DeepEqual(marks, []int64{1, 2, 3}) {
+		t.Errorf("Nack failed: expected offsets [1 2 3] committed got %v\n", marks)
+	}
+}
+
+func TestKafkaNackRetried(t *testing.T) {
+	group := &fakeGroup{messages: make(chan *sarama.ConsumerMessage, 1)}
+	producer := mocks.NewSyncProducer(t, nil)
+	q := &KafkaQueue{
+		producer: producer,
+		consumer: mocks.NewConsumer(t, nil),
+		newGroup: func(string) (sarama.ConsumerGroup, error) { return group, nil },
+		options:  newOptions(nil),
+		closing:  make(chan struct{}),
+	}
+	defer q.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	group.messages <- consumerMessage(0, "http://example.com", "")
+	deliveries := make(chan Delivery)
+	go q.Consume(ctx, "urlstatus", 1, deliveries)
+
+	// A transient failure is retried, the message is settled once published
+	producer.ExpectSendMessageAndFail(sarama.ErrNotLeaderForPartition)
+	producer.ExpectSendMessageAndSucceed()
+	if err := receive(t, deliveries).Nack(false, nil); err != nil {
+		t.Errorf("Nack failed: expected nil got %v\n", err)
+	}
+	if marks := group.committed(); !reflect.DeepEqual(marks, []int64{1}) {
+		t.Errorf("Nack failed: expected offset 1 committed got %v\n", marks)
+	}
+}
+
+func TestKafkaDeadLetterFailed(t *testing.T) {
+	group := &fakeGroup{messages: make(chan *sarama.ConsumerMessage, 2)}
+	producer := mocks.NewSyncProducer(t, nil)
+	q := &KafkaQueue{
+		producer: producer,
+		consumer: mocks.NewConsumer(t, nil),
+		newGroup: func(string) (sarama.ConsumerGroup, error) { return group, nil },
+		options:  newOptions(nil),
+		closing:  make(chan struct{}),
+	}
+	defer q.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	group.messages <- consumerMessage(0, "http://a", "")
+	group.messages <- consumerMessage(1, "http://b", "")
+	deliveries := make(chan Delivery)
+	go q.Consume(ctx, "urlstatus", 2, deliveries)
+
+	// Not dead-lettered, the message is delivered again at the same attempt
+	// before the following ones
+	for i := 0; i < kafkaRepublishAttempts; i++ {
+		producer.ExpectSendMessageAndFail(sarama.ErrNotLeaderForPartition)
+	}
+	if err := receive(t, deliveries).Nack(false, nil); err == nil {
+		t.Errorf("Nack failed: expected an error\n")
+	}
+	d := receive(t, deliveries)
+	var s sample
+	if err := d.Decode(&s); err != nil || s.Url != "http://a" || d.Attempts != 1 {
+		t.Errorf("Nack failed: expected http://a at attempt 1 got %v at %d\n", s.Url, d.Attempts)
+	}
+	if marks := group.committed(); len(marks) != 0 {
+		t.Errorf("Nack failed: expected no offset committed got %v\n", marks)
+	}
+	d.Ack()
+	receive(t, deliveries).Ack()
+	if marks := group.committed(); !reflect.DeepEqual(marks, []int64{1, 2}) {
+		t.Errorf("Ack failed: expected offsets [1 2] committed got %v\n", marks)
+	}
+}
+
+// fakeTopic is a `sarama.Client` and a `sarama.Consumer` of a topic with a
+// single partition
+type fakeTopic struct {
+	sarama.Client
+	sarama.Consumer
+	name     string
+	messages []*sarama.ConsumerMessage
+}
+
+func (f *fakeTopic) Partitions(topic string) ([]int32, error) {
+	if topic != f.name {
+		return nil, sarama.ErrUnknownTopicOrPartition
+	}
+	return []int32{0}, nil
+}
+
+func (f *fakeTopic) GetOffset(topic string, partition int32, time int64) (int64, error) {
+	if time == sarama.OffsetOldest {
+		return 0, nil
+	}
+	return int64(len(f.messages)), nil
+}
+
+func (f *fakeTopic) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	messages := make(chan *sarama.ConsumerMessage, len(f.messages))
+	for _, m := range f.messages[offset:] {
+		messages <- m
+	}
+	return &fakePartition{messages: messages}, nil
+}
+
+func (f *fakeTopic) Topics() ([]string, error) { return []string{f.name}, nil }
+func (f *fakeTopic) Close() error              { return nil }
+
+type fakePartition struct {
+	sarama.PartitionConsumer
+	messages chan *sarama.ConsumerMessage
+}
+
+func (p *fakePartition) Messages() <-chan *sarama.ConsumerMessage { return p.messages }
+func (p *fakePartition) AsyncClose()                              {}
+func (p *fakePartition) Close() error                             { return nil }
+
+// fakeOffsets is a `sarama.OffsetManager` managing the offsets of a group
+// on a single partition
+type fakeOffsets struct {
+	group     string
+	marked    int64
+	committed int64
+}
+
+func (o *fakeOffsets) ManagePartition(string, int32) (sarama.PartitionOffsetManager, error) {
+	o.marked = o.committed
+	return o, nil
+}
+
+func (o *fakeOffsets) Commit()                              { o.committed = o.marked }
+func (o *fakeOffsets) Close() error                         { return nil }
+func (o *fakeOffsets) NextOffset() (int64, string)          { return o.committed, "" }
+func (o *fakeOffsets) MarkOffset(offset int64, _ string)    { o.marked = offset }
+func (o *fakeOffsets) ResetOffset(int64, string)            {}
+func (o *fakeOffsets) Errors() <-chan *sarama.ConsumerError { return nil }
+func (o *fakeOffsets) AsyncClose()                          {}
+
+func TestKafkaDeadLetters(t *testing.T) {
+	topic := &fakeTopic{name: "urlstatus.dead"}
+	for i, url := range []string{"http://a", "http://b", "http://c"} {
+		m := consumerMessage(int64(i), url, "3")
+		m.Topic = "urlstatus.dead"
+		m.Headers = append(m.Headers, &sarama.RecordHeader{Key: []byte(reasonHeader), Value: []byte("down")})
+		topic.messages = append(topic.messages, m)
+	}
+	offsets := &fakeOffsets{committed: sarama.OffsetOldest}
+	producer := mocks.NewSyncProducer(t, nil)
+	q := &KafkaQueue{
+		client:   topic,
+		producer: producer,
+		consumer: topic,
+		newOffsets: func(group string) (sarama.OffsetManager, error) {
+			offsets.group = group
+			return offsets, nil
+		},
+		options: newOptions(nil),
+		closing: make(chan struct{}),
+	}
+	defer q.Close()
+
+	letters, err := q.DeadLetters("urlstatus", 0)
+	if err != nil || len(letters) != 3 {
+		t.Fatalf("DeadLetters failed: expected 3 dead letters got %v (%v)\n", letters, err)
+	}
+	if l := letters[0]; l.Queue != "urlstatus" || l.Attempts != 3 || l.Reason != "down" ||
+		l.Headers.Key != "http://a" || l.Headers.AgentID != "agent-1" {
+		t.Errorf("DeadLetters failed: unexpected dead letter %v\n", l)
+	}
+
+	// Replayed with their key, without the dead-letter headers, and marked
+	// as such through the offsets of the dead-letter group
+	for _, url := range []string{"http://a", "http://b"} {
+		url := url
+		producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(m *sarama.ProducerMessage) error {
+			key, _ := m.Key.Encode()
+			if m.Topic != "urlstatus" || string(key) != url {
+				return fmt.Errorf("unexpected message %s/%s", m.Topic, key)
+			}
+			for _, h := range m.Headers {
+				if string(h.Key) == attemptsHeader || string(h.Key) == reasonHeader {
+					return errors.New("unexpected header " + string(h.Key))
+				}
+			}
+			return nil
+		})
+	}
+	if n, err := q.Replay("urlstatus", 2); err != nil || n != 2 {
+		t.Errorf("Replay failed: expected 2 got %d (%v)\n", n, err)
+	}
+	if offsets.group != "urlstatus.dead" || offsets.committed != 2 {
+		t.Errorf("Replay failed: expected offset 2 of urlstatus.dead got %d of %s\n",
+			offsets.committed, offsets.group)
+	}
+	letters, err = q.DeadLetters("urlstatus", 0)
+	if err != nil || len(letters) != 1 || letters[0].Headers.Key != "http://c" {
+		t.Errorf("DeadLetters failed: expected http://c left got %v (%v)\n", letters, err)
+	}
+	if letters, err := q.DeadLetters("unknown", 0); err != nil || len(letters) != 0 {
+		t.Errorf("DeadLetters failed: expected no dead letters got %v (%v)\n", letters, err)
+	}
+}
+
+func TestKafkaSubscribe(t *testing.T) {
+	consumer := mocks.NewConsumer(t, nil)
+	consumer.SetTopicMetadata(map[string][]int32{"membership": {0, 1}})
+	partitions := []*mocks.PartitionConsumer{
+		consumer.ExpectConsumePartition("membership", 0, sarama.OffsetNewest),
+		consumer.ExpectConsumePartition("membership", 1, sarama.OffsetNewest),
+	}
+	q := &KafkaQueue{
+		producer: mocks.NewSyncProducer(t, nil),
+		consumer: consumer,
+		options:  newOptions(nil),
+		closing:  make(chan struct{}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	deliveries := make(chan Delivery)
+	go q.Subscribe(ctx, "membership", deliveries)
+
+	for i, pc := range partitions {
+		m := consumerMessage(int64(i), "http://example.com", "")
+		m.Topic, m.Partition = "membership", int32(i)
+		pc.YieldMessage(m)
+		var s sample
+		if err := receive(t, deliveries).Decode(&s); err != nil || s.Url != "http://example.com" {
+			t.Errorf("Subscribe failed: expected http://example.com got %v (%v)\n", s.Url, err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	q.Close()
+}
@@ -0,0 +1,482 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package messaging
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Headers carried by the NATS messages, the AMQP message properties have no
+// NATS counterpart
+const (
+	contentTypeHeader = "Content-Type"
+	agentIDHeader     = "x-overseer-agent-id"
+	timestampHeader   = "x-overseer-timestamp"
+)
+
+// natsFetchTimeout is the longest a consumer waits for a message before
+// checking whether to stop
+const natsFetchTimeout = time.Second
+
+// ConnectNats create a connection to a NATS server with JetStream enabled,
+// returning it into a pointer to a `NatsQueue` object, secured by TLS once
+// a CA bundle or a client certificate is set
+func ConnectNats(url string, opts ...option) (*NatsQueue, error) {
+	options := newOptions(opts)
+	var natsOptions []nats.Option
+	tlsConfig, err := options.security.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		natsOptions = append(natsOptions, nats.Secure(tlsConfig))
+	}
+	username, password, err := options.security.credentials(url)
+	if err != nil {
+		return nil, err
+	}
+	if password != "" {
+		natsOptions = append(natsOptions, nats.UserInfo(username, password))
+	}
+	conn, err := nats.Connect(url, natsOptions...)
+	if err != nil {
+		return nil, err
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &NatsQueue{
+		conn:    conn,
+		js:      js,
+		options: options,
+		streams: make(map[string]bool),
+		closing: make(chan struct{}),
+	}, nil
+}
+
+// NatsQueue is a `MessageQueue` backed by NATS. Each queue is a JetStream
+// stream with work queue retention, consumed through a durable consumer
+// named after the consumer group and shared by every instance of the group,
+// thus messages survive restarts and are delivered again if not settled in
+// time. Work queues allow a single group, consuming a queue with another
+// one fails. Topics are plain NATS subjects, without durability.
+type NatsQueue struct {
+	conn      *nats.Conn
+	js        nats.JetStreamContext
+	options   *options
+	mutex     sync.Mutex
+	streams   map[string]bool
+	closed    bool
+	closing   chan struct{}
+	consumers sync.WaitGroup
+}
+
+// Close the connection with NATS, stopping the consumers and waiting for the
+// deliveries in flight to be settled, up to the drain timeout
+func (q *NatsQueue) Close() error {
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.closing)
+	q.mutex.Unlock()
+
+	q.consumers.Wait()
+	q.conn.Close()
+	return nil
+}
+
+// addConsumer register a consumer to be waited for on close, false if the
+// queue is closed
+func (q *NatsQueue) addConsumer() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return false
+	}
+	q.consumers.Add(1)
+	return true
+}
+
+// streamName return the name of the stream of a queue, stream names can't
+// contain dots
+func streamName(queueName string) string {
+	return strings.Replace(queueName, ".", "_", -1)
+}
+
+// declare create the stream of a queue if missing, the streams already
+// declared are cached. Return the name of the stream.
+func (q *NatsQueue) declare(queueName string, retention nats.RetentionPolicy) (string, error) {
+	name := streamName(queueName)
+	q.mutex.Lock()
+	declared := q.streams[name]
+	q.mutex.Unlock()
+	if declared {
+		return name, nil
+	}
+	_, err := q.js.StreamInfo(name)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = q.js.AddStream(&nats.StreamConfig{
+			Name:      name,
+			Subjects:  []string{queueName},
+			Retention: retention,
+			Storage:   nats.FileStorage,
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+	q.mutex.Lock()
+	q.streams[name] = true
+	q.mutex.Unlock()
+	return name, nil
+}
+
+// Produce publish a message to a queue, waiting for it to be stored
+func (q *NatsQueue) Produce(ctx context.Context, queueName string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-q.closing:
+		return ErrClosed
+	default:
+	}
+	if _, err := q.declare(queueName, nats.WorkQueuePolicy); err != nil {
+		return err
+	}
+	_, err := q.js.PublishMsg(natsMessage(queueName, msg), nats.Context(ctx))
+	return err
+}
+
+// Consume pull the messages of a queue and block handing them out until the
+// context is cancelled or the queue closed, a concurrency value can be set
+// to consume multiple messages at once, that is the number of deliveries
+// not yet settled. Before returning, the deliveries handed out are given
+// time to be settled, those not settled are delivered again.
+func (q *NatsQueue) Consume(ctx context.Context, queueName string,
+	concurrency int, itemChan chan<- Delivery) error {
+	if !q.addConsumer() {
+		return ErrClosed
+	}
+	defer q.consumers.Done()
+
+	stream, err := q.declare(queueName, nats.WorkQueuePolicy)
+	if err != nil {
+		return err
+	}
+	// The consumer is created explicitly to outlive the subscription, the
+	// messages not settled are kept for the next subscriber
+	durable := streamName(q.options.groupFor(queueName))
+	_, err = q.js.AddConsumer(stream, &nats.ConsumerConfig{
+		Durable:       durable,
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       q.options.ackTimeout,
+		FilterSubject: queueName,
+	})
+	if err != nil {
+		return err
+	}
+	sub, err := q.js.PullSubscribe(queueName, durable, nats.Bind(stream, durable))
+	if err != nil {
+		return err
+	}
+	var inflight sync.WaitGroup
+	defer func() {
+		drain(&inflight, q.options.drainTimeout)
+		sub.Unsubscribe()
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-q.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+		fetchCtx, fetchCancel := context.WithTimeout(ctx, natsFetchTimeout)
+		msgs, err := sub.Fetch(1, nats.Context(fetchCtx))
+		fetchCancel()
+		if err != nil {
+			<-slots
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+				continue
+			}
+			return err
+		}
+		for _, m := range msgs {
+			inflight.Add(1)
+			settled := func() {
+				<-slots
+				inflight.Done()
+			}
+			select {
+			case itemChan <- q.delivery(queueName, m, settled):
+			case <-ctx.Done():
+				// Not handed out, delivered again right away
+				m.Nak()
+				settled()
+				return nil
+			}
+		}
+	}
+}
+
+// Publish broadcast a message to every subscriber of a topic, a NATS
+// subject named after the topic
+func (q *NatsQueue) Publish(ctx context.Context, topic string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return q.conn.PublishMsg(natsMessage(topic, msg))
+}
+
+// Subscribe subscribe to the subject of a topic and block handing out all
+// messages published to it until the context is cancelled or the queue
+// closed
+func (q *NatsQueue) Subscribe(ctx context.Context, topic string, itemChan chan<- Delivery) error {
+	if !q.addConsumer() {
+		return ErrClosed
+	}
+	defer q.consumers.Done()
+
+	msgs := make(chan *nats.Msg, 64)
+	sub, err := q.conn.ChanSubscribe(topic, msgs)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	for {
+		select {
+		case m := <-msgs:
+			select {
+			case itemChan <- NewDelivery(natsMessageOf(m.Header, m.Data), 1, nil):
+			case <-ctx.Done():
+				return nil
+			case <-q.closing:
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		case <-q.closing:
+			return nil
+		}
+	}
+}
+
+// natsMessage return the NATS message of a message published to a subject
+func natsMessage(subject string, msg Message) *nats.Msg {
+	m := nats.NewMsg(subject)
+	m.Data = msg.Body
+	if msg.Headers.ContentType != "" {
+		m.Header.Set(contentTypeHeader, msg.Headers.ContentType)
+	}
+	if msg.Headers.AgentID != "" {
+		m.Header.Set(agentIDHeader, msg.Headers.AgentID)
+	}
+	if !msg.Headers.Timestamp.IsZero() {
+		m.Header.Set(timestampHeader, msg.Headers.Timestamp.Format(time.RFC3339Nano))
+	}
+	if msg.Headers.SchemaVersion > 0 {
+		m.Header.Set(schemaVersionHeader, strconv.Itoa(msg.Headers.SchemaVersion))
+	}
+	return m
+}
+
+// natsMessageOf return the message of the headers and the data of a NATS
+// message
+func natsMessageOf(header nats.Header, data []byte) Message {
+	version, _ := strconv.Atoi(header.Get(schemaVersionHeader))
+	timestamp, _ := time.Parse(time.RFC3339Nano, header.Get(timestampHeader))
+	return Message{
+		Body: data,
+		Headers: Headers{
+			ContentType:   header.Get(contentTypeHeader),
+			SchemaVersion: version,
+			AgentID:       header.Get(agentIDHeader),
+			Timestamp:     timestamp,
+		},
+	}
+}
+
+// delivery wrap a message pulled from a queue into a `Delivery`, `settled`
+// is called once it is. The attempts are tracked by JetStream.
+func (q *NatsQueue) delivery(queueName string, m *nats.Msg, settled func()) Delivery {
+	attempts := 1
+	if meta, err := m.Metadata(); err == nil {
+		attempts = int(meta.NumDelivered)
+	}
+	return NewDelivery(natsMessageOf(m.Header, m.Data), attempts, &natsAcker{
+		queue:    q,
+		msg:      m,
+		name:     queueName,
+		attempts: attempts,
+		settled:  settled,
+	})
+}
+
+// natsAcker settles a JetStream delivery, messages rejected are delivered
+// again by JetStream or published to the dead-letter queue
+type natsAcker struct {
+	queue    *NatsQueue
+	msg      *nats.Msg
+	name     string
+	attempts int
+	settled  func()
+	once     sync.Once
+}
+
+// Ack acknowledge the delivery
+func (a *natsAcker) Ack() error {
+	defer a.once.Do(a.settled)
+	return a.msg.Ack()
+}
+
+// Nack have the message delivered again, or publish it to the dead-letter
+// queue once the attempts are exhausted or if not to be requeued,
+// acknowledging the delivery
+func (a *natsAcker) Nack(requeue bool, reason error) error {
+	defer a.once.Do(a.settled)
+	if requeue && a.attempts < a.queue.options.maxAttempts {
+		return a.msg.Nak()
+	}
+	deadLetterQueue := DeadLetterQueueName(a.name)
+	if _, err := a.queue.declare(deadLetterQueue, nats.LimitsPolicy); err != nil {
+		return err
+	}
+	m := nats.NewMsg(deadLetterQueue)
+	m.Data = a.msg.Data
+	for k, v := range a.msg.Header {
+		m.Header[k] = v
+	}
+	m.Header.Set(attemptsHeader, strconv.Itoa(a.attempts))
+	m.Header.Set(queueHeader, a.name)
+	m.Header.Set(deadAtHeader, time.Now().Format(time.RFC3339Nano))
+	if reason != nil {
+		m.Header.Set(reasonHeader, reason.Error())
+	}
+	if _, err := a.queue.js.PublishMsg(m); err != nil {
+		return err
+	}
+	return a.msg.Ack()
+}
+
+// deadLetters call `f` on the messages in the dead-letter queue of a queue,
+// oldest first, up to `limit` messages, all of them if not positive
+func (q *NatsQueue) deadLetters(queueName string, limit int, f func(*nats.RawStreamMsg) error) error {
+	stream, err := q.declare(DeadLetterQueueName(queueName), nats.LimitsPolicy)
+	if err != nil {
+		return err
+	}
+	info, err := q.js.StreamInfo(stream)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for seq := info.State.FirstSeq; seq > 0 && seq <= info.State.LastSeq; seq++ {
+		if limit > 0 && n >= limit {
+			break
+		}
+		m, err := q.js.GetMsg(stream, seq)
+		if err != nil {
+			// Deleted, e.g. replayed
+			continue
+		}
+		if err := f(m); err != nil {
+			return err
+		}
+		n++
+	}
+	return nil
+}
+
+// DeadLetters return the messages in the dead-letter queue of a queue
+// without removing them, up to `limit` messages, all of them if not
+// positive
+func (q *NatsQueue) DeadLetters(queueName string, limit int) ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := q.deadLetters(queueName, limit, func(m *nats.RawStreamMsg) error {
+		attempts, _ := strconv.Atoi(m.Header.Get(attemptsHeader))
+		deadAt, _ := time.Parse(time.RFC3339Nano, m.Header.Get(deadAtHeader))
+		letters = append(letters, DeadLetter{
+			Queue:    queueName,
+			Message:  natsMessageOf(m.Header, m.Data),
+			Attempts: attempts,
+			Reason:   m.Header.Get(reasonHeader),
+			DeadAt:   deadAt,
+		})
+		return nil
+	})
+	return letters, err
+}
+
+// Replay move the messages in the dead-letter queue of a queue back to the
+// queue, up to `limit` messages, all of them if not positive, their
+// attempts are reset. Return the number of messages replayed.
+func (q *NatsQueue) Replay(queueName string, limit int) (int, error) {
+	replayed := 0
+	err := q.deadLetters(queueName, limit, func(m *nats.RawStreamMsg) error {
+		msg := natsMessageOf(m.Header, m.Data)
+		if err := q.Produce(context.Background(), queueName, msg); err != nil {
+			return err
+		}
+		if err := q.js.DeleteMsg(streamName(DeadLetterQueueName(queueName)), m.Sequence); err != nil {
+			return err
+		}
+		replayed++
+		return nil
+	})
+	return replayed, err
+}
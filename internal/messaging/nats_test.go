@@ -0,0 +1,220 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package messaging
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// runNats start an embedded NATS server with JetStream enabled, return a
+// queue connected to it
+func runNats(t *testing.T, opts ...option) *NatsQueue {
+	dir, err := ioutil.TempDir("", "nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("embedded NATS server not ready")
+	}
+	mq, err := Dial(s.ClientURL(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		mq.Close()
+		s.Shutdown()
+		os.RemoveAll(dir)
+	})
+	return mq.(*NatsQueue)
+}
+
+// receive return the next delivery or fail after a timeout
+func receive(t *testing.T, deliveries <-chan Delivery) Delivery {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery received")
+	}
+	return Delivery{}
+}
+
+func TestNatsProduceConsume(t *testing.T) {
+	mq := runNats(t, MaxAttempts(2))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	msg, _ := Encode(JSON, "agent-1", sample{"http://example.com", true})
+	if err := mq.Produce(ctx, "urlstatus", msg); err != nil {
+		t.Fatal(err)
+	}
+	deliveries := make(chan Delivery)
+	go mq.Consume(ctx, "urlstatus", 1, deliveries)
+
+	d := receive(t, deliveries)
+	var s sample
+	if err := d.Decode(&s); err != nil || s.Url != "http://example.com" {
+		t.Errorf("Consume failed: expected http://example.com got %v (%v)\n", s.Url, err)
+	}
+	if d.Headers.AgentID != "agent-1" || d.Headers.SchemaVersion != DefaultSchemaVersion ||
+		!d.Headers.Timestamp.Equal(msg.Headers.Timestamp) || d.Attempts != 1 {
+		t.Errorf("Consume failed: expected headers %v got %v (attempts %d)\n", msg.Headers, d.Headers, d.Attempts)
+	}
+
+	// Delivered again up to the maximum attempts, then dead-lettered
+	d.Nack(true, errors.New("first"))
+	d = receive(t, deliveries)
+	if d.Attempts != 2 {
+		t.Errorf("Nack failed: expected attempt 2 got %d\n", d.Attempts)
+	}
+	d.Nack(true, errors.New("second"))
+
+	var letters []DeadLetter
+	for i := 0; i < 50 && len(letters) == 0; i++ {
+		letters, _ = mq.DeadLetters("urlstatus", 0)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(letters) != 1 || letters[0].Reason != "second" || letters[0].Attempts != 2 ||
+		letters[0].Queue != "urlstatus" || letters[0].Headers.AgentID != "agent-1" {
+		t.Fatalf("DeadLetters failed: unexpected dead letters %v\n", letters)
+	}
+
+	n, err := mq.Replay("urlstatus", 0)
+	if err != nil || n != 1 {
+		t.Errorf("Replay failed: expected 1 got %d (%v)\n", n, err)
+	}
+	d = receive(t, deliveries)
+	if d.Attempts != 1 {
+		t.Errorf("Replay failed: expected the attempts reset got %d\n", d.Attempts)
+	}
+	d.Ack()
+	if letters, _ := mq.DeadLetters("urlstatus", 0); len(letters) != 0 {
+		t.Errorf("Replay failed: expected no dead letters got %v\n", letters)
+	}
+}
+
+func TestNatsRedeliverOnClose(t *testing.T) {
+	mq := runNats(t, DrainTimeout(100*time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+
+	msg, _ := Encode(JSON, "agent-1", sample{"http://example.com", true})
+	mq.Produce(ctx, "urlstatus", msg)
+	deliveries := make(chan Delivery)
+	done := make(chan error)
+	go func() { done <- mq.Consume(ctx, "urlstatus", 1, deliveries) }()
+	d := receive(t, deliveries)
+	d.Nack(true, nil)
+
+	// Pulled again but not handed out, left to the next consumer
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Consume failed: expected nil got %v\n", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go mq.Consume(ctx, "urlstatus", 1, deliveries)
+	if d := receive(t, deliveries); d.Attempts < 2 {
+		t.Errorf("Consume failed: expected the message delivered again got attempt %d\n", d.Attempts)
+	}
+}
+
+func TestNatsGroup(t *testing.T) {
+	mq := runNats(t, Group("aggregator"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	msg, _ := Encode(JSON, "agent-1", sample{"http://example.com", true})
+	if err := mq.Produce(ctx, "urlstatus.0", msg); err != nil {
+		t.Fatal(err)
+	}
+	deliveries := make(chan Delivery)
+	go mq.Consume(ctx, "urlstatus.0", 1, deliveries)
+	receive(t, deliveries).Ack()
+	if _, err := mq.js.ConsumerInfo("urlstatus_0", "aggregator"); err != nil {
+		t.Errorf("Consume failed: expected a consumer named after the group got %v\n", err)
+	}
+
+	mq.Close()
+	if err := mq.Produce(context.Background(), "urlstatus.0", msg); err != ErrClosed {
+		t.Errorf("Produce failed: expected %v got %v\n", ErrClosed, err)
+	}
+}
+
+func TestNatsPublishSubscribe(t *testing.T) {
+	mq := runNats(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first, second := make(chan Delivery), make(chan Delivery)
+	go mq.Subscribe(ctx, "membership", first)
+	go mq.Subscribe(ctx, "membership", second)
+	// Core NATS subjects keep nothing for late subscribers
+	time.Sleep(100 * time.Millisecond)
+
+	msg, _ := Encode(MsgPack, "agent-1", sample{"http://example.com", true})
+	if err := mq.Publish(ctx, "membership", msg); err != nil {
+		t.Fatal(err)
+	}
+	for _, deliveries := range []chan Delivery{first, second} {
+		var s sample
+		d := receive(t, deliveries)
+		if err := d.Decode(&s); err != nil || s.Url != "http://example.com" {
+			t.Errorf("Subscribe failed: expected http://example.com got %v (%v)\n", s.Url, err)
+		}
+	}
+
+	mq.Close()
+	if err := mq.Subscribe(ctx, "membership", first); err != ErrClosed {
+		t.Errorf("Subscribe failed: expected %v got %v\n", ErrClosed, err)
+	}
+}
+
+func TestDial(t *testing.T) {
+	if _, err := Dial("mqtt://localhost:1883"); err == nil {
+		t.Errorf("Dial failed: expected an error for an unsupported scheme\n")
+	}
+}
@@ -25,11 +25,18 @@
 // OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 
 // Package messaging contains middleware for communication with decoupled
-// services, could be RabbitMQ drivers as well as kafka or redis
+// services, RabbitMQ, NATS, Redis and Kafka drivers, selected by the scheme
+// of the URL dialed
 package messaging
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/streadway/amqp"
 )
@@ -37,36 +44,258 @@ import (
 // ErrRabbitMq generic RabbitMQ communication error
 var ErrRabbitMq = errors.New("rabbitmq communication error")
 
+// ErrClosed is returned when consuming from a message queue being closed
+var ErrClosed = errors.New("message queue closed")
+
+// Headers carried by the messages, along with the AMQP message properties
+const (
+	schemaVersionHeader = "x-overseer-schema-version"
+	attemptsHeader      = "x-overseer-attempts"
+	reasonHeader        = "x-overseer-reason"
+	queueHeader         = "x-overseer-queue"
+	deadAtHeader        = "x-overseer-dead-at"
+)
+
+// DefaultDrainTimeout is the time given to the consumers to settle the
+// deliveries in flight when closing a message queue
+const DefaultDrainTimeout = 5 * time.Second
+
+// DefaultAckTimeout is the time given to a consumer to settle a delivery
+// before it's delivered again, by the transports tracking it
+const DefaultAckTimeout = 30 * time.Second
+
+// DefaultBatchInterval is the time the messages produced are batched for
+// at most, when batching
+const DefaultBatchInterval = 100 * time.Millisecond
+
+// DefaultMaxLen is the approximate number of messages a stream retains, by
+// the transports trimming their streams
+const DefaultMaxLen = 100000
+
 // MessageQueue defines the behavior of a simple message queue, it's
 // expected to provide a `Produce` function a `Consume` one and a `Close`.
+// Consumed messages are handed out as deliveries which must be settled,
+// consumers stop when the context is cancelled or the queue closed. Closing
+// the queue drains the deliveries in flight first.
 type MessageQueue interface {
-	Produce(string, []byte) error
-	Consume(string, int, chan<- []byte) error
-	Close()
+	Produce(context.Context, string, Message) error
+	Consume(context.Context, string, int, chan<- Delivery) error
+	Close() error
 }
 
-// AmqpOptions is a simple settings container for AMQP queue
-type amqpOptions struct {
-	durable      bool
-	deleteUnused bool
-	exclusive    bool
-	noWait       bool
+// Broadcaster defines the behavior of a publish/subscribe middleware, every
+// subscriber of a topic receives a copy of each message published to it,
+// unlike queues where each message is consumed only once. Broadcast
+// deliveries need not be settled.
+type Broadcaster interface {
+	Publish(context.Context, string, Message) error
+	Subscribe(context.Context, string, chan<- Delivery) error
 }
 
-// amqpOption is an option pattern helper to set different options to an
-// `amqpOption` object
-type amqpOption func(*amqpOptions)
+// options is a simple settings container for the message queues, the AMQP
+// specific ones are ignored by the other transports
+type options struct {
+	durable       bool
+	deleteUnused  bool
+	exclusive     bool
+	noWait        bool
+	maxAttempts   int
+	drainTimeout  time.Duration
+	ackTimeout    time.Duration
+	maxLen        int64
+	group         string
+	exchange      string
+	bindings      map[string][]string
+	batchSize     int
+	batchInterval time.Duration
+	security      SecurityConfig
+}
 
-// Connect create a connection and a channel for RabbitMQ communication,
-// returning them into a pointer to an `AmqpQueue` object
-func Connect(url string, opts ...amqpOption) (*AmqpQueue, error) {
-	options := &amqpOptions{}
+// option is an option pattern helper to set different options to an
+// `options` object
+type option func(*options)
 
-	// Mix in all optionals
+// newOptions return the default options mixed with the optionals
+func newOptions(opts []option) *options {
+	o := &options{
+		maxAttempts:   DefaultMaxAttempts,
+		drainTimeout:  DefaultDrainTimeout,
+		ackTimeout:    DefaultAckTimeout,
+		maxLen:        DefaultMaxLen,
+		bindings:      make(map[string][]string),
+		batchInterval: DefaultBatchInterval,
+	}
 	for _, opt := range opts {
-		opt(options)
+		opt(o)
+	}
+	return o
+}
+
+// MaxAttempts set the number of times a message is delivered before being
+// dead-lettered
+func MaxAttempts(n int) option {
+	return func(o *options) {
+		o.maxAttempts = n
+	}
+}
+
+// DrainTimeout set the time given to the consumers to settle the deliveries
+// in flight when closing
+func DrainTimeout(d time.Duration) option {
+	return func(o *options) {
+		o.drainTimeout = d
+	}
+}
+
+// AckTimeout set the time given to a consumer to settle a delivery before
+// it's delivered again, e.g. because the consumer crashed, ignored by
+// RabbitMQ which redelivers as soon as the consumer goes away
+func AckTimeout(d time.Duration) option {
+	return func(o *options) {
+		o.ackTimeout = d
+	}
+}
+
+// MaxLen set the approximate number of messages a stream retains, the
+// oldest are trimmed, consumed or not, ignored by the transports without
+// streams
+func MaxLen(n int64) option {
+	return func(o *options) {
+		o.maxLen = n
+	}
+}
+
+// Group set the consumer group the consumers join, each group gets a copy
+// of every message of a queue, shared among its consumers, by default the
+// group is named after the queue. Ignored by the transports without
+// consumer groups.
+func Group(name string) option {
+	return func(o *options) {
+		o.group = name
+	}
+}
+
+// groupFor return the consumer group consuming a queue
+func (o *options) groupFor(queueName string) string {
+	if o.group != "" {
+		return o.group
+	}
+	return queueName
+}
+
+// Exchange set the topic exchange the messages produced are published to,
+// routed by the name they're produced with, which becomes a routing key
+// rather than the name of a queue. Queues consumed are bound to it, several
+// queues bound to the same keys get a copy each. Ignored by the transports
+// other than RabbitMQ.
+func Exchange(name string) option {
+	return func(o *options) {
+		o.exchange = name
+	}
+}
+
+// Bindings set the keys binding each queue to the exchange, patterns of
+// words separated by dots where `*` matches exactly one word and `#` zero
+// or more, by default a queue is bound by its own name
+func Bindings(bindings map[string][]string) option {
+	return func(o *options) {
+		for queueName, keys := range bindings {
+			o.bindings[queueName] = append(o.bindings[queueName], keys...)
+		}
+	}
+}
+
+// bindingsFor return the keys binding a queue to the exchange
+func (o *options) bindingsFor(queueName string) []string {
+	if keys := o.bindings[queueName]; len(keys) > 0 {
+		return keys
+	}
+	return []string{queueName}
+}
+
+// Batch set the messages produced to be buffered and published in batches,
+// once `size` messages are buffered or at least once every `interval`, the
+// confirmations of a batch are awaited at once. Producing a message that
+// fills a batch publishes it and returns the outcome, the others return as
+// soon as the message is buffered. Ignored by the transports other than
+// RabbitMQ.
+func Batch(size int, interval time.Duration) option {
+	return func(o *options) {
+		o.batchSize = size
+		if interval > 0 {
+			o.batchInterval = interval
+		}
+	}
+}
+
+// RoutingKey return a routing key made of a prefix followed by some words,
+// the dots in each word are replaced as they separate the words of a key,
+// empty words become `none`
+func RoutingKey(prefix string, words ...string) string {
+	key := prefix
+	for _, w := range words {
+		if w == "" {
+			w = "none"
+		}
+		key += "." + strings.ReplaceAll(w, ".", "_")
+	}
+	return key
+}
+
+// Dial connect to the message queue at an URL, the transport is selected by
+// the scheme of the URL, `amqp` or `amqps` for RabbitMQ, `nats` for NATS,
+// `redis` or `rediss` for Redis and `kafka` for Kafka. The credentials are
+// redacted from the errors returned.
+func Dial(rawurl string, opts ...option) (MessageQueue, error) {
+	mq, err := dial(rawurl, opts)
+	if err != nil {
+		return nil, redactedError{err}
+	}
+	return mq, nil
+}
+
+// dial connect to the message queue at an URL with the transport selected
+// by its scheme
+func dial(rawurl string, opts []option) (MessageQueue, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "amqp", "amqps":
+		return Connect(rawurl, opts...)
+	case "nats":
+		return ConnectNats(rawurl, opts...)
+	case "redis", "rediss":
+		return ConnectRedis(rawurl, opts...)
+	case "kafka":
+		return ConnectKafka(rawurl, opts...)
+	}
+	return nil, fmt.Errorf("unsupported message queue scheme %q", u.Scheme)
+}
+
+// Connect create a connection and a channel for RabbitMQ communication,
+// returning them into a pointer to an `AmqpQueue` object. Connections to
+// `amqps` URLs are secured by TLS, verified by the CA bundle set, if any,
+// authenticating with the client certificate set, if any.
+func Connect(url string, opts ...option) (*AmqpQueue, error) {
+	options := newOptions(opts)
+	config := amqp.Config{Heartbeat: 10 * time.Second, Locale: "en_US"}
+	tlsConfig, err := options.security.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.TLSClientConfig = tlsConfig
+	username, password, err := options.security.credentials(url)
+	if err != nil {
+		return nil, err
+	}
+	if password != "" {
+		config.SASL = []amqp.Authentication{
+			&amqp.PlainAuth{Username: username, Password: password},
+		}
 	}
-	conn, err := amqp.Dial(url)
+	conn, err := amqp.DialConfig(url, config)
 	if err != nil {
 		return nil, err
 	}
@@ -74,27 +303,95 @@ func Connect(url string, opts ...amqpOption) (*AmqpQueue, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &AmqpQueue{conn, options, channel}, nil
+	// Publish in confirm mode, tracking the confirmations asynchronously
+	if err := channel.Confirm(false); err != nil {
+		return nil, err
+	}
+	q := &AmqpQueue{
+		amqpConn:   conn,
+		connection: options,
+		channel:    channel,
+		confirms:   newConfirms(),
+		declared:   make(map[string]bool),
+		closing:    make(chan struct{}),
+	}
+	go q.confirms.listen(channel.NotifyPublish(make(chan amqp.Confirmation, 256)),
+		channel.NotifyReturn(make(chan amqp.Return, 16)))
+	if options.batchSize > 1 {
+		q.batch = &batch{size: options.batchSize}
+		q.consumers.Add(1)
+		go q.flushEvery(options.batchInterval)
+	}
+	return q, nil
 }
 
 // AmqpQueue is the main exposed object to work with, it's a `MessageQueue`
-// object
+// object. Messages are published on a shared channel in confirm mode, the
+// queues and exchanges published to are declared once, each consumer runs
+// on a dedicated channel.
 type AmqpQueue struct {
 	amqpConn   *amqp.Connection
-	connection *amqpOptions
+	connection *options
 	channel    *amqp.Channel
+	confirms   *confirms
+	batch      *batch
+	mutex      sync.Mutex
+	declared   map[string]bool
+	closed     bool
+	closing    chan struct{}
+	consumers  sync.WaitGroup
+}
+
+// ConfirmStats return the counters of the messages published
+func (q *AmqpQueue) ConfirmStats() ConfirmStats {
+	return q.confirms.Stats()
 }
 
-// Close a connection with RabbitMQ by closing the underlying connection and
+// Close a connection with RabbitMQ, stopping the consumers and waiting for
+// the deliveries in flight to be settled, up to the drain timeout, then
+// flushing the messages batched and closing the underlying connection and
 // the channel
-func (q AmqpQueue) Close() {
-	q.channel.Close()
-	q.amqpConn.Close()
+func (q *AmqpQueue) Close() error {
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.closing)
+	q.mutex.Unlock()
+
+	q.consumers.Wait()
+	var err error
+	if q.batch != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), q.connection.drainTimeout)
+		err = q.flush(ctx, q.batch.take())
+		cancel()
+	}
+	if cerr := q.channel.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := q.amqpConn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// addConsumer register a consumer to be waited for on close, false if the
+// queue is closed
+func (q *AmqpQueue) addConsumer() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return false
+	}
+	q.consumers.Add(1)
+	return true
 }
 
-// Produce publish a message to a define queue name
-func (q AmqpQueue) Produce(queueName string, item []byte) error {
-	queue, err := q.channel.QueueDeclare(
+// declare declare a queue with the options of the connection
+func (q *AmqpQueue) declare(channel *amqp.Channel, queueName string) (amqp.Queue, error) {
+	return channel.QueueDeclare(
 		queueName,                 // name
 		q.connection.durable,      // durable
 		q.connection.deleteUnused, // delete when unused
@@ -102,47 +399,344 @@ func (q AmqpQueue) Produce(queueName string, item []byte) error {
 		q.connection.noWait,       // no-wait
 		nil,                       // arguments
 	)
+}
+
+// declareTopicExchange declare the topic exchange set, if any
+func (q *AmqpQueue) declareTopicExchange(channel *amqp.Channel) error {
+	if q.connection.exchange == "" {
+		return nil
+	}
+	return channel.ExchangeDeclare(
+		q.connection.exchange, // name
+		"topic",               // type
+		true,                  // durable
+		false,                 // auto-deleted
+		false,                 // internal
+		false,                 // no-wait
+		nil,                   // arguments
+	)
+}
+
+// declareOnce declare a queue or an exchange on the shared channel the
+// first time it's published to
+func (q *AmqpQueue) declareOnce(name string, declare func() error) error {
+	q.mutex.Lock()
+	declared := q.declared[name]
+	q.mutex.Unlock()
+	if declared {
+		return nil
+	}
+	if err := declare(); err != nil {
+		return err
+	}
+	q.mutex.Lock()
+	q.declared[name] = true
+	q.mutex.Unlock()
+	return nil
+}
+
+// publish publish a message on the shared channel, return a channel
+// receiving the outcome of its confirmation
+func (q *AmqpQueue) publish(exchange, key string, mandatory bool, p amqp.Publishing) (<-chan error, error) {
+	return q.confirms.publish(func() error {
+		return q.channel.Publish(
+			exchange,  // exchange
+			key,       // routing key
+			mandatory, // mandatory
+			false,     // immediate
+			p,
+		)
+	})
+}
+
+// Produce publish a message to a define queue name, or to the exchange set
+// with the name as routing key, waiting for the broker to confirm it.
+// Messages not matching the bindings of any queue are dropped, counted as
+// returned. With batching set the message is buffered, the call filling
+// the batch publishes it.
+func (q *AmqpQueue) Produce(ctx context.Context, queueName string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-q.closing:
+		return ErrClosed
+	default:
+	}
+	if q.batch == nil {
+		return q.flush(ctx, []outgoing{{queueName, msg}})
+	}
+	if messages := q.batch.add(queueName, msg); messages != nil {
+		return q.flush(ctx, messages)
+	}
+	return nil
+}
+
+// flush publish some messages at once and wait for the broker to confirm
+// them, return an error if any of them is not
+func (q *AmqpQueue) flush(ctx context.Context, messages []outgoing) error {
+	confirmations := make([]<-chan error, 0, len(messages))
+	for _, m := range messages {
+		exchange, key := q.connection.exchange, m.name
+		var err error
+		if exchange != "" {
+			err = q.declareOnce("exchange:"+exchange, func() error {
+				return q.declareTopicExchange(q.channel)
+			})
+		} else {
+			err = q.declareOnce("queue:"+key, func() error {
+				_, err := q.declare(q.channel, key)
+				return err
+			})
+		}
+		if err != nil {
+			return err
+		}
+		confirmation, err := q.publish(exchange, key, true, publishing(m.msg))
+		if err != nil {
+			return err
+		}
+		confirmations = append(confirmations, confirmation)
+	}
+	nacked := 0
+	for _, confirmation := range confirmations {
+		select {
+		case err := <-confirmation:
+			if err == ErrNacked {
+				nacked++
+			} else if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if nacked > 0 {
+		return fmt.Errorf("%d of %d messages: %w", nacked, len(messages), ErrNacked)
+	}
+	return nil
+}
+
+// flushEvery flush the messages batched once every interval, until the
+// queue is closed
+func (q *AmqpQueue) flushEvery(interval time.Duration) {
+	defer q.consumers.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-q.closing
+		cancel()
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Failures are tracked by the confirm counters
+			q.flush(ctx, q.batch.take())
+		case <-q.closing:
+			return
+		}
+	}
+}
+
+// bind bind a queue to the exchange set, if any, by its binding keys
+func (q *AmqpQueue) bind(channel *amqp.Channel, queueName string) error {
+	if q.connection.exchange == "" {
+		return nil
+	}
+	if err := q.declareTopicExchange(channel); err != nil {
+		return err
+	}
+	for _, key := range q.connection.bindingsFor(queueName) {
+		err := channel.QueueBind(
+			queueName,             // queue
+			key,                   // routing key
+			q.connection.exchange, // exchange
+			false,                 // no-wait
+			nil,                   // arguments
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Consume subscribe to a queue, bound to the exchange set if any, and block
+// consuming all messages incoming until the context is cancelled or the
+// queue closed, a concurrency value can be set to consume multiple messages
+// at once, that is the number of deliveries not yet settled. Before
+// returning, the deliveries handed out are given time to be settled, those
+// not settled are delivered again.
+func (q *AmqpQueue) Consume(ctx context.Context, queueName string,
+	concurrency int, itemChan chan<- Delivery) error {
+	if !q.addConsumer() {
+		return ErrClosed
+	}
+	defer q.consumers.Done()
+
+	channel, err := q.amqpConn.Channel()
 	if err != nil {
 		return err
 	}
+	var inflight sync.WaitGroup
+	defer func() {
+		drain(&inflight, q.connection.drainTimeout)
+		channel.Close()
+	}()
 
-	err = q.channel.Publish(
-		"",         // exchange
-		queue.Name, // routing key
-		false,      // mandatory
-		false,      // immediate
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        item,
-		},
+	queue, err := q.declare(channel, queueName)
+	if err != nil {
+		return err
+	}
+	if err := q.bind(channel, queue.Name); err != nil {
+		return err
+	}
+
+	// pre-fetch `concurrency` message at once
+	err = channel.Qos(concurrency, 0, false)
+	if err != nil {
+		return err
+	}
+
+	msgs, err := channel.Consume(
+		queue.Name, // queue
+		"",         // consumer
+		false,      // auto-ack
+		false,      // exclusive
+		false,      // no-local
+		false,      // no-wait
+		nil,        // args
 	)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	for {
+		select {
+		case d, ok := <-msgs:
+			if !ok {
+				return ErrRabbitMq
+			}
+			inflight.Add(1)
+			select {
+			case itemChan <- q.delivery(channel, queue.Name, d, inflight.Done):
+			case <-ctx.Done():
+				// Not handed out, requeued on channel close
+				inflight.Done()
+				return nil
+			case <-q.closing:
+				inflight.Done()
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		case <-q.closing:
+			return nil
+		}
+	}
 }
 
-// Consume subscribe to a queue and block consuming all messages incoming, a
-// concurrency value can be set to consume multiple messages at once
-func (q AmqpQueue) Consume(queueName string, concurrency int,
-	itemChan chan<- []byte) error {
-	queue, err := q.channel.QueueDeclare(
-		queueName,                 // name
-		q.connection.durable,      // durable
-		q.connection.deleteUnused, // delete when unused
-		q.connection.exclusive,    // exclusive
-		q.connection.noWait,       // no-wait
-		nil,                       // arguments
+// drain wait for the deliveries in flight to be settled, up to a timeout
+func drain(inflight *sync.WaitGroup, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// declareExchange declare the fanout exchange of a topic
+func declareExchange(channel *amqp.Channel, topic string) error {
+	return channel.ExchangeDeclare(
+		topic,    // name
+		"fanout", // type
+		false,    // durable
+		false,    // auto-deleted
+		false,    // internal
+		false,    // no-wait
+		nil,      // arguments
+	)
+}
+
+// Publish broadcast a message to every subscriber of a topic, backed by a
+// fanout exchange named after the topic, waiting for the broker to confirm
+// it
+func (q *AmqpQueue) Publish(ctx context.Context, topic string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := q.declareOnce("fanout:"+topic, func() error {
+		return declareExchange(q.channel, topic)
+	})
+	if err != nil {
+		return err
+	}
+	confirmation, err := q.publish(topic, "", false, publishing(msg))
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-confirmation:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Subscribe bind an exclusive queue to the fanout exchange of a topic and
+// block consuming all messages published to it until the context is
+// cancelled or the queue closed
+func (q *AmqpQueue) Subscribe(ctx context.Context, topic string, itemChan chan<- Delivery) error {
+	if !q.addConsumer() {
+		return ErrClosed
+	}
+	defer q.consumers.Done()
+
+	channel, err := q.amqpConn.Channel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	if err := declareExchange(channel, topic); err != nil {
+		return err
+	}
+
+	// Server named queue, deleted as soon as the subscriber goes away
+	queue, err := channel.QueueDeclare(
+		"",    // name
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
 	)
 	if err != nil {
 		return err
 	}
 
-	msgs, err := q.channel.Consume(
+	err = channel.QueueBind(
+		queue.Name, // queue
+		"",         // routing key
+		topic,      // exchange
+		false,      // no-wait
+		nil,        // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	msgs, err := channel.Consume(
 		queue.Name, // queue
 		"",         // consumer
 		true,       // auto-ack
-		false,      // exclusive
+		true,       // exclusive
 		false,      // no-local
 		false,      // no-wait
 		nil,        // args
@@ -151,22 +745,247 @@ func (q AmqpQueue) Consume(queueName string, concurrency int,
 		return err
 	}
 
-	// pre-fetch `concurrency` message at once
-	err = q.channel.Qos(concurrency, 0, false)
+	for {
+		select {
+		case d, ok := <-msgs:
+			if !ok {
+				return ErrRabbitMq
+			}
+			select {
+			case itemChan <- NewDelivery(message(d), 1, nil):
+			case <-ctx.Done():
+				return nil
+			case <-q.closing:
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		case <-q.closing:
+			return nil
+		}
+	}
+}
+
+// publishing return the AMQP publishing of a message, the id of the agent
+// producing it is carried as the application id
+func publishing(msg Message) amqp.Publishing {
+	p := amqp.Publishing{
+		ContentType: msg.Headers.ContentType,
+		AppId:       msg.Headers.AgentID,
+		Timestamp:   msg.Headers.Timestamp,
+		Body:        msg.Body,
+	}
+	if msg.Headers.SchemaVersion > 0 {
+		p.Headers = amqp.Table{schemaVersionHeader: int32(msg.Headers.SchemaVersion)}
+	}
+	return p
+}
+
+// message return the message of an AMQP delivery
+func message(d amqp.Delivery) Message {
+	return Message{
+		Body: d.Body,
+		Headers: Headers{
+			ContentType:   d.ContentType,
+			SchemaVersion: headerInt(d.Headers, schemaVersionHeader),
+			AgentID:       d.AppId,
+			Timestamp:     d.Timestamp,
+		},
+	}
+}
+
+// delivery wrap a message consumed from a queue on a channel into a
+// `Delivery` settled on the same channel, `settled` is called once it is.
+// The attempts are carried by the messages redelivered, a message
+// redelivered by the broker, e.g. after a consumer crashed, counts as an
+// attempt as well.
+func (q *AmqpQueue) delivery(channel *amqp.Channel, queueName string,
+	d amqp.Delivery, settled func()) Delivery {
+	attempts := headerInt(d.Headers, attemptsHeader) + 1
+	if d.Redelivered {
+		attempts++
+	}
+	return NewDelivery(message(d), attempts, &amqpAcker{
+		channel:     channel,
+		delivery:    d,
+		queue:       queueName,
+		attempts:    attempts,
+		maxAttempts: q.connection.maxAttempts,
+		settled:     settled,
+	})
+}
+
+// amqpAcker settles an AMQP delivery, messages rejected are published again
+// to the queue or to its dead-letter queue and acknowledged, as the broker
+// does not track the attempts of messages requeued
+type amqpAcker struct {
+	channel     *amqp.Channel
+	delivery    amqp.Delivery
+	queue       string
+	attempts    int
+	maxAttempts int
+	settled     func()
+	once        sync.Once
+}
+
+// Ack acknowledge the delivery
+func (a *amqpAcker) Ack() error {
+	defer a.once.Do(a.settled)
+	return a.delivery.Ack(false)
+}
+
+// Nack publish the message to the tail of the queue it was consumed from,
+// or to the dead-letter queue once the attempts are exhausted or if not to
+// be requeued, acknowledging the delivery
+func (a *amqpAcker) Nack(requeue bool, reason error) error {
+	defer a.once.Do(a.settled)
+	p := publishing(message(a.delivery))
+	p.Headers = amqp.Table{}
+	for k, v := range a.delivery.Headers {
+		p.Headers[k] = v
+	}
+	p.Headers[attemptsHeader] = int32(a.attempts)
+	if requeue && a.attempts < a.maxAttempts {
+		err := a.channel.Publish(
+			"",      // exchange
+			a.queue, // routing key
+			false,   // mandatory
+			false,   // immediate
+			p,
+		)
+		if err != nil {
+			return err
+		}
+		return a.delivery.Ack(false)
+	}
+	deadLetterQueue, err := declareDeadLetterQueue(a.channel, a.queue)
+	if err != nil {
+		return err
+	}
+	p.Headers[queueHeader] = a.queue
+	p.Headers[deadAtHeader] = time.Now()
+	if reason != nil {
+		p.Headers[reasonHeader] = reason.Error()
+	}
+	p.DeliveryMode = amqp.Persistent
+	err = a.channel.Publish(
+		"",              // exchange
+		deadLetterQueue, // routing key
+		false,           // mandatory
+		false,           // immediate
+		p,
+	)
 	if err != nil {
 		return err
 	}
+	return a.delivery.Ack(false)
+}
 
-	forever := make(chan error)
+// declareDeadLetterQueue declare the durable dead-letter queue of a queue,
+// return its name
+func declareDeadLetterQueue(channel *amqp.Channel, queueName string) (string, error) {
+	queue, err := channel.QueueDeclare(
+		DeadLetterQueueName(queueName), // name
+		true,                           // durable
+		false,                          // delete when unused
+		false,                          // exclusive
+		false,                          // no-wait
+		nil,                            // arguments
+	)
+	return queue.Name, err
+}
 
-	// Forever consume messages and push them into the channel for the client
-	go func() {
-		for d := range msgs {
-			itemChan <- d.Body
+// headerInt return the value of an integer header, 0 if missing
+func headerInt(headers amqp.Table, name string) int {
+	switch v := headers[name].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+// DeadLetters return the messages in the dead-letter queue of a queue
+// without removing them, up to `limit` messages, all of them if not
+// positive. The messages are fetched without acknowledgement on a dedicated
+// channel, closing it puts them back.
+func (q *AmqpQueue) DeadLetters(queueName string, limit int) ([]DeadLetter, error) {
+	channel, err := q.amqpConn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	defer channel.Close()
+
+	deadLetterQueue, err := declareDeadLetterQueue(channel, queueName)
+	if err != nil {
+		return nil, err
+	}
+	var letters []DeadLetter
+	for limit <= 0 || len(letters) < limit {
+		d, ok, err := channel.Get(deadLetterQueue, false)
+		if err != nil {
+			return nil, err
 		}
-		forever <- ErrRabbitMq
-	}()
+		if !ok {
+			break
+		}
+		reason, _ := d.Headers[reasonHeader].(string)
+		deadAt, _ := d.Headers[deadAtHeader].(time.Time)
+		letters = append(letters, DeadLetter{
+			Queue:    queueName,
+			Message:  message(d),
+			Attempts: headerInt(d.Headers, attemptsHeader),
+			Reason:   reason,
+			DeadAt:   deadAt,
+		})
+	}
+	return letters, nil
+}
 
-	err = <-forever
-	return err
+// Replay move the messages in the dead-letter queue of a queue back to the
+// queue, up to `limit` messages, all of them if not positive, their
+// attempts are reset. Return the number of messages replayed.
+func (q *AmqpQueue) Replay(queueName string, limit int) (int, error) {
+	channel, err := q.amqpConn.Channel()
+	if err != nil {
+		return 0, err
+	}
+	defer channel.Close()
+
+	deadLetterQueue, err := declareDeadLetterQueue(channel, queueName)
+	if err != nil {
+		return 0, err
+	}
+	queue, err := q.declare(channel, queueName)
+	if err != nil {
+		return 0, err
+	}
+	replayed := 0
+	for limit <= 0 || replayed < limit {
+		d, ok, err := channel.Get(deadLetterQueue, false)
+		if err != nil {
+			return replayed, err
+		}
+		if !ok {
+			break
+		}
+		err = channel.Publish(
+			"",         // exchange
+			queue.Name, // routing key
+			false,      // mandatory
+			false,      // immediate
+			publishing(message(d)),
+		)
+		if err != nil {
+			return replayed, err
+		}
+		if err := d.Ack(false); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, nil
 }
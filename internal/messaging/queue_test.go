@@ -0,0 +1,70 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package messaging
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoutingKey(t *testing.T) {
+	cases := []struct {
+		words []string
+		want  string
+	}{
+		{[]string{"eu-west", "web"}, "status.eu-west.web"},
+		{[]string{"", "web"}, "status.none.web"},
+		{[]string{"eu.west", "db"}, "status.eu_west.db"},
+		{nil, "status"},
+	}
+	for _, c := range cases {
+		if got := RoutingKey("status", c.words...); got != c.want {
+			t.Errorf("RoutingKey failed: expected %s got %s\n", c.want, got)
+		}
+	}
+}
+
+func TestBindings(t *testing.T) {
+	o := newOptions([]option{
+		Exchange("overseer"),
+		Bindings(map[string][]string{"urlstatus": {"status.#"}}),
+		Bindings(map[string][]string{"archive": {"status.eu.*", "status.us.*"}}),
+	})
+	if o.exchange != "overseer" {
+		t.Errorf("Exchange failed: expected overseer got %s\n", o.exchange)
+	}
+	cases := map[string][]string{
+		"urlstatus": {"status.#"},
+		"archive":   {"status.eu.*", "status.us.*"},
+		"stats":     {"stats"},
+	}
+	for queue, want := range cases {
+		if got := o.bindingsFor(queue); !reflect.DeepEqual(got, want) {
+			t.Errorf("bindingsFor(%s) failed: expected %v got %v\n", queue, want, got)
+		}
+	}
+}
@@ -0,0 +1,562 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// bodyField is the field of the stream entries carrying the body of the
+// messages, the others carry the headers
+const bodyField = "body"
+
+// redisReadTimeout is the longest a consumer blocks waiting for a message
+// before checking whether to stop or to reclaim the pending messages
+const redisReadTimeout = time.Second
+
+// ConnectRedis create a client connected to a Redis server, returning it
+// into a pointer to a `RedisQueue` object. Connections to `rediss` URLs, or
+// with a CA bundle or a client certificate set, are secured by TLS.
+func ConnectRedis(url string, opts ...option) (*RedisQueue, error) {
+	options := newOptions(opts)
+	redisOptions, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := options.security.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		host, _, _ := net.SplitHostPort(redisOptions.Addr)
+		tlsConfig.ServerName = host
+		redisOptions.TLSConfig = tlsConfig
+	}
+	redisOptions.Username, redisOptions.Password, err = options.security.credentials(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(redisOptions)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &RedisQueue{
+		client:  client,
+		options: options,
+		groups:  make(map[string]bool),
+		closing: make(chan struct{}),
+	}, nil
+}
+
+// RedisQueue is a `MessageQueue` backed by Redis Streams. Each queue is a
+// stream trimmed to about `MaxLen` entries, consumed through a consumer
+// group shared by every instance consuming the queue, named after the queue
+// unless set with `Group`. The
+// messages left pending by a consumer for longer than the ack timeout, e.g.
+// because it crashed, are claimed by the others. Topics are Redis Pub/Sub
+// channels, without durability.
+type RedisQueue struct {
+	client    *redis.Client
+	options   *options
+	mutex     sync.Mutex
+	groups    map[string]bool
+	closed    bool
+	closing   chan struct{}
+	consumers sync.WaitGroup
+}
+
+// Close the connection with Redis, stopping the consumers and waiting for
+// the deliveries in flight to be settled, up to the drain timeout
+func (q *RedisQueue) Close() error {
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.closing)
+	q.mutex.Unlock()
+
+	q.consumers.Wait()
+	return q.client.Close()
+}
+
+// addConsumer register a consumer to be waited for on close, false if the
+// queue is closed
+func (q *RedisQueue) addConsumer() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return false
+	}
+	q.consumers.Add(1)
+	return true
+}
+
+// declare create the consumer group consuming a queue if missing, along
+// with its stream, the queues already declared are cached. The group starts from
+// the first entry, to consume the messages produced before any consumer.
+func (q *RedisQueue) declare(ctx context.Context, queueName string) error {
+	q.mutex.Lock()
+	declared := q.groups[queueName]
+	q.mutex.Unlock()
+	if declared {
+		return nil
+	}
+	err := q.client.XGroupCreateMkStream(ctx, queueName, q.options.groupFor(queueName), "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	q.mutex.Lock()
+	q.groups[queueName] = true
+	q.mutex.Unlock()
+	return nil
+}
+
+// add append a message to a stream, trimming it to about `MaxLen` entries
+func (q *RedisQueue) add(ctx context.Context, pipe redis.Cmdable, stream string, values map[string]interface{}) error {
+	return pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: q.options.maxLen,
+		Approx: true,
+		Values: values,
+	}).Err()
+}
+
+// Produce publish a message to a queue
+func (q *RedisQueue) Produce(ctx context.Context, queueName string, msg Message) error {
+	return q.add(ctx, q.client, queueName, redisValues(msg))
+}
+
+// redisEntry is an entry of a stream read by a consumer, along with the
+// number of times it has been delivered
+type redisEntry struct {
+	redis.XMessage
+	attempts int
+}
+
+// Consume read the messages of a queue as a member of its consumer group
+// and block handing them out until the context is cancelled or the queue
+// closed, a concurrency value can be set to consume multiple messages at
+// once, that is the number of deliveries not yet settled. Before returning,
+// the deliveries handed out are given time to be settled, those not settled
+// are claimed by another consumer once the ack timeout expires.
+func (q *RedisQueue) Consume(ctx context.Context, queueName string,
+	concurrency int, itemChan chan<- Delivery) error {
+	if !q.addConsumer() {
+		return ErrClosed
+	}
+	defer q.consumers.Done()
+
+	if err := q.declare(ctx, queueName); err != nil {
+		return err
+	}
+	var inflight sync.WaitGroup
+	defer drain(&inflight, q.options.drainTimeout)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-q.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	consumer := consumerName()
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	var (
+		claimed   []redisEntry
+		reclaimed time.Time
+	)
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+		if len(claimed) == 0 && time.Since(reclaimed) >= q.options.ackTimeout/2 {
+			entries, err := q.reclaim(ctx, queueName, consumer, int64(concurrency))
+			if err != nil && ctx.Err() == nil {
+				return err
+			}
+			claimed, reclaimed = entries, time.Now()
+		}
+		var entry redisEntry
+		if len(claimed) > 0 {
+			entry, claimed = claimed[0], claimed[1:]
+		} else {
+			streams, err := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group:    q.options.groupFor(queueName),
+				Consumer: consumer,
+				Streams:  []string{queueName, ">"},
+				Count:    1,
+				Block:    redisReadTimeout,
+			}).Result()
+			if err != nil {
+				<-slots
+				if ctx.Err() != nil {
+					return nil
+				}
+				if errors.Is(err, redis.Nil) {
+					continue
+				}
+				return err
+			}
+			if len(streams) == 0 || len(streams[0].Messages) == 0 {
+				<-slots
+				continue
+			}
+			m := streams[0].Messages[0]
+			entry = redisEntry{m, headerValue(m.Values, attemptsHeader) + 1}
+		}
+
+		inflight.Add(1)
+		settled := func() {
+			<-slots
+			inflight.Done()
+		}
+		d := q.delivery(queueName, entry, settled)
+		if entry.attempts > q.options.maxAttempts {
+			// Left pending by consumers gone away too many times
+			d.Nack(false, errors.New("delivery attempts exhausted"))
+			continue
+		}
+		select {
+		case itemChan <- d:
+		case <-ctx.Done():
+			// Not handed out, left pending to be claimed again
+			settled()
+			return nil
+		}
+	}
+}
+
+// reclaim claim up to `count` messages of a queue left pending by other
+// consumers for longer than the ack timeout, the messages still pending
+// within it are skipped by Redis, requiring Redis 6.2 or later
+func (q *RedisQueue) reclaim(ctx context.Context, queueName, consumer string, count int64) ([]redisEntry, error) {
+	pending, err := q.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: queueName,
+		Group:  q.options.groupFor(queueName),
+		Idle:   q.options.ackTimeout,
+		Start:  "-",
+		End:    "+",
+		Count:  count,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	retries := make(map[string]int64, len(pending))
+	ids := make([]string, 0, len(pending))
+	for _, p := range pending {
+		retries[p.ID] = p.RetryCount
+		ids = append(ids, p.ID)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	msgs, err := q.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   queueName,
+		Group:    q.options.groupFor(queueName),
+		Consumer: consumer,
+		MinIdle:  q.options.ackTimeout,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]redisEntry, 0, len(msgs))
+	for _, m := range msgs {
+		attempts := headerValue(m.Values, attemptsHeader) + int(retries[m.ID]) + 1
+		entries = append(entries, redisEntry{m, attempts})
+	}
+	return entries, nil
+}
+
+// consumerName return a name unique to each consumer of a group
+func consumerName() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano())
+}
+
+// redisBroadcast is a message published to a Pub/Sub channel, which carries
+// no headers
+type redisBroadcast struct {
+	Headers map[string]string `json:"headers"`
+	Body    []byte            `json:"body"`
+}
+
+// Publish broadcast a message to every subscriber of a topic, a Pub/Sub
+// channel named after the topic
+func (q *RedisQueue) Publish(ctx context.Context, topic string, msg Message) error {
+	payload, err := json.Marshal(redisBroadcast{redisHeaders(msg), msg.Body})
+	if err != nil {
+		return err
+	}
+	return q.client.Publish(ctx, topic, payload).Err()
+}
+
+// Subscribe subscribe to the Pub/Sub channel of a topic and block handing
+// out all messages published to it until the context is cancelled or the
+// queue closed
+func (q *RedisQueue) Subscribe(ctx context.Context, topic string, itemChan chan<- Delivery) error {
+	if !q.addConsumer() {
+		return ErrClosed
+	}
+	defer q.consumers.Done()
+
+	pubsub := q.client.Subscribe(ctx, topic)
+	defer pubsub.Close()
+	// Wait for the subscription to be confirmed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return err
+	}
+
+	msgs := pubsub.Channel()
+	for {
+		select {
+		case m, ok := <-msgs:
+			if !ok {
+				return ErrClosed
+			}
+			var b redisBroadcast
+			if err := json.Unmarshal([]byte(m.Payload), &b); err != nil {
+				continue
+			}
+			values := make(map[string]interface{}, len(b.Headers))
+			for k, v := range b.Headers {
+				values[k] = v
+			}
+			select {
+			case itemChan <- NewDelivery(redisMessageOf(values, b.Body), 1, nil):
+			case <-ctx.Done():
+				return nil
+			case <-q.closing:
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		case <-q.closing:
+			return nil
+		}
+	}
+}
+
+// redisHeaders return the headers of a message as strings
+func redisHeaders(msg Message) map[string]string {
+	headers := make(map[string]string)
+	if msg.Headers.ContentType != "" {
+		headers[contentTypeHeader] = msg.Headers.ContentType
+	}
+	if msg.Headers.AgentID != "" {
+		headers[agentIDHeader] = msg.Headers.AgentID
+	}
+	if !msg.Headers.Timestamp.IsZero() {
+		headers[timestampHeader] = msg.Headers.Timestamp.Format(time.RFC3339Nano)
+	}
+	if msg.Headers.SchemaVersion > 0 {
+		headers[schemaVersionHeader] = strconv.Itoa(msg.Headers.SchemaVersion)
+	}
+	return headers
+}
+
+// redisValues return the fields of the stream entry of a message
+func redisValues(msg Message) map[string]interface{} {
+	values := map[string]interface{}{bodyField: msg.Body}
+	for k, v := range redisHeaders(msg) {
+		values[k] = v
+	}
+	return values
+}
+
+// headerString return the value of a field of a stream entry, empty if
+// missing
+func headerString(values map[string]interface{}, name string) string {
+	v, _ := values[name].(string)
+	return v
+}
+
+// headerValue return the value of an integer field of a stream entry, 0 if
+// missing
+func headerValue(values map[string]interface{}, name string) int {
+	n, _ := strconv.Atoi(headerString(values, name))
+	return n
+}
+
+// redisMessageOf return the message of the fields of a stream entry and its
+// body
+func redisMessageOf(values map[string]interface{}, body []byte) Message {
+	timestamp, _ := time.Parse(time.RFC3339Nano, headerString(values, timestampHeader))
+	return Message{
+		Body: body,
+		Headers: Headers{
+			ContentType:   headerString(values, contentTypeHeader),
+			SchemaVersion: headerValue(values, schemaVersionHeader),
+			AgentID:       headerString(values, agentIDHeader),
+			Timestamp:     timestamp,
+		},
+	}
+}
+
+// delivery wrap an entry read from a queue into a `Delivery`, `settled` is
+// called once it is
+func (q *RedisQueue) delivery(queueName string, entry redisEntry, settled func()) Delivery {
+	body := []byte(headerString(entry.Values, bodyField))
+	return NewDelivery(redisMessageOf(entry.Values, body), entry.attempts, &redisAcker{
+		queue:   q,
+		name:    queueName,
+		entry:   entry,
+		settled: settled,
+	})
+}
+
+// redisAcker settles a stream entry, messages rejected are appended again
+// to the stream or to its dead-letter stream and acknowledged, as Redis
+// does not requeue the messages pending
+type redisAcker struct {
+	queue   *RedisQueue
+	name    string
+	entry   redisEntry
+	settled func()
+	once    sync.Once
+}
+
+// Ack acknowledge the delivery
+func (a *redisAcker) Ack() error {
+	defer a.once.Do(a.settled)
+	return a.queue.client.XAck(context.Background(), a.name,
+		a.queue.options.groupFor(a.name), a.entry.ID).Err()
+}
+
+// Nack append the message to the tail of the queue it was consumed from,
+// or to the dead-letter queue once the attempts are exhausted or if not to
+// be requeued, acknowledging the delivery in the same transaction
+func (a *redisAcker) Nack(requeue bool, reason error) error {
+	defer a.once.Do(a.settled)
+	ctx := context.Background()
+	values := make(map[string]interface{}, len(a.entry.Values))
+	for k, v := range a.entry.Values {
+		values[k] = v
+	}
+	values[attemptsHeader] = strconv.Itoa(a.entry.attempts)
+	stream := a.name
+	if !requeue || a.entry.attempts >= a.queue.options.maxAttempts {
+		stream = DeadLetterQueueName(a.name)
+		values[queueHeader] = a.name
+		values[deadAtHeader] = time.Now().Format(time.RFC3339Nano)
+		if reason != nil {
+			values[reasonHeader] = reason.Error()
+		}
+	}
+	_, err := a.queue.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if err := a.queue.add(ctx, pipe, stream, values); err != nil {
+			return err
+		}
+		return pipe.XAck(ctx, a.name, a.queue.options.groupFor(a.name), a.entry.ID).Err()
+	})
+	return err
+}
+
+// DeadLetters return the messages in the dead-letter queue of a queue
+// without removing them, up to `limit` messages, all of them if not
+// positive
+func (q *RedisQueue) DeadLetters(queueName string, limit int) ([]DeadLetter, error) {
+	msgs, err := q.deadLetters(queueName, limit)
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]DeadLetter, 0, len(msgs))
+	for _, m := range msgs {
+		deadAt, _ := time.Parse(time.RFC3339Nano, headerString(m.Values, deadAtHeader))
+		body := []byte(headerString(m.Values, bodyField))
+		letters = append(letters, DeadLetter{
+			Queue:    queueName,
+			Message:  redisMessageOf(m.Values, body),
+			Attempts: headerValue(m.Values, attemptsHeader),
+			Reason:   headerString(m.Values, reasonHeader),
+			DeadAt:   deadAt,
+		})
+	}
+	return letters, nil
+}
+
+// deadLetters return the entries of the dead-letter stream of a queue,
+// oldest first, up to `limit` entries, all of them if not positive
+func (q *RedisQueue) deadLetters(queueName string, limit int) ([]redis.XMessage, error) {
+	ctx := context.Background()
+	if limit > 0 {
+		return q.client.XRangeN(ctx, DeadLetterQueueName(queueName), "-", "+", int64(limit)).Result()
+	}
+	return q.client.XRange(ctx, DeadLetterQueueName(queueName), "-", "+").Result()
+}
+
+// Replay move the messages in the dead-letter queue of a queue back to the
+// queue, up to `limit` messages, all of them if not positive, their
+// attempts are reset. Return the number of messages replayed.
+func (q *RedisQueue) Replay(queueName string, limit int) (int, error) {
+	msgs, err := q.deadLetters(queueName, limit)
+	if err != nil {
+		return 0, err
+	}
+	ctx := context.Background()
+	replayed := 0
+	for _, m := range msgs {
+		body := []byte(headerString(m.Values, bodyField))
+		_, err := q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			msg := redisMessageOf(m.Values, body)
+			if err := q.add(ctx, pipe, queueName, redisValues(msg)); err != nil {
+				return err
+			}
+			return pipe.XDel(ctx, DeadLetterQueueName(queueName), m.ID).Err()
+		})
+		if err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, nil
+}
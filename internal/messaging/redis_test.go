@@ -0,0 +1,222 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package messaging
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// runRedis start an in-process Redis server, return a queue connected to it
+func runRedis(t *testing.T, opts ...option) (*RedisQueue, *miniredis.Miniredis) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq, err := Dial("redis://"+s.Addr(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		mq.Close()
+		s.Close()
+	})
+	return mq.(*RedisQueue), s
+}
+
+func TestRedisProduceConsume(t *testing.T) {
+	mq, _ := runRedis(t, MaxAttempts(2))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Produced before any consumer group exists
+	msg, _ := Encode(MsgPack, "agent-1", sample{"http://example.com", true})
+	if err := mq.Produce(ctx, "urlstatus", msg); err != nil {
+		t.Fatal(err)
+	}
+	deliveries := make(chan Delivery)
+	go mq.Consume(ctx, "urlstatus", 1, deliveries)
+
+	d := receive(t, deliveries)
+	var s sample
+	if err := d.Decode(&s); err != nil || s.Url != "http://example.com" {
+		t.Errorf("Consume failed: expected http://example.com got %v (%v)\n", s.Url, err)
+	}
+	if d.Headers.ContentType != "application/x-msgpack" || d.Headers.AgentID != "agent-1" ||
+		!d.Headers.Timestamp.Equal(msg.Headers.Timestamp) || d.Attempts != 1 {
+		t.Errorf("Consume failed: expected headers %v got %v (attempts %d)\n", msg.Headers, d.Headers, d.Attempts)
+	}
+
+	d.Nack(true, errors.New("first"))
+	d = receive(t, deliveries)
+	if d.Attempts != 2 {
+		t.Errorf("Nack failed: expected attempt 2 got %d\n", d.Attempts)
+	}
+	d.Nack(true, errors.New("second"))
+
+	letters, err := mq.DeadLetters("urlstatus", 0)
+	if err != nil || len(letters) != 1 || letters[0].Reason != "second" || letters[0].Attempts != 2 ||
+		letters[0].Queue != "urlstatus" || letters[0].Headers.AgentID != "agent-1" {
+		t.Fatalf("DeadLetters failed: unexpected dead letters %v (%v)\n", letters, err)
+	}
+
+	n, err := mq.Replay("urlstatus", 0)
+	if err != nil || n != 1 {
+		t.Errorf("Replay failed: expected 1 got %d (%v)\n", n, err)
+	}
+	d = receive(t, deliveries)
+	if d.Attempts != 1 {
+		t.Errorf("Replay failed: expected the attempts reset got %d\n", d.Attempts)
+	}
+	if err := d.Decode(&s); err != nil || s.Url != "http://example.com" {
+		t.Errorf("Replay failed: expected http://example.com got %v (%v)\n", s.Url, err)
+	}
+	d.Ack()
+	if letters, _ := mq.DeadLetters("urlstatus", 0); len(letters) != 0 {
+		t.Errorf("Replay failed: expected no dead letters got %v\n", letters)
+	}
+}
+
+func TestRedisReclaim(t *testing.T) {
+	mq, _ := runRedis(t, AckTimeout(100*time.Millisecond), DrainTimeout(10*time.Millisecond), MaxAttempts(2))
+	msg, _ := Encode(JSON, "agent-1", sample{"http://example.com", true})
+	mq.Produce(context.Background(), "urlstatus", msg)
+
+	// The first consumer goes away without settling the delivery
+	ctx, cancel := context.WithCancel(context.Background())
+	deliveries := make(chan Delivery)
+	done := make(chan error)
+	go func() { done <- mq.Consume(ctx, "urlstatus", 1, deliveries) }()
+	receive(t, deliveries)
+	cancel()
+	<-done
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { done <- mq.Consume(ctx, "urlstatus", 1, deliveries) }()
+	d := receive(t, deliveries)
+	if d.Attempts != 2 {
+		t.Errorf("Consume failed: expected the message claimed at attempt 2 got %d\n", d.Attempts)
+	}
+	cancel()
+	<-done
+
+	// Left pending once more, dead-lettered as the attempts are exhausted
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go mq.Consume(ctx, "urlstatus", 1, deliveries)
+	var letters []DeadLetter
+	for i := 0; i < 300 && len(letters) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		letters, _ = mq.DeadLetters("urlstatus", 0)
+	}
+	if len(letters) != 1 || letters[0].Attempts != 3 || letters[0].Reason != "delivery attempts exhausted" {
+		t.Errorf("Consume failed: expected the message dead-lettered got %v\n", letters)
+	}
+}
+
+func TestRedisReclaimBehindPending(t *testing.T) {
+	mq, _ := runRedis(t, AckTimeout(time.Second), DrainTimeout(10*time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := mq.declare(ctx, "urlstatus"); err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{"http://a.example", "http://b.example", "http://c.example"} {
+		msg, _ := Encode(JSON, "agent-1", sample{url, true})
+		mq.Produce(ctx, "urlstatus", msg)
+	}
+	// A consumer crashes with every message pending, another one claims the
+	// first two and is still working on them
+	streams, err := mq.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: "urlstatus", Consumer: "crashed", Streams: []string{"urlstatus", ">"}, Count: 3,
+	}).Result()
+	if err != nil || len(streams[0].Messages) != 3 {
+		t.Fatalf("XReadGroup failed: expected 3 messages got %v (%v)\n", streams, err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	mq.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream: "urlstatus", Group: "urlstatus", Consumer: "alive",
+		Messages: []string{streams[0].Messages[0].ID, streams[0].Messages[1].ID},
+	})
+
+	// The message idle behind the ones in progress is claimed right away
+	deliveries := make(chan Delivery)
+	go mq.Consume(ctx, "urlstatus", 1, deliveries)
+	select {
+	case d := <-deliveries:
+		var s sample
+		if err := d.Decode(&s); err != nil || s.Url != "http://c.example" {
+			t.Errorf("Consume failed: expected http://c.example got %v (%v)\n", s.Url, err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Errorf("Consume failed: expected the idle message claimed\n")
+	}
+}
+
+func TestRedisMaxLen(t *testing.T) {
+	mq, s := runRedis(t, MaxLen(10))
+	msg, _ := Encode(JSON, "agent-1", sample{"http://example.com", true})
+	for i := 0; i < 100; i++ {
+		if err := mq.Produce(context.Background(), "urlstatus", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Trimming is approximate, the stream is kept around the limit
+	entries, _ := s.Stream("urlstatus")
+	if len(entries) >= 100 {
+		t.Errorf("Produce failed: expected the stream trimmed got %d entries\n", len(entries))
+	}
+}
+
+func TestRedisPublishSubscribe(t *testing.T) {
+	mq, _ := runRedis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first, second := make(chan Delivery), make(chan Delivery)
+	go mq.Subscribe(ctx, "membership", first)
+	go mq.Subscribe(ctx, "membership", second)
+	// Pub/Sub channels keep nothing for late subscribers
+	time.Sleep(100 * time.Millisecond)
+
+	msg, _ := Encode(MsgPack, "agent-1", sample{"http://example.com", true})
+	if err := mq.Publish(ctx, "membership", msg); err != nil {
+		t.Fatal(err)
+	}
+	for _, deliveries := range []chan Delivery{first, second} {
+		var s sample
+		d := receive(t, deliveries)
+		if err := d.Decode(&s); err != nil || s.Url != "http://example.com" || d.Headers.AgentID != "agent-1" {
+			t.Errorf("Subscribe failed: expected http://example.com got %v (%v)\n", s.Url, err)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package messaging
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// redacted replaces the credentials hidden from the log output
+const redacted = "xxxxx"
+
+// SecurityConfig holds the TLS and credential settings of the connection
+// to a broker. `CAFile` is a PEM bundle of the authorities verifying the
+// broker, `CertFile` and `KeyFile` the PEM client certificate and key. The
+// credentials are read from files, e.g. Docker or Kubernetes secrets,
+// rather than carried by the URL, falling back to those of the URL if not
+// set.
+type SecurityConfig struct {
+	CAFile       string `yaml:"ca_file,omitempty"`
+	CertFile     string `yaml:"cert_file,omitempty"`
+	KeyFile      string `yaml:"key_file,omitempty"`
+	UsernameFile string `yaml:"username_file,omitempty"`
+	PasswordFile string `yaml:"password_file,omitempty"`
+}
+
+// Security set the TLS and credential settings of the connection
+func Security(c SecurityConfig) option {
+	return func(o *options) {
+		o.security = c
+	}
+}
+
+// tlsConfig return the TLS configuration of the connection, nil if neither
+// a CA bundle nor a client certificate is set
+func (c SecurityConfig) tlsConfig() (*tls.Config, error) {
+	if c.CAFile == "" && c.CertFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + c.CAFile)
+		}
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// credentials return the username and the password of the connection, read
+// from the files set or from the URL, the password read is redacted from
+// the log output
+func (c SecurityConfig) credentials(rawurl string) (string, string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", "", err
+	}
+	username := u.User.Username()
+	password, _ := u.User.Password()
+	if c.UsernameFile != "" {
+		if username, err = readSecret(c.UsernameFile); err != nil {
+			return "", "", err
+		}
+	}
+	if c.PasswordFile != "" {
+		if password, err = readSecret(c.PasswordFile); err != nil {
+			return "", "", err
+		}
+		secrets.add(password)
+	}
+	return username, password, nil
+}
+
+// readSecret return the content of a secret file, without the trailing
+// newline
+func readSecret(path string) (string, error) {
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(secret), "\r\n"), nil
+}
+
+// secretSet is a set of the secrets read from files, redacted from the log
+// output wherever they appear
+type secretSet struct {
+	mutex   sync.RWMutex
+	secrets map[string]bool
+}
+
+// secrets are the secrets read so far
+var secrets = &secretSet{secrets: make(map[string]bool)}
+
+// add add a secret to the set
+func (s *secretSet) add(secret string) {
+	if secret == "" {
+		return
+	}
+	s.mutex.Lock()
+	s.secrets[secret] = true
+	s.mutex.Unlock()
+}
+
+// redact replace every secret of the set in a text
+func (s *secretSet) redact(text string) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for secret := range s.secrets {
+		text = strings.ReplaceAll(text, secret, redacted)
+	}
+	return text
+}
+
+// userinfoPassword matches the password in the userinfo of the URLs
+var userinfoPassword = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^:/@\s]*):[^@/\s]*@`)
+
+// Redact return a text with the passwords of the URLs, and those read from
+// files, replaced
+func Redact(text string) string {
+	return secrets.redact(userinfoPassword.ReplaceAllString(text, "${1}:"+redacted+"@"))
+}
+
+// redactedError hides the credentials in the message of an error
+type redactedError struct {
+	err error
+}
+
+func (e redactedError) Error() string { return Redact(e.err.Error()) }
+
+func (e redactedError) Unwrap() error { return e.err }
+
+// redactor is an `io.Writer` redacting the credentials in what's written
+type redactor struct {
+	w io.Writer
+}
+
+// Write write a redacted copy of p, the log package writes a line at once
+func (r redactor) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Redacting return a writer redacting the credentials in what's written to
+// w, to be set as the output of the loggers
+func Redacting(w io.Writer) io.Writer {
+	return redactor{w}
+}
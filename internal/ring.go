@@ -0,0 +1,122 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package internal
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DefaultReplicas is the default number of virtual nodes placed on the ring
+// for each member, the higher the smoother the distribution of the keys
+const DefaultReplicas = 64
+
+// HashRing is a consistent hash ring, keys are assigned to the first member
+// found walking the ring clockwise from their hash, so adding or removing a
+// member only moves the keys it owns, or is going to own, leaving every other
+// assignment untouched
+type HashRing struct {
+	replicas int
+	hashes   []uint32
+	owners   map[uint32]string
+	members  []string
+}
+
+// NewHashRing create a new `HashRing` with a number of virtual nodes for each
+// member, a non positive number of replicas fallback to `DefaultReplicas`
+func NewHashRing(replicas int, members ...string) *HashRing {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	r := &HashRing{replicas: replicas, owners: make(map[uint32]string)}
+	for _, member := range members {
+		r.add(member)
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	sort.Strings(r.members)
+	return r
+}
+
+// add place the virtual nodes of a member on the ring, on hash collisions
+// the lowest member name wins, to keep the ring independent of the order
+// the members are added
+func (r *HashRing) add(member string) {
+	for _, m := range r.members {
+		if m == member {
+			return
+		}
+	}
+	r.members = append(r.members, member)
+	for i := 0; i < r.replicas; i++ {
+		h := hash(member + "#" + strconv.Itoa(i))
+		if owner, ok := r.owners[h]; ok {
+			if member < owner {
+				r.owners[h] = member
+			}
+			continue
+		}
+		r.owners[h] = member
+		r.hashes = append(r.hashes, h)
+	}
+}
+
+// Members return the sorted list of members of the ring
+func (r *HashRing) Members() []string {
+	return r.members
+}
+
+// Owner return the member owning a key, an empty string if the ring is empty
+func (r *HashRing) Owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+// hash return the 32 bit FNV-1a hash of a string
+func hash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// Partition return the partition an URL belongs to, out of a fixed number of
+// partitions
+func Partition(url URL, partitions int) int {
+	return int(hash(url) % uint32(partitions))
+}
+
+// PartitionQueue return the name of the queue of a partition
+func PartitionQueue(queue string, partition int) string {
+	return queue + "." + strconv.Itoa(partition)
+}
@@ -0,0 +1,72 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package internal
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashRingOwner(t *testing.T) {
+	empty := NewHashRing(0)
+	if owner := empty.Owner("http://localhost"); owner != "" {
+		t.Errorf("HashRing.Owner failed: expected no owner got %s\n", owner)
+	}
+	r1 := NewHashRing(0, "agent-1", "agent-2", "agent-3")
+	r2 := NewHashRing(0, "agent-3", "agent-1", "agent-2")
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("http://server-%d", i)
+		owner := r1.Owner(key)
+		if owner != r2.Owner(key) {
+			t.Errorf("HashRing.Owner failed: expected %s got %s\n", owner, r2.Owner(key))
+		}
+		counts[owner]++
+	}
+	for _, member := range r1.Members() {
+		if counts[member] < 200 {
+			t.Errorf("HashRing.Owner failed: expected at least 200 keys for %s got %d\n",
+				member, counts[member])
+		}
+	}
+}
+
+func TestHashRingRebalance(t *testing.T) {
+	before := NewHashRing(0, "agent-1", "agent-2", "agent-3")
+	after := NewHashRing(0, "agent-1", "agent-2")
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("http://server-%d", i)
+		owner := before.Owner(key)
+		// Only the keys owned by the member leaving are moved
+		if owner != "agent-3" && after.Owner(key) != owner {
+			t.Errorf("HashRing.Owner failed: expected %s got %s\n", owner, after.Owner(key))
+		}
+		if after.Owner(key) == "agent-3" {
+			t.Errorf("HashRing.Owner failed: expected a member of the ring got agent-3\n")
+		}
+	}
+}
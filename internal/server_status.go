@@ -34,23 +34,61 @@ import (
 
 type URL = string
 
+// AgentInfo identifies the agent which probed a server, its name is
+// expected to be unique, the region is the location it probes from
+type AgentInfo struct {
+	Name   string            `json:"name" yaml:"name"`
+	Region string            `json:"region" yaml:"region"`
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
 // ServerStatus defines the current state of a monitored server, URL to
 // identify it, alive status, response time of the last request along with the
-// status code and content
+// status code and content. CertExpiry is set only for TLS endpoints and
+// carries the expiration date of the leaf certificate presented by the server,
+// Assertions the results of the target assertions, if any. Agent identifies
+// the agent which performed the probe
 type ServerStatus struct {
-	Url             URL           `json:"url"`
-	Alive           bool          `json:"alive"`
-	ResponseTime    time.Duration `json:"response_time"`
-	ResponseStatus  int           `json:"response_status"`
-	ResponseContent string        `json:"response_content"`
+	Url             URL               `json:"url"`
+	Agent           AgentInfo         `json:"agent"`
+	Tags            []string          `json:"tags,omitempty"`
+	Alive           bool              `json:"alive"`
+	ResponseTime    time.Duration     `json:"response_time"`
+	ResponseStatus  int               `json:"response_status"`
+	ResponseContent string            `json:"response_content"`
+	CertExpiry      time.Time         `json:"cert_expiry"`
+	Assertions      []AssertionResult `json:"assertions,omitempty"`
 }
 
 // Stats holds the collected stats for each server ready to be dispatched to a
-// front-end client
+// front-end client, State is one of "up", "down", "flapping" or "unknown",
+// the latter when too few agents report to reach a quorum, Maintenance
+// is the name of the maintenance window in effect, if any, SLOs the status
+// of every objective declared for the server and Locations the breakdown of
+// the stats by each agent probing the server. When a quorum of agents is
+// required to declare a server down, FailingAgents lists the agents seeing it
+// down and OutlierAgent is the single agent seeing it down, if any.
 type Stats struct {
-	Url             URL           `json:"url"`
+	Url             URL             `json:"url"`
+	Alive           bool            `json:"alive"`
+	State           string          `json:"state"`
+	Maintenance     string          `json:"maintenance,omitempty"`
+	SLOs            []SLOStatus     `json:"slos,omitempty"`
+	AvgResponseTime time.Duration   `json:"avg_response_time"`
+	Availability    float64         `json:"availability"`
+	StatusCodes     map[int]int     `json:"status_codes"`
+	Locations       []LocationStats `json:"locations,omitempty"`
+	FailingAgents   []string        `json:"failing_agents,omitempty"`
+	OutlierAgent    string          `json:"outlier_agent,omitempty"`
+}
+
+// LocationStats holds the stats of a server as seen by a single agent
+type LocationStats struct {
+	Agent           string        `json:"agent"`
+	Region          string        `json:"region"`
 	Alive           bool          `json:"alive"`
+	State           string        `json:"state"`
+	Outlier         bool          `json:"outlier"`
 	AvgResponseTime time.Duration `json:"avg_response_time"`
 	Availability    float64       `json:"availability"`
-	StatusCodes     map[int]int   `json:"status_codes"`
 }
@@ -0,0 +1,89 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestJSONFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.json")
+	var missing []Target
+	if err := LoadJSONFile(path, &missing); err != nil || missing != nil {
+		t.Errorf("LoadJSONFile failed: expected nothing loaded got %v %v\n", missing, err)
+	}
+	targets := []Target{{Url: "http://a", Interval: 30 * time.Second, Tags: []string{"web"}}}
+	if err := SaveJSONFile(path, targets); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("SaveJSONFile failed: expected no temporary file left got %v\n", err)
+	}
+	var loaded []Target
+	if err := LoadJSONFile(path, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, targets) {
+		t.Errorf("LoadJSONFile failed: expected %v got %v\n", targets, loaded)
+	}
+}
+
+func TestNewID(t *testing.T) {
+	a, err := NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewID()
+	if len(a) != 16 || a == b {
+		t.Errorf("NewID failed: expected two distinct 16 chars IDs got %s %s\n", a, b)
+	}
+}
+
+func TestSelectorApplies(t *testing.T) {
+	s := Selector{Targets: []URL{"http://a"}, Tags: []string{"db"}}
+	cases := []struct {
+		target   Target
+		expected bool
+	}{
+		{Target{Url: "http://a"}, true},
+		{Target{Url: "http://b", Tags: []string{"web", "db"}}, true},
+		{Target{Url: "http://c", Tags: []string{"web"}}, false},
+	}
+	for _, c := range cases {
+		if got := s.Applies(c.target); got != c.expected {
+			t.Errorf("Selector.Applies failed: expected %v got %v for %v\n",
+				c.expected, got, c.target)
+		}
+	}
+	if !(Selector{}).Empty() || s.Empty() {
+		t.Errorf("Selector.Empty failed: expected only the zero selector empty\n")
+	}
+}
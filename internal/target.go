@@ -0,0 +1,152 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package internal
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Probe types supported by the agents
+const (
+	ProbeHTTP = "http"
+)
+
+// Target is a monitored server, identified by its URL and optionally tagged
+// to be selected as a group, e.g. by maintenance windows. Assertions are
+// checked against every probe response. Targets managed through the
+// registry carry an ID and an owner, the probe type, HTTP by default, and
+// may override the probing interval of the agent.
+type Target struct {
+	ID         string        `yaml:"id,omitempty" json:"id,omitempty"`
+	Url        URL           `yaml:"url" json:"url"`
+	Probe      string        `yaml:"probe,omitempty" json:"probe,omitempty"`
+	Interval   time.Duration `yaml:"interval,omitempty" json:"interval,omitempty"`
+	Tags       []string      `yaml:"tags,omitempty" json:"tags,omitempty"`
+	Assertions []Assertion   `yaml:"assertions,omitempty" json:"assertions,omitempty"`
+	Owner      string        `yaml:"owner,omitempty" json:"owner,omitempty"`
+}
+
+// MarshalJSON encode the interval as a duration string, e.g. "30s"
+func (t Target) MarshalJSON() ([]byte, error) {
+	type plain Target
+	return json.Marshal(struct {
+		plain
+		Interval Duration `json:"interval,omitempty"`
+	}{plain(t), Duration(t.Interval)})
+}
+
+// UnmarshalJSON decode a target with the interval expressed as a duration
+// string
+func (t *Target) UnmarshalJSON(data []byte) error {
+	type plain Target
+	aux := struct {
+		*plain
+		Interval Duration `json:"interval,omitempty"`
+	}{plain: (*plain)(t)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	t.Interval = time.Duration(aux.Interval)
+	return nil
+}
+
+// UnmarshalYAML allows a target to be defined either by its bare URL or as
+// a mapping with URL and tags
+func (t *Target) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var url URL
+	if err := unmarshal(&url); err == nil {
+		t.Url = url
+		return nil
+	}
+	type plain Target
+	return unmarshal((*plain)(t))
+}
+
+// HasTag return true if the target is tagged with a given tag
+func (t Target) HasTag(tag string) bool {
+	for _, tt := range t.Tags {
+		if tt == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// TargetsFromURLs create a list of untagged targets from a list of URLs
+func TargetsFromURLs(urls []URL) []Target {
+	targets := make([]Target, len(urls))
+	for i, url := range urls {
+		targets[i] = Target{Url: url}
+	}
+	return targets
+}
+
+// Actions of the target change events published by the registry
+const (
+	TargetCreated   = "created"
+	TargetUpdated   = "updated"
+	TargetDeleted   = "deleted"
+	TargetsSnapshot = "snapshot"
+)
+
+// TargetEvent is a change to the targets of the registry, a snapshot event
+// carries the whole set of targets in `Targets` while the others carry the
+// single target changed
+type TargetEvent struct {
+	Action  string   `json:"action"`
+	Target  Target   `json:"target,omitempty"`
+	Targets []Target `json:"targets,omitempty"`
+}
+
+// Duration is a `time.Duration` encoded in JSON as a human readable string
+// like "1h30m", a zero duration is omitted by `omitempty`
+type Duration time.Duration
+
+// MarshalJSON encode the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decode a duration expressed as a string, an empty string
+// decodes to zero
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s == "" {
+		*d = 0
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
@@ -31,6 +31,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
+
+	"github.com/codepr/overseer/internal/messaging"
 )
 
 // ValidateConfigPath just makes sure, that the path provided is a file,
@@ -46,6 +48,16 @@ func ValidateConfigPath(path string) error {
 	return nil
 }
 
+// Hostname return the host name or a default value if it can't be
+// retrieved, used as default name of the service instances
+func Hostname(defaultVal string) string {
+	name, err := os.Hostname()
+	if err != nil {
+		return defaultVal
+	}
+	return name
+}
+
 // Simple helper function to read an environment or return a default value
 func GetEnv(key string, defaultVal string) string {
 	if value, exists := os.LookupEnv(key); exists {
@@ -87,3 +99,36 @@ func GetEnvAsSlice(name string, defaultVal []string, sep string) []string {
 
 	return val
 }
+
+// Helper to read an environment variable into a string map or return default
+// value, pairs are separated by `sep` and keys from values by `kvsep`
+func GetEnvAsMap(name string, defaultVal map[string]string, sep, kvsep string) map[string]string {
+	valStr := GetEnv(name, "")
+
+	if valStr == "" {
+		return defaultVal
+	}
+
+	val := make(map[string]string)
+	for _, pair := range strings.Split(valStr, sep) {
+		kv := strings.SplitN(pair, kvsep, 2)
+		if len(kv) == 2 {
+			val[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+
+	return val
+}
+
+// Helper to read the TLS and credential settings of the connection to the
+// message queue from the environment, the credentials are read from the
+// files at QUEUE_USERNAME_FILE and QUEUE_PASSWORD_FILE, e.g. secrets
+func GetEnvAsSecurity() messaging.SecurityConfig {
+	return messaging.SecurityConfig{
+		CAFile:       GetEnv("QUEUE_CA_FILE", ""),
+		CertFile:     GetEnv("QUEUE_CERT_FILE", ""),
+		KeyFile:      GetEnv("QUEUE_KEY_FILE", ""),
+		UsernameFile: GetEnv("QUEUE_USERNAME_FILE", ""),
+		PasswordFile: GetEnv("QUEUE_PASSWORD_FILE", ""),
+	}
+}